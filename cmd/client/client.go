@@ -22,15 +22,20 @@ along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
 package main
 
 import (
-	"encoding/gob"
+	"cosmofs"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"time"
 )
 
 var (
 	verbose *bool = flag.Bool("v", false, "Verbose mode")
+	control *string = flag.String("control", defaultControl(), "Address of the local control endpoint of the server")
 
 	list_dirs *bool = flag.Bool("dirs", false, "List directories")
 	list_dir_id *string = flag.String("dirID", "", "List directories for ID")
@@ -44,87 +49,141 @@ var (
 	search_file *string = flag.String("sFile", "", "Search File")
 
 	open_file *string = flag.String("file", "", "Open File")
-)
 
-const (
-	PORT int = 5453
+	list_fingerprints *bool = flag.Bool("fingerprints", false, "List the key fingerprints of known peers")
+	accept_key *string = flag.String("acceptKey", "", "Accept the changed key of a known peer")
+
+	export_peers *string = flag.String("exportPeers", "", "Export known peers to a file (- for stdout)")
+	import_peers *string = flag.String("importPeers", "", "Import known peers from a file")
+
+	deny_peer *string = flag.String("deny", "", "Deny an ID or key fingerprint")
+	allow_peer *string = flag.String("allow", "", "Remove an ID or key fingerprint from the deny list")
+	list_denied *bool = flag.Bool("denied", false, "List denied IDs and key fingerprints")
+	connect_peer *string = flag.String("connect", "", "Connect to the peer at host:port")
+	find_peer *string = flag.String("findPeer", "", "Find the address of an ID in the DHT")
+	find_file *string = flag.String("findFile", "", "Find the peers sharing a file in the DHT")
+	revoke_key *bool = flag.Bool("revokeMyKey", false, "Publish the revocation of our own key, when it has been compromised")
 )
 
+// defaultControl returns the control endpoint of the server, which can be
+// changed with COSMOFSCONTROL like in the server.
+func defaultControl() string {
+	if addr := os.Getenv("COSMOFSCONTROL"); addr != "" {
+		return addr
+	}
+
+	return cosmofs.DefaultControlAddr
+}
+
+// exitCodes are the exit codes of the errors of the server, by their code.
+// Any other error exits with 1, and 2 is left to flag for usage errors.
+var exitCodes = map[cosmofs.ErrorCode]int{
+	cosmofs.CodeNotFound: 10,
+	cosmofs.CodeInvalidID: 11,
+	cosmofs.CodeInvalidPath: 12,
+	cosmofs.CodePermissionDenied: 13,
+	cosmofs.CodePeerOffline: 14,
+	cosmofs.CodeTimeout: 15,
+	cosmofs.CodeIntegrity: 16,
+}
+
+// fatal prints the message and exits with the code of err.
+func fatal(err error, format string, v ...interface{}) {
+	log.Printf(format, v...)
+
+	var e *cosmofs.WireError
+
+	if errors.As(err, &e) {
+		if code, ok := exitCodes[e.Code]; ok {
+			os.Exit(code)
+		}
+	}
+
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(flag.CommandLine.Output(), "\nExit status: 10 not found, 11 invalid ID, 12 invalid path, "+
+		"13 permission denied, 14 peer offline, 15 timeout, 16 integrity failure, 2 usage error, "+
+		"1 any other error.\n")
+}
+
 func debug (format string, v ...interface{}) {
 	if *verbose {
-		log.Printf(format, v)
+		log.Printf(format, v...)
 	}
 }
 
 func main () {
+	flag.Usage = usage
 	flag.Parse()
 
-	conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{
-		IP:		net.IPv4(127,0,0,1),
-		Port:	PORT,
-	})
+	conn, err := net.Dial("tcp", *control)
 
 	if err != nil {
-		log.Fatalf("Error: %s\n", err)
+		fatal(err, "Error: %s\n", err)
 		return
 	}
 
 	defer conn.Close()
 
-	decod := gob.NewDecoder(conn)
-
 	if *list_dirs {
 		fmt.Printf("List directories\n")
-		//fmt.Fprintf(conn, "List Directories\n")
-		_, err = conn.Write([]byte("List Directories\n"))
 
-		if err != nil {
-			log.Fatalf("Error: %s\n", err)
-		}
+		var dirs cosmofs.ListResponse
 
-		var dirs []string
+		err = cosmofs.Call(conn, cosmofs.MsgListDirs, nil, &dirs)
 
-		decod.Decode(&dirs)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
+		}
 
-		for _, v := range dirs {
+		for _, v := range dirs.Items {
 			fmt.Println(v)
 		}
 	}
 
 	if *list_known_ids {
 		fmt.Printf("List Known IDs\n")
-		_, err = conn.Write([]byte("List Known IDs\n"))
 
-		if err != nil {
-			log.Fatalf("Error: %s\n", err)
-		}
+		var ids cosmofs.ListResponse
 
-		var ids []string
+		err = cosmofs.Call(conn, cosmofs.MsgListKnownIDs, nil, &ids)
 
-		decod.Decode(&ids)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
+		}
 
-		for _, v := range ids {
+		for _, v := range ids.Items {
 			fmt.Println(v)
 		}
 	}
 
 	if *list_connected_ids {
 		fmt.Printf("List connected IDs\n")
-		_, err = conn.Write([]byte("List Connected IDs\n"))
+
+		var ids cosmofs.StatusResponse
+
+		err = cosmofs.Call(conn, cosmofs.MsgPeerStatus, nil, &ids)
 
 		if err != nil {
-			log.Fatalf("Error: %s\n", err)
+			fatal(err, "Error: %s\n", err)
 		}
 
-		var ids map[string]string
+		for _, v := range ids.Peers {
+			if v.Reconnecting {
+				fmt.Printf("%s - %s (reconnecting, %d attempts failed, next in %v: %s)\n", v.ID, v.Addr,
+					v.Attempts, time.Until(v.NextAttempt).Round(time.Second), v.LastError)
+				continue
+			}
 
-		decod.Decode(&ids)
-
-		for k, v := range ids {
-			fmt.Println(k+" - "+v)
+			fmt.Printf("%s - %s (last seen %v ago, rtt %v)\n", v.ID, v.Addr,
+				time.Since(v.LastSeen).Round(time.Second), v.RTT)
 		}
 
-		if ids == nil {
+		if ids.Peers == nil {
 			fmt.Printf("There are no IDs connected\n")
 		}
 	}
@@ -132,27 +191,19 @@ func main () {
 	if *list_dir_id != "" {
 		fmt.Printf("Listing directories for ID %s\n", *list_dir_id)
 
-		_, err = conn.Write([]byte("List Directories ID\n"))
+		var dirs cosmofs.ListResponse
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
-		}
+		err = cosmofs.Call(conn, cosmofs.MsgListDirsID, cosmofs.IDRequest{ID: *list_dir_id}, &dirs)
 
-		_, err = conn.Write([]byte(*list_dir_id+"\n"))
-
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
 
-		var dirs []string
-
-		decod.Decode(&dirs)
-
-		for _, v := range dirs {
+		for _, v := range dirs.Items {
 			fmt.Println(v)
 		}
 
-		if dirs == nil {
+		if dirs.Items == nil {
 			fmt.Printf("There are no entries for ID %s\n", *list_dir_id)
 		}
 	}
@@ -160,139 +211,236 @@ func main () {
 	if *list_dir != "" {
 		fmt.Printf("Listing directory %s\n", *list_dir)
 
-		_, err = conn.Write([]byte("List Directory\n"))
+		var files cosmofs.ListResponse
+
+		err = cosmofs.Call(conn, cosmofs.MsgListDir, cosmofs.PathRequest{Path: *list_dir}, &files)
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
 
-		_, err = conn.Write([]byte(*list_dir+"\n"))
+		for _, v := range files.Items {
+			fmt.Println(v)
+		}
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if files.Items == nil {
+			fmt.Printf("There are no entries for Directory %s\n", *list_dir)
 		}
+	}
 
-		var files []string
+	for _, s := range []struct {
+		query string
+		t cosmofs.MsgType
+	}{{*search, cosmofs.MsgSearch}, {*search_dir, cosmofs.MsgSearchDir}, {*search_file, cosmofs.MsgSearchFile}} {
+		if s.query == "" {
+			continue
+		}
+
+		fmt.Printf("Searching for %s\n", s.query)
 
-		decod.Decode(&files)
+		var result cosmofs.ListResponse
 
-		for _, v := range files {
+		err = cosmofs.Call(conn, s.t, cosmofs.QueryRequest{Query: s.query}, &result)
+
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
+		}
+
+		for _, v := range result.Items {
 			fmt.Println(v)
 		}
 
-		if files == nil {
-			fmt.Printf("There are no entries for Directory %s\n", *list_dir)
+		if result.Items == nil {
+			fmt.Printf("There are no entries for %s\n", s.query)
 		}
 	}
 
-	if *search != "" {
-		fmt.Printf("Searching for %s\n", *search)
+	if *open_file != "" {
+		fmt.Printf("Opening file %s\n", *open_file)
+
+		var file cosmofs.FileContent
 
-		_, err = conn.Write([]byte("Search\n"))
+		err = cosmofs.Call(conn, cosmofs.MsgLocalOpenFile, cosmofs.PathRequest{Path: *open_file}, &file)
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "It wasn't possible to open %v: %s\n", *open_file, err)
 		}
 
-		_, err = conn.Write([]byte(*search+"\n"))
+		fmt.Printf("%s", string(file.Content))
+	}
+
+	if *list_fingerprints {
+		fmt.Printf("List fingerprints of known peers\n")
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		var list cosmofs.FingerprintsResponse
+
+		err = cosmofs.Call(conn, cosmofs.MsgListFingerprints, nil, &list)
+
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
 
-		var result []string
+		for _, v := range list.Peers {
+			fmt.Println(v.ID+" "+v.Fingerprint)
 
-		decod.Decode(&result)
+			if v.Pending != "" {
+				fmt.Println("\tCHANGED KEY REFUSED: "+v.Pending)
+			}
+		}
 
-		for _, v := range result {
-			fmt.Println(v)
+		if list.Peers == nil {
+			fmt.Printf("There are no known peers\n")
 		}
+	}
+
+	if *accept_key != "" {
+		fmt.Printf("Accepting changed key of %s\n", *accept_key)
 
-		if result == nil {
-			fmt.Printf("There are no entries for %s\n", *search)
+		err = cosmofs.Call(conn, cosmofs.MsgAcceptKey, cosmofs.IDRequest{ID: *accept_key}, nil)
+
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
+
+		fmt.Printf("The new key of %s is now trusted\n", *accept_key)
 	}
 
-	if *search_dir != "" {
-		fmt.Printf("Searching for %s\n", *search_dir)
+	if *export_peers != "" {
+		var data cosmofs.DataMessage
 
-		_, err = conn.Write([]byte("Search Directory\n"))
+		err = cosmofs.Call(conn, cosmofs.MsgExportPeers, nil, &data)
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
+		}
+
+		if *export_peers == "-" {
+			os.Stdout.Write(data.Data)
+			return
 		}
 
-		_, err = conn.Write([]byte(*search_dir+"\n"))
+		err = ioutil.WriteFile(*export_peers, data.Data, 0644)
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
 
-		var result []string
+		fmt.Printf("Known peers exported to %s\n", *export_peers)
+	}
+
+	if *import_peers != "" {
+		fmt.Printf("Importing peers from %s\n", *import_peers)
 
-		decod.Decode(&result)
+		data, err := ioutil.ReadFile(*import_peers)
 
-		for _, v := range result {
-			fmt.Println(v)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
 
-		if result == nil {
-			fmt.Printf("There are no entries for %s\n", *search_dir)
+		var result cosmofs.ResultResponse
+
+		err = cosmofs.Call(conn, cosmofs.MsgImportPeers, cosmofs.DataMessage{Data: data}, &result)
+
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
+
+		fmt.Println(result.Result)
 	}
 
-	if *search_file != "" {
-		fmt.Printf("Searching for %s\n", *search_file)
+	if *deny_peer != "" {
+		fmt.Printf("Denying %s\n", *deny_peer)
 
-		_, err = conn.Write([]byte("Search File\n"))
+		err = cosmofs.Call(conn, cosmofs.MsgDenyPeer, cosmofs.EntryRequest{Entry: *deny_peer}, nil)
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
+	}
+
+	if *connect_peer != "" {
+		fmt.Printf("Connecting to %s\n", *connect_peer)
+
+		var result cosmofs.ResultResponse
 
-		_, err = conn.Write([]byte(*search_file+"\n"))
+		err = cosmofs.Call(conn, cosmofs.MsgConnectPeer, cosmofs.AddrRequest{Addr: *connect_peer}, &result)
 
-		if err !=nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
 
-		var result []string
+		fmt.Println(result.Result)
+	}
+
+	if *find_peer != "" || *find_file != "" {
+		var contacts cosmofs.ContactsResponse
 
-		decod.Decode(&result)
+		var req interface{} = cosmofs.IDRequest{ID: *find_peer}
+		t, what := cosmofs.MsgFindPeer, *find_peer
 
-		for _, v := range result {
-			fmt.Println(v)
+		if *find_file != "" {
+			req = cosmofs.NameRequest{Name: *find_file}
+			t, what = cosmofs.MsgFindFile, *find_file
 		}
 
-		if result == nil {
-			fmt.Printf("There are no entries for %s\n", *search_file)
+		fmt.Printf("Finding %s\n", what)
+
+		err = cosmofs.Call(conn, t, req, &contacts)
+
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
+		}
+
+		for _, v := range contacts.Contacts {
+			fmt.Printf("%s - %s\n", v.ID, v.Addr)
+		}
+
+		if contacts.Contacts == nil {
+			fmt.Printf("%s not found\n", what)
 		}
 	}
 
-	if *open_file != "" {
-		fmt.Printf("Opening file %s\n", *open_file)
+	if *allow_peer != "" {
+		fmt.Printf("Allowing %s\n", *allow_peer)
 
-		_, err = conn.Write([]byte("Open File\n"))
+		err = cosmofs.Call(conn, cosmofs.MsgAllowPeer, cosmofs.EntryRequest{Entry: *allow_peer}, nil)
 
-		if err!= nil {
-			log.Fatalf("Error: %s\n", err)
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
+	}
+
+	if *list_denied {
+		fmt.Printf("List denied peers\n")
+
+		var list cosmofs.ListResponse
 
-		_, err = conn.Write([]byte(*open_file+"\n"))
+		err = cosmofs.Call(conn, cosmofs.MsgListDenied, nil, &list)
 
 		if err != nil {
-			log.Fatalf("Error: %s\n", err)
+			fatal(err, "Error: %s\n", err)
 		}
 
-		var file []byte
+		for _, v := range list.Items {
+			fmt.Println(v)
+		}
 
-		decod.Decode(&file)
+		if list.Items == nil {
+			fmt.Printf("There are no denied peers\n")
+		}
+	}
 
-		if file == nil {
-			fmt.Printf("It wasn't possible to open %v\n", *open_file)
-			return
+	if *revoke_key {
+		fmt.Printf("Revoking our key\n")
+
+		var result cosmofs.ResultResponse
+
+		err = cosmofs.Call(conn, cosmofs.MsgRevokeKey, nil, &result)
+
+		if err != nil {
+			fatal(err, "Error: %s\n", err)
 		}
 
-		fmt.Printf("%s", string(file))
+		fmt.Println(result.Result)
 	}
 }
@@ -0,0 +1,184 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	challengeSize int = 32
+	challengeContext string = "cosmofs-challenge-v1"
+)
+
+var (
+	ErrBadChallenge = errors.New("cosmofs: malformed challenge")
+	ErrAuthFailed = newError(ErrPermissionDenied, "cosmofs: peer failed to prove possession of its key")
+)
+
+// challenge is sent by the verifier. The prover signs the nonce together with
+// both IDs, so the answer cannot be replayed against a different peer.
+type challenge struct {
+	ID string
+	Nonce []byte
+}
+
+// challengeDigest returns the hash that the prover has to sign.
+func challengeDigest(verifierID, proverID string, nonce []byte) []byte {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", challengeContext, verifierID, proverID)
+	h.Write(nonce)
+
+	return h.Sum(nil)
+}
+
+// Challenge sends a fresh nonce to the remote peer and checks that the answer
+// is a signature made with the private key that matches peer.PubKey. It must
+// succeed before the peer is stored or any of its data is trusted.
+func (n *Node) Challenge(encod *gob.Encoder, decod *gob.Decoder, peer *Peer) (err error) {
+	if peer == nil || peer.PubKey == nil {
+		return ErrAuthFailed
+	}
+
+	nonce := make([]byte, challengeSize)
+
+	_, err = rand.Read(nonce)
+
+	if err != nil {
+		return err
+	}
+
+	err = encod.Encode(challenge{
+		ID: n.pub.ID,
+		Nonce: nonce,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	var signature []byte
+
+	err = decod.Decode(&signature)
+
+	if err != nil {
+		return err
+	}
+
+	digest := challengeDigest(n.pub.ID, peer.ID, nonce)
+
+	return verifyDigest(peer.PubKey, digest, signature)
+}
+
+// AnswerChallenge receives a nonce from the remote peer and sends it back
+// signed with the private key of the node.
+func (n *Node) AnswerChallenge(encod *gob.Encoder, decod *gob.Decoder) (err error) {
+	var c challenge
+
+	err = decod.Decode(&c)
+
+	if err != nil {
+		return err
+	}
+
+	if len(c.Nonce) != challengeSize {
+		return ErrBadChallenge
+	}
+
+	digest := challengeDigest(c.ID, n.priv.id, c.Nonce)
+
+	signature, err := n.signDigest(digest)
+
+	if err != nil {
+		return err
+	}
+
+	return encod.Encode(signature)
+}
+
+// VerifyPeer makes sure the remote end of rw owns the key of peer. Over a
+// Session the handshake already proved it, so the keys only have to match.
+func (n *Node) VerifyPeer(rw io.ReadWriter, encod *gob.Encoder, decod *gob.Decoder, peer *Peer) (err error) {
+	if s, ok := rw.(*Session); ok {
+		if peer == nil || peer.ID != s.Peer.ID || !samePublicKey(s.Peer.PubKey, peer.PubKey) {
+			return ErrAuthFailed
+		}
+		return err
+	}
+
+	return n.Challenge(encod, decod, peer)
+}
+
+// ProvePeer is the counterpart of VerifyPeer.
+func (n *Node) ProvePeer(rw io.ReadWriter, encod *gob.Encoder, decod *gob.Decoder) (err error) {
+	if _, ok := rw.(*Session); ok {
+		return err
+	}
+
+	return n.AnswerChallenge(encod, decod)
+}
+
+// signDigest signs a SHA-256 digest with the private key of the node.
+// Ed25519 keys sign the digest itself as the message.
+func (n *Node) signDigest(digest []byte) (signature []byte, err error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+
+	if _, ok := n.priv.key.(ed25519.PrivateKey); ok {
+		opts = crypto.Hash(0)
+	}
+
+	return n.priv.key.Sign(rand.Reader, digest, opts)
+}
+
+// verifyDigest checks a signature made by signDigest.
+func verifyDigest(pub crypto.PublicKey, digest, signature []byte) (err error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, signature) {
+			err = ErrAuthFailed
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, digest, signature) {
+			err = ErrAuthFailed
+		}
+	default:
+		err = ErrAuthFailed
+	}
+
+	if err != nil {
+		return ErrAuthFailed
+	}
+
+	return err
+}
@@ -0,0 +1,50 @@
+package cosmofs
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/gob"
+	"net"
+	"testing"
+)
+
+func runChallenge(t *testing.T, n *Node, peer *Peer) error {
+	c1, c2 := net.Pipe()
+
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		n.AnswerChallenge(gob.NewEncoder(c2), gob.NewDecoder(c2))
+	}()
+
+	return n.Challenge(gob.NewEncoder(c1), gob.NewDecoder(c1), peer)
+}
+
+func TestChallenge(t *testing.T) {
+	n := newTestNode(t, "auth@cosmofs.es")
+
+	err := runChallenge(t, n, n.PublicPeer())
+
+	if err != nil {
+		t.Error("Failure in Challenge:", err)
+	}
+
+	// Somebody claiming our ID with another key must be rejected.
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+
+	if err != nil {
+		t.Fatal("Error generating key:", err)
+	}
+
+	impostor := &Peer{
+		ID: n.ID(),
+		PubKey: &key.PublicKey,
+	}
+
+	err = runChallenge(t, n, impostor)
+
+	if err != ErrAuthFailed {
+		t.Error("Failure in Challenge. Impostor should not pass:", err)
+	}
+}
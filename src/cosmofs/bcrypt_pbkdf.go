@@ -0,0 +1,204 @@
+/**
+
+Adapted for Cosmofs from golang.org/x/crypto/ssh/internal/bcrypt_pbkdf, which is distributed
+under the following license.
+
+Copyright 2014 The Go Authors. All rights reserved.
+
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+**/
+
+package cosmofs
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+)
+
+// bcryptPBKDF derives the key and IV of passphrase protected OpenSSH private
+// keys, following bcrypt_pbkdf(3) from OpenBSD. The Blowfish cipher below is
+// just what that function needs.
+func bcryptPBKDF(password, salt []byte, rounds, keyLen int) (key []byte, err error) {
+	if rounds < 1 {
+		return nil, errors.New("bcrypt_pbkdf: number of rounds is too small")
+	}
+
+	if len(password) == 0 {
+		return nil, errors.New("bcrypt_pbkdf: empty password")
+	}
+
+	if len(salt) == 0 || len(salt) > 1<<20 {
+		return nil, errors.New("bcrypt_pbkdf: bad salt length")
+	}
+
+	if keyLen > 1024 {
+		return nil, errors.New("bcrypt_pbkdf: keyLen is too large")
+	}
+
+	numBlocks := (keyLen + 32 - 1) / 32
+	key = make([]byte, numBlocks*32)
+
+	shapass := sha512.Sum512(password)
+	countsalt := make([]byte, len(salt)+4)
+	copy(countsalt, salt)
+
+	tmp := make([]byte, 32)
+	out := make([]byte, 32)
+
+	for block := 1; block <= numBlocks; block++ {
+		binary.BigEndian.PutUint32(countsalt[len(salt):], uint32(block))
+
+		shasalt := sha512.Sum512(countsalt)
+		bcryptHash(tmp, shapass[:], shasalt[:])
+		copy(out, tmp)
+
+		for i := 1; i < rounds; i++ {
+			shasalt = sha512.Sum512(tmp)
+			bcryptHash(tmp, shapass[:], shasalt[:])
+
+			for j := range out {
+				out[j] ^= tmp[j]
+			}
+		}
+
+		// The output is interleaved across the blocks.
+		for i, v := range out {
+			key[i*numBlocks+(block-1)] = v
+		}
+	}
+
+	return key[:keyLen], err
+}
+
+var bcryptMagic = []byte("OxychromaticBlowfishSwatDynamite")
+
+func bcryptHash(out, shapass, shasalt []byte) {
+	c := newBlowfish()
+	c.expandKeyWithSalt(shapass, shasalt)
+
+	for i := 0; i < 64; i++ {
+		c.expandKey(shasalt)
+		c.expandKey(shapass)
+	}
+
+	copy(out, bcryptMagic)
+
+	for i := 0; i < 32; i += 8 {
+		l := binary.BigEndian.Uint32(out[i:])
+		r := binary.BigEndian.Uint32(out[i+4:])
+
+		for j := 0; j < 64; j++ {
+			l, r = c.encrypt(l, r)
+		}
+
+		// bcrypt_hash stores the words in little endian order.
+		binary.LittleEndian.PutUint32(out[i:], l)
+		binary.LittleEndian.PutUint32(out[i+4:], r)
+	}
+}
+
+type blowfish struct {
+	p [18]uint32
+	s0, s1, s2, s3 [256]uint32
+}
+
+func newBlowfish() *blowfish {
+	return &blowfish{
+		p: blowfishP,
+		s0: blowfishS0,
+		s1: blowfishS1,
+		s2: blowfishS2,
+		s3: blowfishS3,
+	}
+}
+
+// nextWord reads four bytes from b as a cyclic stream.
+func nextWord(b []byte, pos *int) uint32 {
+	var w uint32
+
+	for i := 0; i < 4; i++ {
+		w = w<<8 | uint32(b[*pos])
+		*pos = (*pos + 1) % len(b)
+	}
+
+	return w
+}
+
+func (c *blowfish) expandKey(key []byte) {
+	c.expandKeyWithSalt(key, nil)
+}
+
+// expandKeyWithSalt is the Blowfish key schedule; with a nil salt it is the
+// plain "expand0state" one.
+func (c *blowfish) expandKeyWithSalt(key, salt []byte) {
+	j := 0
+
+	for i := range c.p {
+		c.p[i] ^= nextWord(key, &j)
+	}
+
+	j = 0
+
+	var l, r uint32
+
+	next := func(dst []uint32) {
+		for i := 0; i < len(dst); i += 2 {
+			if salt != nil {
+				l ^= nextWord(salt, &j)
+				r ^= nextWord(salt, &j)
+			}
+
+			l, r = c.encrypt(l, r)
+			dst[i], dst[i+1] = l, r
+		}
+	}
+
+	next(c.p[:])
+	next(c.s0[:])
+	next(c.s1[:])
+	next(c.s2[:])
+	next(c.s3[:])
+}
+
+func (c *blowfish) f(x uint32) uint32 {
+	return ((c.s0[x>>24] + c.s1[byte(x>>16)]) ^ c.s2[byte(x>>8)]) + c.s3[byte(x)]
+}
+
+func (c *blowfish) encrypt(l, r uint32) (uint32, uint32) {
+	l ^= c.p[0]
+
+	for i := 1; i <= 16; i += 2 {
+		r ^= c.f(l) ^ c.p[i]
+		l ^= c.f(r) ^ c.p[i+1]
+	}
+
+	r ^= c.p[17]
+
+	return r, l
+}
@@ -0,0 +1,245 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// BeaconVersion is the format of the announcements of this version.
+	BeaconVersion int = 1
+
+	// beaconMagic starts every beacon, so they are told apart from the
+	// announcements of legacy peers, which are just their ID.
+	beaconMagic string = "COSMOFS BEACON\n"
+	beaconContext string = "cosmofs-beacon-v1"
+
+	// beaconMaxAge bounds how old a beacon can be, so a captured one cannot
+	// be replayed for long.
+	beaconMaxAge time.Duration = 5 * time.Minute
+)
+
+// Capabilities advertised in beacons.
+const (
+	CapSession uint32 = 1 << iota	// encrypted sessions
+	CapLegacy						// plain TCP petitions of legacy peers
+	CapHeartbeat
+	CapGoodbye
+	CapRevocation
+	CapDHT
+	CapPeerExchange
+	CapRelay
+)
+
+var (
+	ErrBadBeacon = errors.New("cosmofs: invalid beacon")
+	ErrLegacyBeacon = errors.New("cosmofs: unsigned announcement of a legacy peer (run with -insecure to allow it)")
+)
+
+// Beacon is what a node announces to the network, signed with its key.
+// Peers not known yet are verified once the handshake gives us their key.
+// Beacons built from service discovery records are unsigned: the handshake
+// proves the key of their fingerprint.
+type Beacon struct {
+	Version int
+	ID string
+	Fingerprint string
+	Port int
+	Protocol int
+	Capabilities uint32
+	TableVersion uint64
+	Time int64
+	Signature []byte
+
+	// Networks proves membership of the networks of the node, one tag of
+	// the digest of the beacon for each.
+	Networks [][]byte
+
+	unsigned bool
+}
+
+// beaconDigest returns the hash that the announcing peer has to sign.
+func beaconDigest(b *Beacon) []byte {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00%d\x00%s\x00%s\x00%d\x00%d\x00%d\x00%d\x00%d\x00",
+		beaconContext, b.Version, b.ID, b.Fingerprint, b.Port, b.Protocol,
+		b.Capabilities, b.TableVersion, b.Time)
+
+	return h.Sum(nil)
+}
+
+// capabilities returns what the node can do.
+func (n *Node) capabilities() (c uint32) {
+	c = CapSession | CapHeartbeat | CapGoodbye | CapRevocation | CapPeerExchange
+
+	if n.config.Insecure {
+		c |= CapLegacy
+	}
+
+	if n.dht != nil {
+		c |= CapDHT
+	}
+
+	if n.relaySlots != nil {
+		c |= CapRelay
+	}
+
+	return c
+}
+
+// newBeacon returns a signed beacon of the node.
+func (n *Node) newBeacon() (b *Beacon, err error) {
+	b = &Beacon{
+		Version: BeaconVersion,
+		ID: n.pub.ID,
+		Fingerprint: n.pub.Fingerprint(),
+		Port: n.port,
+		Protocol: n.protocol,
+		Capabilities: n.capabilities(),
+		TableVersion: n.table.Version(),
+		Time: time.Now().UnixNano(),
+	}
+
+	b.Signature, err = n.signDigest(beaconDigest(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	b.Networks = n.membershipTags(beaconDigest(b))
+
+	return b, err
+}
+
+// encode returns the datagram that carries b.
+func (b *Beacon) encode() (data []byte, err error) {
+	buf := bytes.NewBufferString(beaconMagic)
+
+	err = gob.NewEncoder(buf).Encode(b)
+
+	return buf.Bytes(), err
+}
+
+// parseBeacon decodes a datagram. The announcements of legacy peers are
+// returned as beacons of version 0, with their ID and DefaultPort.
+func parseBeacon(data []byte) (b *Beacon, err error) {
+	if !bytes.HasPrefix(data, []byte(beaconMagic)) {
+		id := string(bytes.TrimRight(data, "\x00"))
+
+		if checkID(id) != nil {
+			return nil, ErrBadBeacon
+		}
+
+		return &Beacon{ID: id, Port: DefaultPort}, err
+	}
+
+	b = new(Beacon)
+
+	err = gob.NewDecoder(bytes.NewReader(data[len(beaconMagic):])).Decode(b)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Version != BeaconVersion {
+		return nil, fmt.Errorf("cosmofs: unsupported beacon version %d", b.Version)
+	}
+
+	if b.Port <= 0 || b.Port > 65535 || checkID(b.ID) != nil {
+		return nil, ErrBadBeacon
+	}
+
+	return b, err
+}
+
+// verify checks that b was signed by peer.
+func (b *Beacon) verify(peer *Peer) (err error) {
+	if peer == nil || peer.ID != b.ID || peer.Fingerprint() != b.Fingerprint {
+		return ErrBadBeacon
+	}
+
+	if b.unsigned {
+		return err
+	}
+
+	return verifyDigest(peer.PubKey, beaconDigest(b), b.Signature)
+}
+
+// checkBeacon validates b before anything is done about it. Beacons of
+// known peers have to be signed with the pinned key; the rest are verified
+// after the handshake, by the caller. A changed key is only told by the
+// handshake, which refuses it and keeps it aside for the user.
+func (n *Node) checkBeacon(b *Beacon) (err error) {
+	if b.Version == 0 {
+		if !n.config.Insecure {
+			return ErrLegacyBeacon
+		}
+
+		if n.IsDeniedID(b.ID) {
+			return ErrPeerDenied
+		}
+
+		if len(n.networks) > 0 {
+			return ErrNoSharedNetwork
+		}
+
+		return err
+	}
+
+	age := time.Since(time.Unix(0, b.Time))
+
+	if !b.unsigned && (age > beaconMaxAge || age < -beaconMaxAge) {
+		return ErrBadBeacon
+	}
+
+	if n.IsDeniedID(b.ID) || n.peers.isDeniedEntry(b.Fingerprint) {
+		return ErrPeerDenied
+	}
+
+	// Service discovery records carry no proof, the handshake checks it.
+	if _, ok := n.sharedNetworks(b.Networks, beaconDigest(b)); !ok && !b.unsigned {
+		return ErrNoSharedNetwork
+	}
+
+	if b.Capabilities&CapSession == 0 && !n.config.Insecure {
+		return ErrLegacyPeer
+	}
+
+	peer, ok := n.SearchPeer(b.ID)
+
+	if !ok {
+		return err
+	}
+
+	if peer.Fingerprint() != b.Fingerprint {
+		return err
+	}
+
+	return b.verify(peer)
+}
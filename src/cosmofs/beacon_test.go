@@ -0,0 +1,108 @@
+package cosmofs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBeacon(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+	mallory := newTestNode(t, "mallory@cosmofs.es")
+	a.port, mallory.port = DefaultPort, DefaultPort
+
+	beacon, err := a.newBeacon()
+
+	if err != nil {
+		t.Fatal("Failure in newBeacon:", err)
+	}
+
+	data, err := beacon.encode()
+
+	if err != nil {
+		t.Fatal("Failure in encode:", err)
+	}
+
+	// Trailing garbage of the read buffer is ignored.
+	recv, err := parseBeacon(append(data, make([]byte, 64)...))
+
+	if err != nil || recv.ID != a.ID() || recv.Fingerprint != a.PublicPeer().Fingerprint() || recv.Protocol != ProtocolVersion {
+		t.Fatalf("Failure in parseBeacon: %+v %v", recv, err)
+	}
+
+	// Unknown peers are verified after the handshake.
+	if err = b.checkBeacon(recv); err != nil {
+		t.Error("Failure in checkBeacon. Unknown peer:", err)
+	}
+
+	err = b.StorePeer(a.PublicPeer())
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	if err = b.checkBeacon(recv); err != nil {
+		t.Error("Failure in checkBeacon. Known peer:", err)
+	}
+
+	// Beacons of a known peer with another key are left to the handshake
+	forged, _ := mallory.newBeacon()
+	forged.ID = a.ID()
+
+	if err = b.checkBeacon(forged); err != nil {
+		t.Error("Failure in checkBeacon. Changed fingerprint not left to the handshake:", err)
+	}
+
+	forged.Fingerprint = a.PublicPeer().Fingerprint()
+
+	if err = b.checkBeacon(forged); err == nil {
+		t.Error("Failure in checkBeacon. Forged signature accepted.")
+	}
+
+	tampered := *recv
+	tampered.Port++
+
+	if err = b.checkBeacon(&tampered); err == nil {
+		t.Error("Failure in checkBeacon. Tampered beacon accepted.")
+	}
+
+	stale := *recv
+	stale.Time = time.Now().Add(-2 * beaconMaxAge).UnixNano()
+	stale.Signature, _ = a.signDigest(beaconDigest(&stale))
+
+	if err = b.checkBeacon(&stale); err != ErrBadBeacon {
+		t.Error("Failure in checkBeacon. Stale beacon accepted:", err)
+	}
+
+	b.DenyPeer(a.PublicPeer().Fingerprint(), "")
+
+	if err = b.checkBeacon(recv); err != ErrPeerDenied {
+		t.Error("Failure in checkBeacon. Denied peer accepted:", err)
+	}
+}
+
+func TestLegacyBeacon(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+
+	b, err := parseBeacon(append([]byte("legacy@cosmofs.es"), make([]byte, 4000)...))
+
+	if err != nil || b.ID != "legacy@cosmofs.es" || b.Port != DefaultPort || b.Version != 0 {
+		t.Fatalf("Failure in parseBeacon. Legacy announcement: %+v %v", b, err)
+	}
+
+	if err = n.checkBeacon(b); err != ErrLegacyBeacon {
+		t.Error("Failure in checkBeacon. Legacy announcement accepted:", err)
+	}
+
+	n.config.Insecure = true
+
+	if err = n.checkBeacon(b); err != nil {
+		t.Error("Failure in checkBeacon. Legacy announcement refused with Insecure:", err)
+	}
+
+	_, err = parseBeacon([]byte("garbage"))
+
+	if err != ErrBadBeacon {
+		t.Error("Failure in parseBeacon. Garbage accepted:", err)
+	}
+}
@@ -0,0 +1,160 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	DefaultHeartbeatInterval = 30 * time.Second
+	DefaultPeerTimeout = 3 * DefaultHeartbeatInterval
+
+	DefaultReconnectMinDelay = 5 * time.Second
+	DefaultReconnectMaxDelay = 10 * time.Minute
+)
+
+// Config holds everything a Node needs. DefaultConfig fills it from the
+// environment, the way the server has always been configured.
+type Config struct {
+	// SSH key pair of the node. The comment of the public key is its ID.
+	PubKeyFile string
+	PrivKeyFile string
+	Passphrase string
+
+	// Inbox is the location of incoming packages and Share the list of
+	// shared directories.
+	Inbox string
+	Share []string
+
+	// ResetConfig re-generates the config files of the shared directories.
+	ResetConfig bool
+
+	// Port is used for petitions of other peers, 0 picks a free one. It is
+	// advertised in the announcements of the node.
+	Port int
+
+	// DiscoveryPort is where announcements are broadcast and received. 0
+	// uses the same number as Port.
+	DiscoveryPort int
+
+	// BindAddr is the IP address or the name of the interface the node
+	// listens on for peers. Empty listens on every interface; otherwise
+	// broadcast announcements of other peers may not be received.
+	BindAddr string
+
+	// Bootstrap lists the host:port of peers to connect to at startup,
+	// those that cannot be discovered on the local networks.
+	Bootstrap []string
+
+	// ControlAddr is the host:port of the endpoint for local clients. It
+	// has to be a loopback address; the port may be 0.
+	ControlAddr string
+
+	// Files where pinned and denied peers are kept. Empty names use the
+	// defaults in $HOME/.ssh.
+	KnownPeersFile string
+	DeniedPeersFile string
+
+	// Connected peers get a heartbeat every HeartbeatInterval, and are
+	// disconnected when they have not been heard of for PeerTimeout. Zero
+	// values use the defaults.
+	HeartbeatInterval time.Duration
+	PeerTimeout time.Duration
+
+	// Known peers that cannot be reached at their last addresses are tried
+	// again after ReconnectMinDelay, doubling it up to ReconnectMaxDelay
+	// on every failure. Zero values use the defaults.
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+
+	// DHT enables the distributed hash table, to find peers and files
+	// beyond the local networks.
+	DHT bool
+
+	// Relay lets connected peers that cannot reach each other exchange
+	// streams through the node, within RelayRate bytes per second for all
+	// of them. A zero RelayRate uses DefaultRelayRate.
+	Relay bool
+	RelayRate int
+
+	// MDNS advertises the node as _cosmofs._tcp.local and browses for the
+	// other nodes with multicast DNS, besides the announcements.
+	MDNS bool
+
+	// Networks are the private swarms of the node. Nodes only talk to
+	// those sharing one of them; without any, to those without any.
+	Networks []Network
+
+	// Insecure allows unencrypted connections with legacy peers.
+	Insecure bool
+
+	Verbose bool
+}
+
+// DefaultConfig returns the configuration given by the COSMOFS* environment
+// variables.
+func DefaultConfig() Config {
+	return Config{
+		PubKeyFile: os.Getenv("COSMOFSPUBKEY"),
+		PrivKeyFile: os.Getenv("COSMOFSPRIVKEY"),
+		Passphrase: os.Getenv("COSMOFSPASSPHRASE"),
+		Inbox: os.Getenv("COSMOFSIN"),
+		Share: filepath.SplitList(os.Getenv("COSMOFSOUT")),
+		Port: DefaultPort,
+		ControlAddr: defaultControlAddr(),
+		Bootstrap: SplitPeerList(os.Getenv("COSMOFSPEERS")),
+		KnownPeersFile: defaultKnownPeersFile(),
+		DeniedPeersFile: defaultDeniedPeersFile(),
+		HeartbeatInterval: DefaultHeartbeatInterval,
+		PeerTimeout: DefaultPeerTimeout,
+		ReconnectMinDelay: DefaultReconnectMinDelay,
+		ReconnectMaxDelay: DefaultReconnectMaxDelay,
+	}
+}
+
+// SplitPeerList splits a list of host:port separated by commas or spaces.
+func SplitPeerList(list string) []string {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+func defaultControlAddr() string {
+	if addr := os.Getenv("COSMOFSCONTROL"); addr != "" {
+		return addr
+	}
+
+	return DefaultControlAddr
+}
+
+func defaultKnownPeersFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "cosmofs_known_peers")
+}
+
+func defaultDeniedPeersFile() string {
+	return filepath.Join(os.Getenv("HOME"), ".ssh", "cosmofs_denied_peers")
+}
@@ -0,0 +1,846 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+)
+
+// Connected peers keep one session, a peerConn, which carries the requests
+// of both sides at the same time. The answer to a request is matched by its
+// ID. Bodies larger than chunkSize are cut in chunks, flagged with flagMore
+// but the last, so the frames of other requests go in between. The receiver
+// gives credit back, in Window frames, as the consumer of the body takes its
+// chunks: no more than streamWindow bytes of a body are on their way, or
+// waiting for its consumer, at any time. No more than maxStreams bodies are
+// sent in chunks at once.
+//
+// When both peers dial each other at once, both keep the connection dialed
+// by the lower ID. The other one is retired: its dialer closes it once its
+// requests are answered.
+const (
+	chunkSize int = 32 * 1024
+	streamWindow int = 256 * 1024
+	maxStreams int = 64
+
+	// frameOverhead is the slack allowed over chunkSize in the frames of
+	// peers sending chunks.
+	frameOverhead int = 1024
+)
+
+var ErrConnClosed = newError(ErrPeerOffline, "cosmofs: connection with the peer closed")
+
+// frameLimit returns the largest body in a frame of a peer with features.
+// Peers agreeing on chunked transfer never send more than a chunk at once;
+// the rest send large bodies whole.
+func frameLimit(features uint32) int {
+	if features&FeatureChunked != 0 {
+		return chunkSize + frameOverhead
+	}
+
+	return maxFrameSize
+}
+
+// streamKey names a body being sent or received: requests and answers of
+// the same ID go in different streams.
+type streamKey struct {
+	ID uint32
+	Response bool
+}
+
+func frameStream(h Header) streamKey {
+	return streamKey{ID: h.ID, Response: h.Flags&flagResponse != 0}
+}
+
+// windowUpdate is the body of Window frames, the bytes of credit given.
+type windowUpdate struct {
+	Size int
+}
+
+// window is the credit left to send a body.
+type window struct {
+	mu sync.Mutex
+	avail int
+	wake chan struct{}
+}
+
+func newWindow() *window {
+	return &window{avail: streamWindow, wake: make(chan struct{}, 1)}
+}
+
+func (w *window) grant(size int) {
+	w.mu.Lock()
+	w.avail += size
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take waits until size bytes of credit are left, or done is closed.
+func (w *window) take(size int, done <-chan struct{}) (err error) {
+	for {
+		w.mu.Lock()
+
+		if w.avail >= size {
+			w.avail -= size
+			w.mu.Unlock()
+			return err
+		}
+
+		w.mu.Unlock()
+
+		select {
+		case <-w.wake:
+		case <-done:
+			return ErrConnClosed
+		}
+	}
+}
+
+// stream is a body arriving in chunks. The chunks wait in unread until its
+// consumer takes them, or are dropped as they come if nobody waits for it.
+type stream struct {
+	mu sync.Mutex
+	unread bytes.Buffer
+	size int
+	last bool
+	discard bool
+	wake chan struct{}
+}
+
+func newStream() *stream {
+	return &stream{wake: make(chan struct{}, 1)}
+}
+
+// answer is a frame read for a request waiting for it. Answers in chunks
+// come in stream instead of body.
+type answer struct {
+	Header
+	body []byte
+	stream *stream
+}
+
+// peerConn is a session with a peer shared by all the requests between
+// both. Requests of the peer are served with handlers.
+type peerConn struct {
+	n *Node
+	sess *Session
+	peer *Peer
+	remIP string
+	handlers map[MsgType]handlerFunc
+	dialed bool
+
+	// wmu keeps the frames whole, Write is not safe for concurrent use.
+	wmu sync.Mutex
+
+	// sending limits the bodies we send in chunks to maxStreams.
+	sending chan struct{}
+
+	mu sync.Mutex
+	calls map[uint32]chan answer
+	partial map[streamKey]*stream
+	windows map[streamKey]*window
+	err error
+
+	// Credit owed to the streams of the peer, written by writeCredits.
+	credits map[streamKey]int
+	owed chan struct{}
+
+	// Requests in flight, either way, and whether to close once there
+	// are none.
+	active int
+	retired bool
+
+	done chan struct{}
+	closeOnce sync.Once
+}
+
+func (n *Node) newPeerConn(sess *Session, remIP string, handlers map[MsgType]handlerFunc) (c *peerConn) {
+	c = &peerConn{
+		n: n,
+		sess: sess,
+		peer: sess.Peer,
+		remIP: remIP,
+		handlers: handlers,
+		calls: make(map[uint32]chan answer),
+		sending: make(chan struct{}, maxStreams),
+		partial: make(map[streamKey]*stream),
+		windows: make(map[streamKey]*window),
+		credits: make(map[streamKey]int),
+		owed: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	n.connsMu.Lock()
+	n.open[c] = struct{}{}
+	n.connsMu.Unlock()
+
+	return c
+}
+
+// run reads the frames of c until it is closed, while the credit for them
+// is written apart. Connections with no frames for PeerTimeout are closed:
+// the peer uses another one, or is gone.
+func (c *peerConn) run() {
+	c.n.wg.Add(1)
+
+	go func() {
+		defer c.n.wg.Done()
+
+		c.writeCredits()
+	}()
+
+	for {
+		c.sess.SetReadDeadline(time.Now().Add(c.n.config.PeerTimeout))
+
+		h, body, err := readFrame(c.sess, frameLimit(c.sess.Features))
+
+		if err == nil {
+			err = c.handle(h, body)
+		}
+
+		if err != nil {
+			if !isClosed(err) && !c.n.closed() {
+				c.n.debug("Closing connection with %s: %s\n", c.peer.ID, err)
+			}
+
+			c.close(err)
+			return
+		}
+	}
+}
+
+// handle takes a frame read from c: credit for our bodies, a chunk of a
+// body, an answer to one of our requests or a request of the peer.
+func (c *peerConn) handle(h Header, body []byte) (err error) {
+	// Answered, but there is no telling what follows.
+	if h.Version != WireVersion {
+		c.send(Header{Type: MsgError, Flags: flagResponse, ID: h.ID}, wireError(errBadVersion(h.Version)))
+
+		return ErrBadFrame
+	}
+
+	// Only compressed as agreed: anything else is not our protocol.
+	if h.Flags&flagCompressed != 0 && c.sess.Features&FeatureCompression == 0 {
+		return ErrBadFrame
+	}
+
+	if h.Type == MsgWindow {
+		var update windowUpdate
+
+		err = decodeBody(body, &update)
+
+		if err != nil {
+			return err
+		}
+
+		c.mu.Lock()
+		w, ok := c.windows[frameStream(h)]
+		c.mu.Unlock()
+
+		if ok {
+			w.grant(update.Size)
+		}
+
+		return err
+	}
+
+	s, opened, err := c.receive(h, body)
+
+	// Later chunks are taken by the consumer of their stream.
+	if err != nil || (s != nil && !opened) {
+		return err
+	}
+
+	if h.Flags&flagResponse != 0 {
+		taken := false
+
+		// Only the first answer is taken. Given under mu, so calls which
+		// give up find it, see call.
+		c.mu.Lock()
+
+		if ch, ok := c.calls[h.ID]; ok {
+			select {
+			case ch <- answer{Header: h, body: body, stream: s}:
+				taken = true
+			default:
+			}
+		}
+
+		c.mu.Unlock()
+
+		if !taken && s != nil {
+			c.discard(frameStream(h), s)
+		}
+
+		return err
+	}
+
+	c.begin()
+	c.n.wg.Add(1)
+
+	go func() {
+		defer c.n.wg.Done()
+		defer c.end()
+
+		body, err := c.body(h, body, s, nil)
+
+		if err == nil {
+			c.serve(h, body)
+		}
+	}()
+
+	return err
+}
+
+// receive adds a chunk to the stream of its body, which is returned. The
+// first chunk opens the stream; bodies in one frame have none.
+func (c *peerConn) receive(h Header, chunk []byte) (s *stream, opened bool, err error) {
+	key := frameStream(h)
+
+	c.mu.Lock()
+	s, ok := c.partial[key]
+
+	if !ok && h.Flags&flagMore == 0 {
+		c.mu.Unlock()
+		return nil, false, err
+	}
+
+	if !ok {
+		if len(c.partial) >= maxStreams {
+			c.mu.Unlock()
+			return nil, false, ErrBadFrame
+		}
+
+		s = newStream()
+		c.partial[key] = s
+	}
+
+	if h.Flags&flagMore == 0 {
+		delete(c.partial, key)
+	}
+
+	c.mu.Unlock()
+
+	s.mu.Lock()
+
+	s.size += len(chunk)
+	s.last = h.Flags&flagMore == 0
+
+	// Beyond the credit given, or too large.
+	if s.size > maxFrameSize || s.unread.Len()+len(chunk) > streamWindow {
+		s.mu.Unlock()
+		return nil, false, ErrBadFrame
+	}
+
+	discard, last := s.discard, s.last
+
+	if !discard {
+		s.unread.Write(chunk)
+	}
+
+	s.mu.Unlock()
+
+	if discard && !last {
+		c.credit(key, len(chunk))
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+
+	return s, !ok, err
+}
+
+// body returns the body of the frame h, taking the chunks of s if it came
+// in a stream, and decompressed if it was. Streams are given up when
+// expired fires. Bodies which cannot be decompressed close c.
+func (c *peerConn) body(h Header, body []byte, s *stream, expired <-chan time.Time) ([]byte, error) {
+	var err error
+
+	if s != nil {
+		body, err = c.read(frameStream(h), s, expired)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if h.Flags&flagCompressed != 0 {
+		body, err = decompressBody(body)
+
+		if err != nil {
+			c.close(err)
+			return nil, err
+		}
+	}
+
+	return body, err
+}
+
+// read takes the chunks of s as they come, which gives the sender credit
+// for them, and returns the body once whole.
+func (c *peerConn) read(key streamKey, s *stream, expired <-chan time.Time) (body []byte, err error) {
+	var buf bytes.Buffer
+
+	for {
+		s.mu.Lock()
+		size, _ := s.unread.WriteTo(&buf)
+		last := s.last
+		s.mu.Unlock()
+
+		if last {
+			return buf.Bytes(), err
+		}
+
+		c.credit(key, int(size))
+
+		select {
+		case <-s.wake:
+		case <-c.done:
+			return nil, c.closeErr()
+		case <-expired:
+			c.discard(key, s)
+			return nil, ErrTimeout
+		}
+	}
+}
+
+// discard drops the chunks of s, whose body nobody waits for, as they come.
+func (c *peerConn) discard(key streamKey, s *stream) {
+	s.mu.Lock()
+	s.discard = true
+	size := s.unread.Len()
+	s.unread.Reset()
+	last := s.last
+	s.mu.Unlock()
+
+	if !last {
+		c.credit(key, size)
+	}
+}
+
+// credit gives size bytes of credit back to the sender of the stream key.
+// The Window frames are written by writeCredits, so the reads never wait
+// for the writes.
+func (c *peerConn) credit(key streamKey, size int) {
+	if size == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.credits[key] += size
+	c.mu.Unlock()
+
+	select {
+	case c.owed <- struct{}{}:
+	default:
+	}
+}
+
+// writeCredits writes the Window frames of the credit owed until c is
+// closed.
+func (c *peerConn) writeCredits() {
+	for {
+		select {
+		case <-c.owed:
+		case <-c.done:
+			return
+		}
+
+		c.mu.Lock()
+		credits := c.credits
+		c.credits = make(map[streamKey]int)
+		c.mu.Unlock()
+
+		for key, size := range credits {
+			h := Header{Type: MsgWindow, ID: key.ID}
+
+			if key.Response {
+				h.Flags = flagResponse
+			}
+
+			update, _ := encodeBody(windowUpdate{Size: size})
+
+			if c.writeChunk(h, update) != nil {
+				return
+			}
+		}
+	}
+}
+
+// serve answers a request of the peer.
+func (c *peerConn) serve(h Header, body []byte) {
+	r := &request{
+		Header: h,
+		body: body,
+		rw: c.sess,
+		peer: c.peer,
+		remIP: c.remIP,
+		features: c.sess.Features,
+	}
+
+	resp, err := c.n.dispatch(r, c.handlers)
+
+	answer := Header{Type: h.Type, Flags: flagResponse, ID: h.ID}
+
+	if err != nil {
+		log.Printf("Error serving %s from %s: %s\n", h.Type, c.peer.ID, err)
+
+		answer.Type = MsgError
+		resp = wireError(err)
+	}
+
+	err = c.send(answer, resp)
+
+	if err != nil {
+		c.n.debug("Error answering %s to %s: %s\n", h.Type, c.peer.ID, err)
+	}
+}
+
+// send sends a frame with body, in chunks if it is too large for one.
+func (c *peerConn) send(h Header, body interface{}) (err error) {
+	data, err := encodeBody(body)
+
+	if err != nil {
+		return err
+	}
+
+	if len(data) >= compressMinSize && c.sess.Features&FeatureCompression != 0 {
+		if packed := compressBody(data); packed != nil {
+			data = packed
+			h.Flags |= flagCompressed
+		}
+	}
+
+	if len(data) > maxFrameSize {
+		return ErrBadFrame
+	}
+
+	// Peers without chunked transfer take the body whole.
+	if len(data) <= chunkSize || c.sess.Features&FeatureChunked == 0 {
+		return c.writeChunk(h, data)
+	}
+
+	// No more bodies in chunks at once than the peer takes.
+	select {
+	case c.sending <- struct{}{}:
+	case <-c.done:
+		return ErrConnClosed
+	}
+
+	defer func() {
+		<-c.sending
+	}()
+
+	key := frameStream(h)
+	w := newWindow()
+
+	c.mu.Lock()
+	c.windows[key] = w
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.windows, key)
+		c.mu.Unlock()
+	}()
+
+	for len(data) > 0 {
+		size := len(data)
+		chunk := h
+
+		if size > chunkSize {
+			size = chunkSize
+			chunk.Flags |= flagMore
+		}
+
+		err = w.take(size, c.done)
+
+		if err == nil {
+			err = c.writeChunk(chunk, data[:size])
+		}
+
+		if err != nil {
+			return err
+		}
+
+		data = data[size:]
+	}
+
+	return err
+}
+
+func (c *peerConn) writeChunk(h Header, data []byte) (err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+
+	err = writeChunk(c.sess, h, data)
+
+	if err != nil {
+		c.close(err)
+	}
+
+	return err
+}
+
+// call sends a request of type t with body req and decodes the answer into
+// resp. It gives up after timeout, unless it is zero.
+func (c *peerConn) call(t MsgType, req, resp interface{}, timeout time.Duration) (err error) {
+	c.begin()
+	defer c.end()
+
+	id := requestIDs.Add(1)
+	ch := make(chan answer, 1)
+
+	c.mu.Lock()
+	c.calls[id] = ch
+	c.mu.Unlock()
+
+	// An answer in chunks not taken is dropped as it comes.
+	defer func() {
+		var left answer
+
+		c.mu.Lock()
+		delete(c.calls, id)
+
+		select {
+		case left = <-ch:
+		default:
+		}
+
+		c.mu.Unlock()
+
+		if left.stream != nil {
+			c.discard(frameStream(left.Header), left.stream)
+		}
+	}()
+
+	err = c.send(Header{Type: t, ID: id}, req)
+
+	if err != nil {
+		return err
+	}
+
+	var expired <-chan time.Time
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		expired = timer.C
+	}
+
+	select {
+	case a := <-ch:
+		body, err := c.body(a.Header, a.body, a.stream, expired)
+
+		if err != nil {
+			return err
+		}
+
+		return decodeAnswer(t, a.Header, body, resp)
+	case <-c.done:
+		return c.closeErr()
+	case <-expired:
+		return ErrTimeout
+	}
+}
+
+func (c *peerConn) begin() {
+	c.mu.Lock()
+	c.active++
+	c.mu.Unlock()
+}
+
+func (c *peerConn) end() {
+	c.mu.Lock()
+	c.active--
+	idle := c.retired && c.active == 0
+	c.mu.Unlock()
+
+	if idle {
+		c.Close()
+	}
+}
+
+// retire closes c once no requests are in flight.
+func (c *peerConn) retire() {
+	c.mu.Lock()
+	c.retired = true
+	idle := c.active == 0
+	c.mu.Unlock()
+
+	if idle {
+		c.Close()
+	}
+}
+
+// dialer returns the ID of the peer which dialed c.
+func (c *peerConn) dialer() string {
+	if c.dialed {
+		return c.n.pub.ID
+	}
+
+	return c.peer.ID
+}
+
+func (c *peerConn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err == nil || isClosed(c.err) {
+		return ErrConnClosed
+	}
+
+	return c.err
+}
+
+// close closes c because of err, and forgets it if it was shared.
+func (c *peerConn) close(err error) {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+
+		close(c.done)
+		c.sess.Close()
+
+		c.n.forgetConn(c)
+	})
+}
+
+func (c *peerConn) Close() error {
+	c.close(ErrConnClosed)
+
+	return nil
+}
+
+// release closes c, unless it is shared.
+func (c *peerConn) release() {
+	c.n.connsMu.Lock()
+	shared := c.n.conns[c.peer.ID] == c
+	c.n.connsMu.Unlock()
+
+	if !shared {
+		c.Close()
+	}
+}
+
+// preferConn tells whether c is to replace old as the connection with
+// their peer. Both sides keep the one dialed by the lower ID. Between two
+// dialed by the same side, the first one dialed by us is kept, and the
+// last one dialed by the peer: it knows which ones it uses.
+func preferConn(c, old *peerConn) bool {
+	if c.dialer() != old.dialer() {
+		return c.dialer() < old.dialer()
+	}
+
+	return !c.dialed
+}
+
+// shareConn keeps c as the connection with its peer, unless the one it
+// already has is preferred. The connection kept is returned. A replaced
+// connection dialed by us is retired; the ones dialed by the peer are
+// served until it closes them.
+func (n *Node) shareConn(c *peerConn) *peerConn {
+	n.connsMu.Lock()
+
+	old, ok := n.conns[c.peer.ID]
+
+	if ok && !preferConn(c, old) {
+		n.connsMu.Unlock()
+		return old
+	}
+
+	n.conns[c.peer.ID] = c
+	n.connsMu.Unlock()
+
+	if ok && old.dialed {
+		n.debug("Retiring connection with %s\n", c.peer.ID)
+		old.retire()
+	}
+
+	return c
+}
+
+// runConn serves the requests of the peer of c in the background.
+func (n *Node) runConn(c *peerConn) {
+	n.wg.Add(1)
+
+	go func() {
+		defer n.wg.Done()
+
+		c.run()
+	}()
+}
+
+// forgetConn stops sharing c, which is closed.
+func (n *Node) forgetConn(c *peerConn) {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+
+	delete(n.open, c)
+
+	if n.conns[c.peer.ID] == c {
+		delete(n.conns, c.peer.ID)
+	}
+}
+
+// dropConn stops sharing the connection with peer id, which is closed once
+// neither side uses it.
+func (n *Node) dropConn(id string) {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+
+	delete(n.conns, id)
+}
+
+// closeConns closes every connection with the peers.
+func (n *Node) closeConns() {
+	n.connsMu.Lock()
+
+	conns := make([]*peerConn, 0, len(n.open))
+
+	for c := range n.open {
+		conns = append(conns, c)
+	}
+
+	n.connsMu.Unlock()
+
+	for _, c := range conns {
+		c.Close()
+	}
+}
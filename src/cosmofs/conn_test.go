@@ -0,0 +1,495 @@
+package cosmofs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestConns returns both ends of a connection between a and b. b serves
+// the requests of a with handlers.
+func newTestConns(t *testing.T, a, b *Node, handlers map[MsgType]handlerFunc) (ca, cb *peerConn) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+
+	defer ln.Close()
+
+	accepted := make(chan *Session)
+
+	go func() {
+		defer close(accepted)
+
+		conn, err := ln.AcceptTCP()
+
+		if err != nil {
+			return
+		}
+
+		reader := bufio.NewReader(conn)
+
+		_, err = reader.ReadString('\n')
+
+		if err != nil {
+			return
+		}
+
+		s, err := b.AcceptSession(conn, reader)
+
+		if err == nil {
+			accepted <- s
+		}
+	}()
+
+	s, err := a.DialSession(ln.Addr().(*net.TCPAddr))
+
+	if err != nil {
+		t.Fatal("Failure in DialSession:", err)
+	}
+
+	sb, ok := <-accepted
+
+	if !ok {
+		t.Fatal("Failure in AcceptSession")
+	}
+
+	ca = a.newPeerConn(s, "127.0.0.1", nil)
+	cb = b.newPeerConn(sb, "127.0.0.1", handlers)
+
+	a.runConn(ca)
+	b.runConn(cb)
+
+	return ca, cb
+}
+
+func TestPeerConn(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	big := bytes.Repeat([]byte("cosmofs "), 4*streamWindow/8)
+
+	ca, cb := newTestConns(t, a, b, map[MsgType]handlerFunc{
+		MsgOpenFile: func(n *Node, r *request) (resp interface{}, err error) {
+			return FileContent{Content: big}, err
+		},
+		MsgHeartbeat: func(n *Node, r *request) (resp interface{}, err error) {
+			var hb heartbeat
+
+			err = r.decode(&hb)
+
+			return hb, err
+		},
+	})
+
+	defer ca.Close()
+	defer cb.Close()
+
+	// Large answers and small ones share the connection.
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			var content FileContent
+
+			err := ca.call(MsgOpenFile, PathRequest{Path: "bob@cosmofs.es/out1/big"}, &content, 10*time.Second)
+
+			if err != nil || !bytes.Equal(content.Content, big) {
+				t.Errorf("Failure in call. Got %d bytes: %v", len(content.Content), err)
+			}
+		}()
+
+		go func(i int) {
+			defer wg.Done()
+
+			sent := heartbeat{Time: int64(i)}
+
+			var echo heartbeat
+
+			err := ca.call(MsgHeartbeat, sent, &echo, 10*time.Second)
+
+			if err != nil || echo != sent {
+				t.Errorf("Failure in call. Got %+v: %v", echo, err)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	cb.mu.Lock()
+	left := len(cb.windows)
+	cb.mu.Unlock()
+
+	if left != 0 {
+		t.Errorf("Failure in send. %d windows left.", left)
+	}
+
+	var e *WireError
+
+	err := ca.call(MsgHello, nil, nil, 10*time.Second)
+
+	if !errors.As(err, &e) || e.Code != CodeUnknownType {
+		t.Error("Failure in call. Unknown request answered with:", err)
+	}
+
+	cb.Close()
+
+	err = ca.call(MsgHeartbeat, heartbeat{}, nil, 10*time.Second)
+
+	if err == nil {
+		t.Error("Failure in call. Answered through a closed connection.")
+	}
+}
+
+func TestUnagreedCompression(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	b.features &^= FeatureCompression
+
+	ca, cb := newTestConns(t, a, b, nil)
+
+	defer ca.Close()
+	defer cb.Close()
+
+	data, _ := encodeBody(heartbeat{})
+	packed := compressBody(bytes.Repeat(data, compressMinSize))
+
+	h := Header{Version: WireVersion, Type: MsgHeartbeat, Flags: flagCompressed, ID: 1}
+
+	err := cb.handle(h, packed)
+
+	if err != ErrBadFrame {
+		t.Error("Failure in handle. Took a compressed body not agreed:", err)
+	}
+}
+
+func TestStreamCredit(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	ca, cb := newTestConns(t, a, b, nil)
+
+	defer ca.Close()
+	defer cb.Close()
+
+	// The credit b gives for the stream ends up here.
+	key := streamKey{ID: 1 << 30}
+	w := &window{wake: make(chan struct{}, 1)}
+
+	ca.mu.Lock()
+	ca.windows[key] = w
+	ca.mu.Unlock()
+
+	avail := func() int {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		return w.avail
+	}
+
+	h := Header{Version: WireVersion, Type: MsgHeartbeat, Flags: flagMore, ID: key.ID}
+	chunk := make([]byte, chunkSize)
+
+	s, opened, err := cb.receive(h, chunk)
+
+	if err != nil || !opened {
+		t.Fatal("Failure in receive:", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if avail() != 0 {
+		t.Error("Failure in receive. Credit given before the chunk was taken.")
+	}
+
+	read := make(chan []byte)
+
+	go func() {
+		body, _ := cb.read(key, s, nil)
+		read <- body
+	}()
+
+	if !waitFor(func() bool { return avail() == chunkSize }) {
+		t.Error("Failure in read. Credit not given for the chunk taken:", avail())
+	}
+
+	h.Flags = 0
+
+	_, _, err = cb.receive(h, chunk)
+
+	if body := <-read; err != nil || len(body) != 2*chunkSize {
+		t.Errorf("Failure in read. Got %d bytes: %v", len(body), err)
+	}
+
+	// Chunks beyond the credit given are refused.
+	h.Flags = flagMore
+
+	for sent := 0; sent <= streamWindow; sent += chunkSize {
+		h.ID = key.ID + 1
+		_, _, err = cb.receive(h, chunk)
+	}
+
+	if err != ErrBadFrame {
+		t.Error("Failure in receive. Took chunks beyond the window:", err)
+	}
+
+	// And so are streams beyond maxStreams.
+	for i := 1; i <= maxStreams; i++ {
+		h.ID = key.ID + 1 + uint32(i)
+		_, _, err = cb.receive(h, chunk)
+	}
+
+	if err != ErrBadFrame {
+		t.Error("Failure in receive. Took streams beyond maxStreams:", err)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	w := newWindow()
+	done := make(chan struct{})
+
+	err := w.take(streamWindow, done)
+
+	if err != nil {
+		t.Fatal("Failure in take:", err)
+	}
+
+	taken := make(chan error)
+
+	go func() {
+		taken <- w.take(chunkSize, done)
+	}()
+
+	select {
+	case <-taken:
+		t.Fatal("Failure in take. Sent beyond the window.")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.grant(chunkSize)
+
+	if err = <-taken; err != nil {
+		t.Error("Failure in grant:", err)
+	}
+
+	go func() {
+		taken <- w.take(chunkSize, done)
+	}()
+
+	close(done)
+
+	if err = <-taken; err != ErrConnClosed {
+		t.Error("Failure in take. Waited on a closed connection:", err)
+	}
+}
+
+// sharedConn returns the connection n shares with peer id.
+func sharedConn(n *Node, id string) *peerConn {
+	n.connsMu.Lock()
+	defer n.connsMu.Unlock()
+
+	return n.conns[id]
+}
+
+// TestAcceptedConnCredit sends a body beyond streamWindow, which does not
+// compress, to the side that accepted the connection.
+func TestAcceptedConnCredit(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	want := make([]byte, 4*streamWindow)
+	rand.Read(want)
+
+	err := os.WriteFile(filepath.Join(a.config.Share[0], "random.bin"), want, 0600)
+
+	if err != nil {
+		t.Fatal("Error writing file:", err)
+	}
+
+	// Scanned again with the new file.
+	a.table.DeleteDir(a.ID(), "out1")
+	a.config.ResetConfig = true
+
+	err = a.loadShares()
+
+	if err != nil {
+		t.Fatal("Failure in loadShares:", err)
+	}
+
+	for _, n := range []*Node{a, b} {
+		err = n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	_, err = a.Connect(peerAddr("127.0.0.1", b.Port()))
+
+	if err != nil {
+		t.Fatal("Failure in Connect:", err)
+	}
+
+	var c *peerConn
+
+	if !waitFor(func() bool { c = sharedConn(b, a.ID()); return c != nil }) || c.dialed {
+		t.Fatal("Failure in Connect. No connection accepted by bob.")
+	}
+
+	var content FileContent
+
+	err = c.call(MsgOpenFile, PathRequest{Path: filepath.Join(a.ID(), "out1", "random.bin")}, &content, 10*time.Second)
+
+	if err != nil || !bytes.Equal(content.Content, want) {
+		t.Errorf("Failure in call. Got %d bytes: %v", len(content.Content), err)
+	}
+}
+
+func TestSimultaneousConnect(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	var wg sync.WaitGroup
+
+	for _, pair := range [][2]*Node{{a, b}, {b, a}} {
+		wg.Add(1)
+
+		go func(n, other *Node) {
+			defer wg.Done()
+
+			_, err := n.Connect(peerAddr("127.0.0.1", other.Port()))
+
+			if err != nil {
+				t.Errorf("Failure in Connect of %s: %s", n.ID(), err)
+			}
+		}(pair[0], pair[1])
+	}
+
+	wg.Wait()
+
+	// Both keep the connection dialed by alice, the lower ID.
+	settled := waitFor(func() bool {
+		ca, cb := sharedConn(a, b.ID()), sharedConn(b, a.ID())
+
+		if ca == nil || cb == nil || !ca.dialed || cb.dialed {
+			return false
+		}
+
+		if ca.sess.LocalAddr().String() != cb.sess.RemoteAddr().String() {
+			return false
+		}
+
+		a.connsMu.Lock()
+		b.connsMu.Lock()
+		defer a.connsMu.Unlock()
+		defer b.connsMu.Unlock()
+
+		return len(a.open) == 1 && len(b.open) == 1
+	})
+
+	if !settled {
+		t.Error("Failure in shareConn. Both connections are still in use.")
+	}
+
+	for _, n := range []*Node{a, b} {
+		for _, other := range []*Node{a, b} {
+			if len(n.Table().Files(other.ID(), "out1")) == 0 {
+				t.Errorf("Failure in Connect. %s has no files of %s.", n.ID(), other.ID())
+			}
+		}
+	}
+}
+
+// TestRefusedConnNotShared makes sure the connections refused after the
+// handshake are neither shared nor kept open.
+func TestRefusedConnNotShared(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	addr := peerAddr("127.0.0.1", a.Port())
+
+	_, err := b.introduce(addr, func(peer *Peer) error {
+		return ErrAuthFailed
+	})
+
+	if err != ErrAuthFailed {
+		t.Error("Failure in introduce. The check was not run:", err)
+	}
+
+	_, err = b.connTo("carol@cosmofs.es", addr)
+
+	if err != ErrAuthFailed {
+		t.Error("Failure in connTo. Another peer answered with:", err)
+	}
+
+	b.connsMu.Lock()
+	defer b.connsMu.Unlock()
+
+	if len(b.conns) != 0 || len(b.open) != 0 {
+		t.Error("Failure in dialConn. Refused connections are still in use:", len(b.conns), len(b.open))
+	}
+}
+
+func TestFrameLimit(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := writeChunk(&buf, Header{Type: MsgOpenFile, ID: 1}, make([]byte, chunkSize))
+
+	if err != nil {
+		t.Fatal("Failure in writeChunk:", err)
+	}
+
+	_, body, err := readFrame(&buf, frameLimit(FeatureChunked))
+
+	if err != nil || len(body) != chunkSize {
+		t.Error("Failure in readFrame. A whole chunk was refused:", err)
+	}
+
+	// Only the header of a frame claiming more than a chunk is read.
+	writeChunk(&buf, Header{Type: MsgOpenFile, ID: 2}, make([]byte, 2*chunkSize))
+
+	_, _, err = readFrame(&buf, frameLimit(FeatureChunked))
+
+	if err != ErrBadFrame || buf.Len() != 2*chunkSize {
+		t.Error("Failure in readFrame. A frame larger than a chunk was taken:", err)
+	}
+
+	if frameLimit(FeatureCompression) != maxFrameSize {
+		t.Error("Failure in frameLimit. Peers without chunks cannot send whole bodies.")
+	}
+}
@@ -21,25 +21,17 @@ along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
 
 package cosmofs
 
-import (
-	"flag"
-	"os"
-)
-
 const (
 	COSMOFSDIR string = ".cosmofs"
 	COSMOFSCONFIGFILE string = ".cosmofsconfig"
-)
 
-var (
-	//Cosmofsin string = os.Getenv("COSMOFSIN")
-	//Cosmofsout string = os.Getenv("COSMOFSOUT")
-	Cosmofsin *string = flag.String("cosmofsin", os.Getenv("COSMOFSIN"), "Location of incoming packages")
-	Cosmofsout *string = flag.String("cosmofsout", os.Getenv("COSMOFSOUT"), "Location of shared directories")
-	resetConfig *bool = flag.Bool("r", false, "Re-generate config files")
+	// DefaultPort is used for peer discovery (UDP) and petitions (TCP).
+	DefaultPort int = 5453
 
-	//TODO: Change prueba.pub to id_rsa.pub
-	pubkeyFileName *string = flag.String("cosmofspubkey", os.Getenv("COSMOFSPUBKEY"), "Location of public RSA Key")
-	privkeyFileName *string = flag.String("cosmofsprivkey", os.Getenv("COSMOFSPRIVKEY"), "Location of private RSA Key")
-)
+	// DiscoveryGroup is the IPv6 link-local multicast group where peers
+	// announce themselves, on the discovery port.
+	DiscoveryGroup string = "ff02::5453"
 
+	// DefaultControlAddr is where local clients talk to the node.
+	DefaultControlAddr string = "127.0.0.1:5454"
+)
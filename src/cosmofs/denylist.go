@@ -0,0 +1,270 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	revocationContext string = "cosmofs-revocation-v1"
+
+	// maxDeniedPeers bounds the deny list, which grows with the revocations
+	// of other peers.
+	maxDeniedPeers int = 4096
+)
+
+var (
+	ErrPeerDenied = newError(ErrPermissionDenied, "cosmofs: peer is in the deny list")
+	ErrBadRevocation = errors.New("cosmofs: invalid revocation statement")
+	ErrDenyListFull = errors.New("cosmofs: the deny list is full")
+)
+
+// CheckDenied returns ErrPeerDenied if the ID or the key of peer are denied.
+func (n *Node) CheckDenied(peer *Peer) (err error) {
+	if n.peers.isDenied(peer) {
+		return ErrPeerDenied
+	}
+
+	return err
+}
+
+// IsDeniedID reports whether id, or the key pinned for it, is denied.
+func (n *Node) IsDeniedID(id string) bool {
+	return n.peers.isDeniedID(id)
+}
+
+// DenyPeer adds an ID or a key fingerprint to the deny list. Matching peers
+// are disconnected and their entries dropped from the Table.
+func (n *Node) DenyPeer(entry, reason string) (err error) {
+	if !strings.HasPrefix(entry, "SHA256:") && checkID(entry) != nil {
+		return errors.New("cosmofs: expected an ID or a SHA256 key fingerprint, got " + entry)
+	}
+
+	if reason == "" {
+		reason = "denied on " + time.Now().Format(time.RFC3339)
+	}
+
+	_, err = n.peers.deny(entry, reason)
+
+	if err != nil {
+		return err
+	}
+
+	for id := range n.peers.connectedPeers() {
+		if n.IsDeniedID(id) {
+			log.Printf("Disconnecting denied peer %s", id)
+			n.dropPeer(id)
+		}
+	}
+
+	return n.encodeDeniedPeersFile()
+}
+
+// AllowPeer removes an entry from the deny list.
+func (n *Node) AllowPeer(entry string) (err error) {
+	if !n.peers.allow(entry) {
+		return errors.New("cosmofs: " + entry + " is not in the deny list")
+	}
+
+	return n.encodeDeniedPeersFile()
+}
+
+// ListDenied returns the deny list as "entry reason" lines.
+func (n *Node) ListDenied() (list []string) {
+	for entry, reason := range n.peers.deniedEntries() {
+		list = append(list, entry+" "+reason)
+	}
+
+	sort.Strings(list)
+
+	return list
+}
+
+// dropPeer forgets everything a peer shared with us.
+func (n *Node) dropPeer(id string) {
+	n.DisconnectedPeer(id)
+	n.table.DeleteID(id)
+}
+
+// The denied peers file has one ID or fingerprint per line, followed by the
+// reason it was denied.
+func (n *Node) decodeDeniedPeersFile() (err error) {
+	data, err := os.ReadFile(n.config.DeniedPeersFile)
+
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		entry := strings.SplitN(line, " ", 2)
+
+		if len(entry) == 1 {
+			entry = append(entry, "")
+		}
+
+		_, err = n.peers.deny(entry[0], strings.TrimSpace(entry[1]))
+
+		if err != nil {
+			log.Printf("Ignoring the rest of %s: %s\n", n.config.DeniedPeersFile, err)
+			break
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (n *Node) encodeDeniedPeersFile() (err error) {
+	n.files.Lock()
+	defer n.files.Unlock()
+
+	var buf bytes.Buffer
+
+	buf.WriteString("# Cosmofs denied peers: <ID or SHA256 fingerprint> [reason]\n")
+
+	for _, line := range n.ListDenied() {
+		buf.WriteString(line + "\n")
+	}
+
+	tmpFileName := n.config.DeniedPeersFile + ".tmp"
+
+	err = os.WriteFile(tmpFileName, buf.Bytes(), 0600)
+
+	if err != nil {
+		log.Printf("Error writing denied peers file: %s", err)
+		return err
+	}
+
+	return os.Rename(tmpFileName, n.config.DeniedPeersFile)
+}
+
+// Revocation is a statement by which the owner of a key declares it
+// compromised. It is signed with the revoked key itself, so anybody can check
+// it without trusting whoever forwards it.
+type Revocation struct {
+	ID string
+	RawKey []byte
+	Time int64
+	Signature []byte
+}
+
+func revocationDigest(id string, rawKey []byte, t int64) []byte {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00%s\x00", revocationContext, id)
+	writeField(h, rawKey)
+	binary.Write(h, binary.BigEndian, t)
+
+	return h.Sum(nil)
+}
+
+// NewRevocation revokes the key of the node.
+func (n *Node) NewRevocation() (r *Revocation, err error) {
+	r = &Revocation{
+		ID: n.pub.ID,
+		RawKey: n.pub.RawKey,
+		Time: time.Now().Unix(),
+	}
+
+	r.Signature, err = n.signDigest(revocationDigest(r.ID, r.RawKey, r.Time))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return r, err
+}
+
+// Verify checks the signature of the statement and returns the revoked peer.
+func (r *Revocation) Verify() (peer *Peer, err error) {
+	key, _, _, ok := parsePubKey(r.RawKey)
+
+	if !ok {
+		return nil, ErrBadRevocation
+	}
+
+	err = verifyDigest(key, revocationDigest(r.ID, r.RawKey, r.Time), r.Signature)
+
+	if err != nil {
+		return nil, ErrBadRevocation
+	}
+
+	return &Peer{ID: r.ID, PubKey: key, RawKey: r.RawKey}, err
+}
+
+// ApplyRevocation denies the revoked key and drops its owner from the known
+// peers and the Table. Anybody can sign the revocation of a throwaway key,
+// so only keys pinned here are acted on. isNew is false otherwise, or when
+// the key was already denied, so callers know whether to forward it.
+func (n *Node) ApplyRevocation(r *Revocation) (isNew bool, err error) {
+	peer, err := r.Verify()
+
+	if err != nil {
+		return false, err
+	}
+
+	if known, ok := n.peers.lookup(peer.ID); !ok || !samePublicKey(known.PubKey, peer.PubKey) {
+		return false, err
+	}
+
+	fp := peer.Fingerprint()
+
+	reason := "revoked by " + peer.ID + " on " + time.Unix(r.Time, 0).Format(time.RFC3339)
+
+	isNew, err = n.peers.deny(fp, reason)
+
+	if err != nil || !isNew {
+		return false, err
+	}
+
+	log.Printf("Key %s of peer %s was revoked by its owner", fp, peer.ID)
+
+	if n.peers.forget(peer) {
+		n.dropPeer(peer.ID)
+
+		err = n.encodeKnownPeersFile()
+
+		if err != nil {
+			return true, err
+		}
+	}
+
+	return true, n.encodeDeniedPeersFile()
+}
@@ -0,0 +1,135 @@
+package cosmofs
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDenyPeer(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	peer, _ := newTestPeer(t, "denied@example.com")
+
+	for _, entry := range []string{peer.ID, peer.Fingerprint()} {
+		err := n.DenyPeer(entry, "")
+
+		if err != nil {
+			t.Fatal("Failure in DenyPeer:", err)
+		}
+
+		err = n.StorePeer(peer)
+
+		if err != ErrPeerDenied {
+			t.Errorf("Failure in StorePeer. %s should be denied: %v", entry, err)
+		}
+
+		err = n.AllowPeer(entry)
+
+		if err != nil {
+			t.Error("Failure in AllowPeer:", err)
+		}
+	}
+
+	err := n.StorePeer(peer)
+
+	if err != nil {
+		t.Error("Failure in StorePeer. Peer should be allowed again:", err)
+	}
+
+	err = n.DenyPeer("not an id", "")
+
+	if err == nil {
+		t.Error("Failure in DenyPeer. Invalid entry should not pass.")
+	}
+}
+
+func TestRevocation(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	peer, priv := newTestPeer(t, "revoked@example.com")
+
+	err := n.StorePeer(peer)
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	r := &Revocation{
+		ID: peer.ID,
+		RawKey: peer.RawKey,
+		Time: time.Now().Unix(),
+	}
+
+	r.Signature = ed25519.Sign(priv, revocationDigest(r.ID, r.RawKey, r.Time))
+
+	forged := *r
+	forged.Time++
+
+	_, err = n.ApplyRevocation(&forged)
+
+	if err != ErrBadRevocation {
+		t.Error("Failure in ApplyRevocation. Forged statement should not pass:", err)
+	}
+
+	isNew, err := n.ApplyRevocation(r)
+
+	if err != nil || !isNew {
+		t.Fatal("Failure in ApplyRevocation:", err)
+	}
+
+	if _, ok := n.SearchPeer(peer.ID); ok {
+		t.Error("Failure in ApplyRevocation. Peer still known.")
+	}
+
+	if n.StorePeer(peer) != ErrPeerDenied {
+		t.Error("Failure in ApplyRevocation. Revoked key is not denied.")
+	}
+
+	isNew, _ = n.ApplyRevocation(r)
+
+	if isNew {
+		t.Error("Failure in ApplyRevocation. Statement applied twice.")
+	}
+
+	// Keys nobody pinned are not denied, nor passed on.
+	other, priv := newTestPeer(t, "throwaway@example.com")
+
+	r = &Revocation{
+		ID: other.ID,
+		RawKey: other.RawKey,
+		Time: time.Now().Unix(),
+	}
+
+	r.Signature = ed25519.Sign(priv, revocationDigest(r.ID, r.RawKey, r.Time))
+
+	isNew, err = n.ApplyRevocation(r)
+
+	if err != nil || isNew || n.peers.isDeniedEntry(other.Fingerprint()) {
+		t.Error("Failure in ApplyRevocation. Unknown key was revoked:", err)
+	}
+}
+
+func TestDenyListFull(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+
+	for i := len(n.peers.deniedEntries()); i < maxDeniedPeers; i++ {
+		_, err := n.peers.deny(fmt.Sprintf("SHA256:%d", i), "")
+
+		if err != nil {
+			t.Fatal("Failure in deny:", err)
+		}
+	}
+
+	err := n.DenyPeer("full@cosmofs.es", "")
+
+	if err != ErrDenyListFull {
+		t.Error("Failure in DenyPeer. Denied beyond the limit:", err)
+	}
+
+	// Entries already there can still be updated.
+	isNew, err := n.peers.deny("SHA256:1", "again")
+
+	if err != nil || isNew {
+		t.Errorf("Failure in deny. Got %v: %v", isNew, err)
+	}
+}
@@ -0,0 +1,622 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// dhtBucketSize is the k of Kademlia: contacts kept per bucket, nodes a
+	// record is stored at and contacts returned by a lookup.
+	dhtBucketSize int = 8
+
+	// dhtAlpha is how many contacts a lookup queries at a time.
+	dhtAlpha int = 3
+
+	// Limits of what a node stores for others.
+	dhtMaxProviders int = 20
+	dhtMaxRecords int = 10000
+
+	dhtTimeout time.Duration = 10 * time.Second
+
+	// ProviderTTL is how long a provider record lives. Nodes publish their
+	// files again every half of it.
+	ProviderTTL time.Duration = 24 * time.Hour
+)
+
+// Remote procedures of the DHT.
+const (
+	dhtPing int = iota
+	dhtFindNode
+	dhtFindValue
+	dhtStore
+)
+
+var (
+	ErrDHTDisabled = errors.New("cosmofs: the DHT is not enabled")
+	ErrDHTNotFound = newError(ErrNotFound, "cosmofs: not found in the DHT")
+)
+
+// dhtKey places peers and records in the DHT. Peers are at the hash of their
+// ID, records at the hash of what they are about.
+type dhtKey [sha256.Size]byte
+
+func peerKey(id string) dhtKey {
+	return sha256.Sum256([]byte("peer\x00" + id))
+}
+
+func fileKey(name string) dhtKey {
+	return sha256.Sum256([]byte("file\x00" + name))
+}
+
+// closer tells whether a is closer than b to k, by XOR distance.
+func (k dhtKey) closer(a, b dhtKey) bool {
+	for i := range k {
+		da, db := a[i]^k[i], b[i]^k[i]
+
+		if da != db {
+			return da < db
+		}
+	}
+
+	return false
+}
+
+// bucket returns the index of the bucket of other: the length of the prefix
+// it shares with k.
+func (k dhtKey) bucket(other dhtKey) int {
+	for i := range k {
+		if x := k[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return len(k)*8 - 1
+}
+
+// Contact is a peer of the DHT and the address it listens on.
+type Contact struct {
+	ID string
+	Addr string
+}
+
+// Provider records that the peer ID, at Addr, shares a file called Name.
+type Provider struct {
+	ID string
+	Addr string
+	Name string
+	Expires time.Time
+}
+
+// dhtRequest is sent after the DHT petition. Name is the file of FindValue
+// and Store.
+type dhtRequest struct {
+	Type int
+	Key dhtKey
+	Name string
+}
+
+type dhtReply struct {
+	Contacts []Contact
+	Providers []Provider
+}
+
+// dht is the routing table and the records a node keeps for the DHT.
+// Records can only be published by the peer they are about, as the sender
+// of every request is authenticated by its session.
+type dht struct {
+	n *Node
+	self dhtKey
+
+	mu sync.Mutex
+	buckets [len(dhtKey{}) * 8][]Contact
+	records map[dhtKey][]Provider
+	refreshed time.Time
+}
+
+func newDHT(n *Node) *dht {
+	return &dht{
+		n: n,
+		self: peerKey(n.pub.ID),
+		records: make(map[dhtKey][]Provider),
+	}
+}
+
+// update moves c to the tail of its bucket. New contacts are dropped when
+// the bucket is full: peers that have been around for long are preferred.
+func (d *dht) update(c Contact) {
+	if c.ID == d.n.pub.ID || checkID(c.ID) != nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := d.self.bucket(peerKey(c.ID))
+	bucket := d.buckets[b]
+
+	for i, old := range bucket {
+		if old.ID == c.ID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+
+	if len(bucket) < dhtBucketSize {
+		bucket = append(bucket, c)
+	}
+
+	d.buckets[b] = bucket
+}
+
+// remove drops a contact that did not answer.
+func (d *dht) remove(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	b := d.self.bucket(peerKey(id))
+
+	for i, c := range d.buckets[b] {
+		if c.ID == id {
+			d.buckets[b] = append(d.buckets[b][:i:i], d.buckets[b][i+1:]...)
+			return
+		}
+	}
+}
+
+// closest returns up to count contacts, the closest to key first.
+func (d *dht) closest(key dhtKey, count int) (contacts []Contact) {
+	d.mu.Lock()
+
+	for _, bucket := range d.buckets {
+		contacts = append(contacts, bucket...)
+	}
+
+	d.mu.Unlock()
+
+	sortContacts(contacts, key)
+
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+
+	return contacts
+}
+
+func sortContacts(contacts []Contact, key dhtKey) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return key.closer(peerKey(contacts[i].ID), peerKey(contacts[j].ID))
+	})
+}
+
+// store keeps p under key, replacing an older record of the same peer.
+func (d *dht) store(key dhtKey, p Provider) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	list, ok := d.records[key]
+
+	if !ok && len(d.records) >= dhtMaxRecords {
+		d.expire()
+
+		if len(d.records) >= dhtMaxRecords {
+			return
+		}
+	}
+
+	for i, old := range list {
+		if old.ID == p.ID {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+
+	if len(list) >= dhtMaxProviders {
+		return
+	}
+
+	d.records[key] = append(list, p)
+}
+
+// expire drops the records that are too old. mu must be held.
+func (d *dht) expire() {
+	now := time.Now()
+
+	for key, list := range d.records {
+		var alive []Provider
+
+		for _, p := range list {
+			if now.Before(p.Expires) {
+				alive = append(alive, p)
+			}
+		}
+
+		if alive == nil {
+			delete(d.records, key)
+		} else {
+			d.records[key] = alive
+		}
+	}
+}
+
+// providers returns the live records under key.
+func (d *dht) providers(key dhtKey) (list []Provider) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+
+	for _, p := range d.records[key] {
+		if now.Before(p.Expires) {
+			list = append(list, p)
+		}
+	}
+
+	return list
+}
+
+// call sends req to c, which has to prove it is c.ID. Contacts that do not
+// answer are dropped from the routing table.
+func (d *dht) call(c Contact, req dhtRequest) (reply dhtReply, err error) {
+	reply, err = d.n.callDHT(c, req)
+
+	if err != nil {
+		d.n.debug("DHT request to %s at %s failed: %s\n", c.ID, c.Addr, err)
+		d.remove(c.ID)
+		return reply, err
+	}
+
+	d.update(c)
+
+	return reply, err
+}
+
+func (n *Node) callDHT(c Contact, req dhtRequest) (reply dhtReply, err error) {
+	conn, err := n.connTo(c.ID, c.Addr)
+
+	if err != nil {
+		return reply, err
+	}
+
+	err = conn.call(MsgDHT, req, &reply, dhtTimeout)
+
+	if len(reply.Contacts) > dhtBucketSize {
+		reply.Contacts = reply.Contacts[:dhtBucketSize]
+	}
+
+	if len(reply.Providers) > dhtMaxProviders {
+		reply.Providers = reply.Providers[:dhtMaxProviders]
+	}
+
+	return reply, err
+}
+
+// answerDHT serves a DHT request of the peer.
+func (n *Node) answerDHT(r *request) (resp interface{}, err error) {
+	if n.dht == nil {
+		return nil, ErrDHTDisabled
+	}
+
+	var req dhtRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sender := dhtContact(r.peer, r.remIP)
+
+	n.dht.update(sender)
+
+	var reply dhtReply
+
+	switch req.Type {
+	case dhtPing:
+	case dhtFindNode:
+		reply.Contacts = n.dht.closest(req.Key, dhtBucketSize)
+	case dhtFindValue:
+		reply.Providers = n.dht.providers(req.Key)
+		reply.Contacts = n.dht.closest(req.Key, dhtBucketSize)
+	case dhtStore:
+		if req.Key != fileKey(req.Name) {
+			n.debug("Refusing DHT record of %s for %s\n", sender.ID, req.Name)
+			return nil, fmt.Errorf("cosmofs: DHT record for %s under another key", req.Name)
+		}
+
+		n.dht.store(req.Key, Provider{
+			ID: sender.ID,
+			Addr: sender.Addr,
+			Name: req.Name,
+			Expires: time.Now().Add(ProviderTTL),
+		})
+	default:
+		n.debug("Unknown DHT request %d from %s\n", req.Type, sender.ID)
+		return nil, fmt.Errorf("cosmofs: unknown DHT request %d", req.Type)
+	}
+
+	return reply, err
+}
+
+// lookup walks the DHT towards target, dhtAlpha contacts at a time, and
+// returns the closest contacts that answered. With a name, it looks for the
+// providers of that file and stops as soon as some are found.
+func (d *dht) lookup(target dhtKey, name string) (closest []Contact, providers []Provider) {
+	req := dhtRequest{Type: dhtFindNode, Key: target}
+
+	if name != "" {
+		req = dhtRequest{Type: dhtFindValue, Key: target, Name: name}
+	}
+
+	shortlist := d.closest(target, dhtBucketSize)
+	seen := make(map[string]bool)
+	queried := make(map[string]bool)
+
+	for _, c := range shortlist {
+		seen[c.ID] = true
+	}
+
+	type result struct {
+		c Contact
+		reply dhtReply
+		err error
+	}
+
+	for {
+		var batch []Contact
+
+		for _, c := range shortlist {
+			if !queried[c.ID] && len(batch) < dhtAlpha {
+				batch = append(batch, c)
+			}
+		}
+
+		if len(batch) == 0 || (name != "" && len(providers) > 0) {
+			break
+		}
+
+		results := make(chan result, len(batch))
+
+		for _, c := range batch {
+			queried[c.ID] = true
+
+			go func(c Contact) {
+				reply, err := d.call(c, req)
+				results <- result{c, reply, err}
+			}(c)
+		}
+
+		failed := make(map[string]bool)
+
+		for range batch {
+			r := <-results
+
+			if r.err != nil {
+				failed[r.c.ID] = true
+				continue
+			}
+
+			for _, p := range r.reply.Providers {
+				if p.Name == name {
+					providers = append(providers, p)
+				}
+			}
+
+			for _, c := range r.reply.Contacts {
+				if seen[c.ID] || c.ID == d.n.pub.ID || checkID(c.ID) != nil {
+					continue
+				}
+
+				if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+					continue
+				}
+
+				seen[c.ID] = true
+				shortlist = append(shortlist, c)
+			}
+		}
+
+		alive := shortlist[:0]
+
+		for _, c := range shortlist {
+			if !failed[c.ID] {
+				alive = append(alive, c)
+			}
+		}
+
+		shortlist = alive
+
+		sortContacts(shortlist, target)
+
+		if len(shortlist) > dhtBucketSize {
+			shortlist = shortlist[:dhtBucketSize]
+		}
+	}
+
+	for _, c := range shortlist {
+		if queried[c.ID] {
+			closest = append(closest, c)
+		}
+	}
+
+	return closest, uniqueProviders(providers)
+}
+
+// uniqueProviders keeps the first record of every peer.
+func uniqueProviders(list []Provider) (unique []Provider) {
+	seen := make(map[string]bool)
+
+	for _, p := range list {
+		if !seen[p.ID] {
+			seen[p.ID] = true
+			unique = append(unique, p)
+		}
+	}
+
+	return unique
+}
+
+// FindPeer resolves the ID of a peer to the address it listens on, asking
+// the DHT.
+func (n *Node) FindPeer(id string) (addrs []string, err error) {
+	if n.dht == nil {
+		return nil, ErrDHTDisabled
+	}
+
+	target := peerKey(id)
+
+	for _, c := range n.dht.closest(target, dhtBucketSize) {
+		if c.ID == id {
+			return []string{c.Addr}, err
+		}
+	}
+
+	closest, _ := n.dht.lookup(target, "")
+
+	for _, c := range closest {
+		if c.ID == id {
+			addrs = append(addrs, c.Addr)
+		}
+	}
+
+	if addrs == nil {
+		return nil, ErrDHTNotFound
+	}
+
+	return addrs, err
+}
+
+// PublishFile announces in the DHT that the node shares a file called name,
+// storing the record at the nodes closest to it.
+func (n *Node) PublishFile(name string) (err error) {
+	if n.dht == nil {
+		return ErrDHTDisabled
+	}
+
+	key := fileKey(name)
+
+	closest, _ := n.dht.lookup(key, "")
+
+	req := dhtRequest{Type: dhtStore, Key: key, Name: name}
+
+	stored := 0
+	err = ErrDHTNotFound
+
+	for _, c := range closest {
+		_, cerr := n.dht.call(c, req)
+
+		if cerr != nil {
+			n.debug("Error storing %s at %s: %s\n", name, c.ID, cerr)
+			err = cerr
+			continue
+		}
+
+		stored++
+	}
+
+	if stored > 0 {
+		return nil
+	}
+
+	return err
+}
+
+// FindFile returns the peers that published a file called name.
+func (n *Node) FindFile(name string) (providers []Provider, err error) {
+	if n.dht == nil {
+		return nil, ErrDHTDisabled
+	}
+
+	key := fileKey(name)
+
+	_, providers = n.dht.lookup(key, name)
+
+	providers = uniqueProviders(append(n.dht.providers(key), providers...))
+
+	if providers == nil {
+		return nil, ErrDHTNotFound
+	}
+
+	return providers, err
+}
+
+// RefreshDHT looks the node itself up, which fills the routing table of the
+// node and makes it known to its neighbours, and publishes the files it
+// shares.
+func (n *Node) RefreshDHT() (err error) {
+	if n.dht == nil {
+		return ErrDHTDisabled
+	}
+
+	n.dht.mu.Lock()
+	n.dht.refreshed = time.Now()
+	n.dht.mu.Unlock()
+
+	n.dht.lookup(n.dht.self, "")
+
+	names := make(map[string]bool)
+
+	for _, dirs := range n.table.Snapshot()[n.pub.ID] {
+		for _, file := range dirs {
+			if !file.IsDir {
+				names[file.Filename] = true
+			}
+		}
+	}
+
+	for name := range names {
+		err = n.PublishFile(name)
+
+		if err != nil {
+			log.Printf("Error publishing %s in the DHT: %s\n", name, err)
+		}
+	}
+
+	return err
+}
+
+// refreshDue tells whether the records of the node have to be published
+// again before they expire.
+func (d *dht) refreshDue() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return time.Since(d.refreshed) > ProviderTTL/2
+}
+
+// dhtContact returns the contact of the peer proved by a session coming
+// from ip.
+func dhtContact(peer *Peer, ip string) Contact {
+	return Contact{
+		ID: peer.ID,
+		Addr: peerAddr(ip, peer.Port),
+	}
+}
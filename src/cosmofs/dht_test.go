@@ -0,0 +1,149 @@
+package cosmofs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDHTKey(t *testing.T) {
+	self := peerKey("self@cosmofs.es")
+
+	if self.bucket(self) != len(self)*8-1 {
+		t.Error("Failure in bucket. Own key not in the last bucket.")
+	}
+
+	other := self
+	other[0] ^= 0x80
+
+	if self.bucket(other) != 0 {
+		t.Error("Failure in bucket. Wrong bucket for the farthest key:", self.bucket(other))
+	}
+
+	near := self
+	near[31] ^= 0x01
+
+	if !self.closer(near, other) || self.closer(other, near) {
+		t.Error("Failure in closer. XOR distance not respected.")
+	}
+}
+
+func TestDHTRecords(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	n.dht = newDHT(n)
+
+	key := fileKey("a.txt")
+
+	for i := 0; i < 2*dhtMaxProviders; i++ {
+		n.dht.store(key, Provider{ID: fmt.Sprintf("peer%d@cosmofs.es", i), Name: "a.txt", Expires: timeIn(ProviderTTL)})
+	}
+
+	n.dht.store(key, Provider{ID: "peer0@cosmofs.es", Name: "a.txt", Expires: timeIn(-ProviderTTL)})
+
+	list := n.dht.providers(key)
+
+	if len(list) != dhtMaxProviders-1 {
+		t.Errorf("Failure in store. %d providers kept", len(list))
+	}
+
+	for i := 0; i < 4*dhtBucketSize; i++ {
+		n.dht.update(Contact{ID: fmt.Sprintf("peer%d@cosmofs.es", i), Addr: "192.0.2.1:5453"})
+	}
+
+	n.dht.update(Contact{ID: n.ID(), Addr: "192.0.2.1:5453"})
+
+	closest := n.dht.closest(peerKey("peer3@cosmofs.es"), dhtBucketSize)
+
+	if len(closest) != dhtBucketSize || closest[0].ID != "peer3@cosmofs.es" {
+		t.Errorf("Failure in closest. Got %v", closest)
+	}
+
+	for _, c := range n.dht.closest(n.dht.self, 1000) {
+		if c.ID == n.ID() {
+			t.Error("Failure in update. Own contact in the routing table.")
+		}
+	}
+
+	_, err := newTestNode(t, "off@cosmofs.es").FindFile("a.txt")
+
+	if err != ErrDHTDisabled {
+		t.Error("Failure in FindFile. DHT not enabled:", err)
+	}
+}
+
+// TestDHTNetwork runs a DHT of several nodes that only know the first one.
+func TestDHTNetwork(t *testing.T) {
+	if testing.Short() {
+		t.Skip("DHT network in short mode")
+	}
+
+	nodes := make([]*Node, 12)
+
+	for i := range nodes {
+		n := newTestNode(t, fmt.Sprintf("node%d@cosmofs.es", i))
+		n.config.DHT = true
+		n.dht = newDHT(n)
+
+		if i > 0 {
+			n.config.Bootstrap = []string{peerAddr("127.0.0.1", nodes[0].Port())}
+		}
+
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+
+		nodes[i] = n
+	}
+
+	for _, n := range nodes[1:] {
+		if !waitFor(func() bool { return len(n.dht.closest(n.dht.self, 1)) > 0 }) {
+			t.Fatalf("Failure in bootstrap. %s has no contacts", n.ID())
+		}
+	}
+
+	for i, n := range nodes {
+		err := n.RefreshDHT()
+
+		if err != nil && i > 0 {
+			t.Errorf("Failure in RefreshDHT of %s: %s", n.ID(), err)
+		}
+	}
+
+	for i, n := range nodes {
+		err := n.PublishFile(fmt.Sprintf("file%d.txt", i))
+
+		if err != nil {
+			t.Errorf("Failure in PublishFile of %s: %s", n.ID(), err)
+		}
+	}
+
+	last := nodes[len(nodes)-1]
+
+	for i, n := range nodes[:len(nodes)-1] {
+		providers, err := last.FindFile(fmt.Sprintf("file%d.txt", i))
+
+		if err != nil || len(providers) != 1 || providers[0].ID != n.ID() || providers[0].Addr != peerAddr("127.0.0.1", n.Port()) {
+			t.Errorf("Failure in FindFile of file%d.txt: %v %v", i, providers, err)
+		}
+
+		addrs, err := last.FindPeer(n.ID())
+
+		if err != nil || len(addrs) != 1 || addrs[0] != peerAddr("127.0.0.1", n.Port()) {
+			t.Errorf("Failure in FindPeer of %s: %v %v", n.ID(), addrs, err)
+		}
+	}
+
+	_, err := last.FindFile("missing.txt")
+
+	if err != ErrDHTNotFound {
+		t.Error("Failure in FindFile. Missing file found:", err)
+	}
+}
+
+func timeIn(d time.Duration) time.Time {
+	return time.Now().Add(d)
+}
@@ -0,0 +1,250 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// duplicateWindow is how long the announcements of a peer are ignored after
+// one has been answered, so the copies that arrive through every interface
+// and address family are answered only once.
+const duplicateWindow time.Duration = 2 * time.Second
+
+// listenMulticast joins the discovery group on every interface that supports
+// multicast. Failures are only logged, as many hosts have no IPv6.
+func (n *Node) listenMulticast() {
+	ifaces, err := net.Interfaces()
+
+	if err != nil {
+		log.Printf("Error listing interfaces: %s\n", err)
+		return
+	}
+
+	group := &net.UDPAddr{
+		IP:		net.ParseIP(DiscoveryGroup),
+		Port:	n.discoveryPort,
+	}
+
+	for i := range ifaces {
+		iface := &ifaces[i]
+
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		conn, err := net.ListenMulticastUDP("udp6", iface, group)
+
+		if err != nil {
+			n.debug("Error joining %s on %s: %s\n", DiscoveryGroup, iface.Name, err)
+			continue
+		}
+
+		n.lnMulticast = append(n.lnMulticast, conn)
+	}
+}
+
+// announceTargets returns where announcements are sent: the broadcast
+// address of every IPv4 subnet and the discovery group on every interface,
+// together with the local address to send them from. Only the subnets of
+// the bind address are used when the node is bound to one.
+func (n *Node) announceTargets() (locals, targets []*net.UDPAddr) {
+	ifaces, err := net.Interfaces()
+
+	if err != nil {
+		log.Printf("Error listing interfaces: %s\n", err)
+	}
+
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+
+		if err != nil {
+			continue
+		}
+
+		multicast := false
+
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+
+			if !ok {
+				continue
+			}
+
+			if !n.bind.IsUnspecified() && !n.bind.Equal(ipnet.IP) {
+				continue
+			}
+
+			ip4 := ipnet.IP.To4()
+
+			if ip4 != nil && iface.Flags&net.FlagBroadcast != 0 {
+				broadcast := make(net.IP, len(ip4))
+
+				for i := range ip4 {
+					broadcast[i] = ip4[i] | ^ipnet.Mask[len(ipnet.Mask)-len(ip4)+i]
+				}
+
+				locals = append(locals, &net.UDPAddr{IP: ip4})
+				targets = append(targets, &net.UDPAddr{IP: broadcast, Port: n.discoveryPort})
+			}
+
+			if ip4 == nil && ipnet.IP.IsLinkLocalUnicast() {
+				multicast = iface.Flags&net.FlagMulticast != 0
+			}
+		}
+
+		if multicast && len(n.lnMulticast) > 0 {
+			locals = append(locals, nil)
+			targets = append(targets, &net.UDPAddr{
+				IP:		net.ParseIP(DiscoveryGroup),
+				Port:	n.discoveryPort,
+				Zone:	iface.Name,
+			})
+		}
+	}
+
+	// Hosts without any broadcast interface still try the whole network,
+	// like every version before.
+	if len(targets) == 0 {
+		locals = append(locals, nil)
+		targets = append(targets, &net.UDPAddr{
+			IP:		net.IPv4bcast,
+			Port:	n.discoveryPort,
+		})
+	}
+
+	return locals, targets
+}
+
+// announce sends a broadcast message to anyone connected on the same
+// networks.
+func (n *Node) announce() {
+	var data []byte
+
+	b, err := n.newBeacon()
+
+	if err == nil {
+		data, err = b.encode()
+	}
+
+	if err != nil {
+		log.Printf("Error creating beacon: %s\n", err)
+		return
+	}
+
+	locals, targets := n.announceTargets()
+
+	for i, target := range targets {
+		n.debug("Announcing node to %v\n", target)
+
+		conn, err := net.DialUDP("udp", locals[i], target)
+
+		if err != nil {
+			log.Printf("Error announcing node to %v: %s\n", target, err)
+			continue
+		}
+
+		_, err = conn.Write(data)
+
+		if err != nil {
+			log.Printf("Error announcing node to %v: %s\n", target, err)
+		}
+
+		conn.Close()
+	}
+}
+
+// serveUDP receives the announcements of other peers through conn until the
+// node is closed.
+func (n *Node) serveUDP(conn *net.UDPConn) {
+	defer n.wg.Done()
+
+	for {
+		data := make([]byte, 4096)
+
+		size, remoteIP, err := conn.ReadFromUDP(data)
+
+		if err != nil {
+			if n.closed() {
+				return
+			}
+
+			n.debug("Error: %s\n", err)
+			continue
+		}
+
+		n.wg.Add(1)
+
+		go func() {
+			defer n.wg.Done()
+			n.handleUDPPetition(data[:size], remoteIP)
+		}()
+	}
+}
+
+// ownAnnouncement tells whether an announcement of id listening on port,
+// received from ip, was sent by the node itself through any interface.
+func (n *Node) ownAnnouncement(id string, port int, ip net.IP) bool {
+	if id == n.pub.ID {
+		return true
+	}
+
+	return port == n.port && isLocalIP(ip)
+}
+
+// isLocalIP tells whether ip belongs to one of the interfaces of the host.
+func isLocalIP(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// discovered records that the announcement of id is being answered. It
+// returns false for the copies received within duplicateWindow.
+func (n *Node) discovered(id string) bool {
+	n.announcedMu.Lock()
+	defer n.announcedMu.Unlock()
+
+	if time.Since(n.announced[id]) < duplicateWindow {
+		return false
+	}
+
+	n.announced[id] = time.Now()
+
+	return true
+}
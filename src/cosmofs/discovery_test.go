@@ -0,0 +1,59 @@
+package cosmofs
+
+import (
+	"net"
+	"testing"
+)
+
+func TestOwnAnnouncement(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+
+	err := n.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	defer n.Close()
+
+	loopback := net.IPv4(127, 0, 0, 1)
+	remote := net.IPv4(192, 0, 2, 1)
+
+	if !n.ownAnnouncement(n.ID(), n.Port(), remote) {
+		t.Error("Failure in ownAnnouncement. Own ID not recognized.")
+	}
+
+	if !n.ownAnnouncement("other@cosmofs.es", n.Port(), loopback) {
+		t.Error("Failure in ownAnnouncement. Own address not recognized.")
+	}
+
+	if n.ownAnnouncement("other@cosmofs.es", n.Port()+1, loopback) {
+		t.Error("Failure in ownAnnouncement. Another node on this host taken as ours.")
+	}
+
+	if n.ownAnnouncement("other@cosmofs.es", n.Port(), remote) {
+		t.Error("Failure in ownAnnouncement. Remote peer taken as ours.")
+	}
+
+	if !n.discovered("other@cosmofs.es") || n.discovered("other@cosmofs.es") {
+		t.Error("Failure in discovered. Duplicate announcement not dropped.")
+	}
+}
+
+func TestAnnounceTargets(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	n.bind = net.IPv4zero
+	n.discoveryPort = DefaultPort
+
+	locals, targets := n.announceTargets()
+
+	if len(targets) == 0 || len(locals) != len(targets) {
+		t.Fatalf("Failure in announceTargets. %v from %v", targets, locals)
+	}
+
+	for _, target := range targets {
+		if target.Port != DefaultPort || !(target.IP.To4() != nil || target.IP.IsLinkLocalMulticast()) {
+			t.Error("Failure in announceTargets. Wrong target", target)
+		}
+	}
+}
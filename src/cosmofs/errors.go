@@ -0,0 +1,100 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"errors"
+)
+
+// Errors of the node are of one of these kinds, which callers tell apart
+// with errors.Is. They keep their kind over the wire, see WireError.
+var (
+	ErrNotFound = errors.New("cosmofs: not found")
+	ErrInvalidID = errors.New("cosmofs: invalid ID")
+	ErrInvalidPath = errors.New("cosmofs: invalid path")
+	ErrPermissionDenied = errors.New("cosmofs: permission denied")
+	ErrPeerOffline = errors.New("cosmofs: the peer is not connected")
+	ErrTimeout = errors.New("cosmofs: the peer did not answer in time")
+	ErrIntegrity = errors.New("cosmofs: integrity check failed")
+)
+
+// Error is an error of one of the kinds about an ID, a directory or a file,
+// named by Path. Err is its cause, if any.
+type Error struct {
+	Kind error
+	Path string
+	Err error
+}
+
+func (e *Error) Error() string {
+	s := e.Kind.Error()
+
+	if e.Path != "" {
+		s += ": " + e.Path
+	}
+
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+
+	return s
+}
+
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+
+	return []error{e.Kind, e.Err}
+}
+
+// kindError is an error of the node with its own message, of kind.
+type kindError struct {
+	text string
+	kind error
+}
+
+func newError(kind error, text string) error {
+	return &kindError{text: text, kind: kind}
+}
+
+func (e *kindError) Error() string {
+	return e.text
+}
+
+func (e *kindError) Unwrap() error {
+	return e.kind
+}
+
+func notFound(path string) error {
+	return &Error{Kind: ErrNotFound, Path: path}
+}
+
+// peerOffline tells that the peer id could not be reached because of err,
+// unless err is of another kind.
+func peerOffline(id string, err error) error {
+	if code := errorCode(err); code != CodeFailed && code != CodePeerOffline {
+		return err
+	}
+
+	return &Error{Kind: ErrPeerOffline, Path: id, Err: err}
+}
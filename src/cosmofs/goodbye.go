@@ -0,0 +1,166 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	goodbyeContext string = "cosmofs-goodbye-v1"
+
+	// goodbyeMaxAge bounds how old a goodbye can be, so a captured one
+	// cannot be replayed to disconnect the peer later on.
+	goodbyeMaxAge time.Duration = 5 * time.Minute
+
+	// shutdownTimeout bounds the time Close waits for the peers and for
+	// the petitions being served.
+	shutdownTimeout time.Duration = 5 * time.Second
+)
+
+var ErrBadGoodbye = errors.New("cosmofs: invalid goodbye")
+
+// Goodbye is sent to the connected peers when a node shuts down, signed with
+// the key of the node.
+type Goodbye struct {
+	ID string
+	Time int64
+	Signature []byte
+}
+
+// goodbyeDigest returns the hash that the leaving peer has to sign.
+func goodbyeDigest(id string, t int64) []byte {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00", goodbyeContext, id, t)
+
+	return h.Sum(nil)
+}
+
+// newGoodbye returns a signed goodbye of the node.
+func (n *Node) newGoodbye() (g Goodbye, err error) {
+	g = Goodbye{
+		ID: n.pub.ID,
+		Time: time.Now().UnixNano(),
+	}
+
+	g.Signature, err = n.signDigest(goodbyeDigest(g.ID, g.Time))
+
+	return g, err
+}
+
+// sayGoodbye tells every connected peer that the node is leaving and waits
+// for them, at most shutdownTimeout.
+func (n *Node) sayGoodbye() {
+	g, err := n.newGoodbye()
+
+	if err != nil {
+		log.Printf("Error signing goodbye: %s\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for id, ip := range n.ConnectedPeers() {
+		wg.Add(1)
+
+		go func(id, ip string) {
+			defer wg.Done()
+
+			err := n.sendGoodbye(id, ip, g)
+
+			if err != nil {
+				n.debug("Error saying goodbye to %s: %s\n", id, err)
+			}
+		}(id, ip)
+	}
+
+	wg.Wait()
+}
+
+// sendGoodbye sends g to peer id at ip. The connection is closed after,
+// we are leaving.
+func (n *Node) sendGoodbye(id, ip string, g Goodbye) (err error) {
+	c, err := n.connTo(id, ip)
+
+	if err != nil {
+		return err
+	}
+
+	defer c.Close()
+
+	return c.call(MsgGoodbye, g, nil, shutdownTimeout)
+}
+
+// checkGoodbye verifies that g was signed by the pinned key of peer id, the
+// peer at the other end of the connection, not long ago.
+func (n *Node) checkGoodbye(g Goodbye, id string) (err error) {
+	if id == "" || g.ID != id {
+		return ErrBadGoodbye
+	}
+
+	age := time.Since(time.Unix(0, g.Time))
+
+	if age > goodbyeMaxAge || age < -goodbyeMaxAge {
+		return ErrBadGoodbye
+	}
+
+	peer, ok := n.SearchPeer(id)
+
+	if !ok {
+		return ErrBadGoodbye
+	}
+
+	return verifyDigest(peer.PubKey, goodbyeDigest(g.ID, g.Time), g.Signature)
+}
+
+// answerGoodbye disconnects the peer if its goodbye is valid, so its files
+// are marked offline.
+func (n *Node) answerGoodbye(r *request) (resp interface{}, err error) {
+	var g Goodbye
+
+	err = r.decode(&g)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id := r.peer.ID
+
+	err = n.checkGoodbye(g, id)
+
+	if err != nil {
+		log.Printf("Rejected goodbye from %s: %s\n", id, err)
+		return nil, err
+	}
+
+	log.Printf("Peer %s is leaving\n", id)
+
+	n.DisconnectedPeer(id)
+
+	return nil, err
+}
@@ -0,0 +1,159 @@
+package cosmofs
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// sendTestGoodbye hands g to b through a session opened by a, and returns
+// the answer of b.
+func sendTestGoodbye(t *testing.T, a, b *Node, g Goodbye) (err error) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+
+	defer ln.Close()
+
+	served := make(chan struct{})
+
+	go func() {
+		defer close(served)
+
+		conn, err := ln.AcceptTCP()
+
+		if err == nil {
+			b.handleTCPPetition(conn)
+		}
+	}()
+
+	s, err := a.DialSession(ln.Addr().(*net.TCPAddr))
+
+	if err != nil {
+		t.Fatal("Failure in DialSession:", err)
+	}
+
+	c := a.newPeerConn(s, "127.0.0.1", nil)
+	a.runConn(c)
+
+	err = c.call(MsgGoodbye, g, nil, shutdownTimeout)
+	c.Close()
+
+	<-served
+
+	return err
+}
+
+func TestGoodbye(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+	mallory := newTestNode(t, "mallory@cosmofs.es")
+
+	for _, p := range []*Node{a, mallory} {
+		err := b.StorePeer(p.PublicPeer())
+
+		if err != nil {
+			t.Fatal("Failure in StorePeer:", err)
+		}
+	}
+
+	b.table.Merge(a.table.Snapshot())
+	b.ConnectedPeer(a.ID(), "127.0.0.1")
+
+	if !b.table.Files(a.ID(), "out1")[0].Online {
+		t.Fatal("Failure in ConnectedPeer. Files of the peer are not online.")
+	}
+
+	// Goodbyes signed by someone else, or too old, are ignored.
+	forged, err := mallory.newGoodbye()
+
+	if err != nil {
+		t.Fatal("Failure in newGoodbye:", err)
+	}
+
+	forged.ID = a.ID()
+
+	stale, err := a.newGoodbye()
+
+	if err != nil {
+		t.Fatal("Failure in newGoodbye:", err)
+	}
+
+	stale.Time = time.Now().Add(-2 * goodbyeMaxAge).UnixNano()
+	stale.Signature, _ = a.signDigest(goodbyeDigest(stale.ID, stale.Time))
+
+	for _, g := range []struct {
+		from *Node
+		g Goodbye
+	}{{mallory, forged}, {a, stale}} {
+		err = sendTestGoodbye(t, g.from, b, g.g)
+
+		if err == nil {
+			t.Error("Failure in answerGoodbye. Invalid goodbye accepted.")
+		}
+	}
+
+	if _, ok := b.ConnectedPeers()[a.ID()]; !ok {
+		t.Fatal("Failure in answerGoodbye. Peer disconnected by an invalid goodbye.")
+	}
+
+	g, err := a.newGoodbye()
+
+	if err != nil {
+		t.Fatal("Failure in newGoodbye:", err)
+	}
+
+	err = sendTestGoodbye(t, a, b, g)
+
+	if err != nil {
+		t.Fatal("Failure in sendGoodbye:", err)
+	}
+
+	if _, ok := b.ConnectedPeers()[a.ID()]; ok {
+		t.Error("Failure in answerGoodbye. Peer still connected.")
+	}
+
+	if b.table.Files(a.ID(), "out1")[0].Online {
+		t.Error("Failure in answerGoodbye. Files of the peer are still online.")
+	}
+}
+
+func TestCloseFlushes(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	other := newTestNode(t, "other@cosmofs.es")
+
+	err := n.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	n.peers.addKnown([]*Peer{other.PublicPeer()})
+
+	err = n.Close()
+
+	if err != nil {
+		t.Fatal("Failure in Close:", err)
+	}
+
+	err = n.Close()
+
+	if err != nil {
+		t.Error("Failure in Close. Second call failed:", err)
+	}
+
+	data, err := os.ReadFile(n.config.KnownPeersFile)
+
+	if err != nil {
+		t.Fatal("Error reading known peers file:", err)
+	}
+
+	peers, err := parseKnownPeers(data)
+
+	if err != nil || len(peers) != 1 || peers[0].ID != other.ID() {
+		t.Errorf("Failure in Close. Known peers not flushed: %v %v", peers, err)
+	}
+}
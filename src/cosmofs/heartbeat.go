@@ -0,0 +1,175 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrBadHeartbeat = errors.New("cosmofs: heartbeat answered with a different payload")
+
+// heartbeat is sent to a connected peer, which echoes it back.
+type heartbeat struct {
+	Time int64
+}
+
+// keepAlive checks the connected peers every HeartbeatInterval until the
+// node is closed.
+func (n *Node) keepAlive() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.config.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.checkPeers()
+
+			if n.lnMDNS != nil {
+				n.browseMDNS()
+			}
+
+			if time.Now().After(n.pexNext) {
+				n.pexNext = time.Now().Add(pexInterval)
+				n.exchangePeers()
+			}
+
+			if n.dht != nil && n.dht.refreshDue() {
+				n.wg.Add(1)
+
+				go func() {
+					defer n.wg.Done()
+					n.RefreshDHT()
+				}()
+			}
+		}
+	}
+}
+
+// checkPeers disconnects the peers that have not been heard of for
+// PeerTimeout and sends a heartbeat to the rest.
+func (n *Node) checkPeers() {
+	for _, id := range n.peers.expired(n.config.PeerTimeout) {
+		log.Printf("Peer %s timed out, disconnecting it\n", id)
+		n.DisconnectedPeer(id)
+		n.scheduleReconnect(id)
+	}
+
+	for id, ip := range n.ConnectedPeers() {
+		n.wg.Add(1)
+
+		go func(id, ip string) {
+			defer n.wg.Done()
+			n.sendHeartbeat(id, ip)
+		}(id, ip)
+	}
+}
+
+// sendHeartbeat records the round trip time to peer id if it answers. The
+// connection is closed if it does not, so the next one is dialed anew.
+func (n *Node) sendHeartbeat(id, ip string) {
+	c, err := n.connTo(id, ip)
+
+	if err != nil {
+		n.debug("Error sending heartbeat to %s: %s\n", id, err)
+		return
+	}
+
+	rtt, err := n.exchangeHeartbeat(c)
+
+	if err != nil {
+		n.debug("Error sending heartbeat to %s: %s\n", id, err)
+		c.Close()
+		return
+	}
+
+	n.debug("Heartbeat from %s in %v\n", id, rtt)
+
+	n.peers.seen(id, rtt)
+}
+
+// exchangeHeartbeat sends a heartbeat through c and waits for the echo, at
+// most PeerTimeout.
+func (n *Node) exchangeHeartbeat(c *peerConn) (rtt time.Duration, err error) {
+	start := time.Now()
+	sent := heartbeat{Time: start.UnixNano()}
+
+	var answer heartbeat
+
+	err = c.call(MsgHeartbeat, sent, &answer, n.config.PeerTimeout)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if answer != sent {
+		return 0, ErrBadHeartbeat
+	}
+
+	return time.Since(start), err
+}
+
+// answerHeartbeat echoes the heartbeat of the peer. A known peer we had
+// given up on is connected again.
+func (n *Node) answerHeartbeat(r *request) (resp interface{}, err error) {
+	var hb heartbeat
+
+	err = r.decode(&hb)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id := r.peer.ID
+
+	// Only the pinned key keeps its ID alive, or moves its address.
+	err = n.CheckPeer(r.peer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !n.peers.seen(id, 0) {
+		if _, ok := n.SearchPeer(id); ok && !n.IsDeniedID(id) {
+			log.Printf("Peer %s is back\n", id)
+			n.ConnectedPeer(id, peerAddr(r.remIP, r.peer.Port))
+		}
+	}
+
+	return hb, err
+}
+
+// refreshOnline marks the files of the connected peers online and the rest
+// offline.
+func (n *Node) refreshOnline() {
+	connected := n.ConnectedPeers()
+
+	n.table.setOnline(n.pub.ID, func(id string) bool {
+		_, ok := connected[id]
+		return ok
+	})
+}
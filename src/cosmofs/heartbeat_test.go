@@ -0,0 +1,128 @@
+package cosmofs
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	err := b.StorePeer(a.PublicPeer())
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.AcceptTCP()
+
+		if err == nil {
+			b.handleTCPPetition(conn)
+		}
+	}()
+
+	s, err := a.DialSession(ln.Addr().(*net.TCPAddr))
+
+	if err != nil {
+		t.Fatal("Failure in DialSession:", err)
+	}
+
+	c := a.newPeerConn(s, "127.0.0.1", nil)
+	a.runConn(c)
+
+	defer c.Close()
+
+	rtt, err := a.exchangeHeartbeat(c)
+
+	if err != nil || rtt <= 0 {
+		t.Fatal("Failure in exchangeHeartbeat:", rtt, err)
+	}
+
+	// b had not seen a yet, but knows its key: it is connected again.
+	status := b.PeerStatus()
+
+	if len(status) != 1 || status[0].ID != a.ID() || time.Since(status[0].LastSeen) > time.Minute {
+		t.Errorf("Failure in answerHeartbeat. Status is %+v", status)
+	}
+}
+
+func TestHeartbeatChangedKey(t *testing.T) {
+	b := newTestNode(t, "bob@cosmofs.es")
+	a, _ := newTestPeer(t, "alice@cosmofs.es")
+	impostor, _ := newTestPeer(t, "alice@cosmofs.es")
+
+	err := b.StorePeer(a)
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	body, err := encodeBody(heartbeat{Time: 1})
+
+	if err != nil {
+		t.Fatal("Failure in encodeBody:", err)
+	}
+
+	_, err = b.answerHeartbeat(&request{
+		Header: Header{Type: MsgHeartbeat, Version: WireVersion},
+		body: body,
+		peer: impostor,
+		remIP: "192.0.2.66",
+	})
+
+	if err != ErrKeyChanged {
+		t.Error("Failure in answerHeartbeat. Impostor answered with:", err)
+	}
+
+	if len(b.PeerStatus()) != 0 {
+		t.Errorf("Failure in answerHeartbeat. Impostor is connected: %+v", b.PeerStatus())
+	}
+}
+
+func TestPeerTimeout(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	n.config.PeerTimeout = 10 * time.Millisecond
+
+	n.table.Merge(IDTable{
+		"gone@cosmofs.es": DirTable{"out1": FileList{{Filename: "a"}}},
+	})
+
+	n.ConnectedPeer("gone@cosmofs.es", "192.0.2.1")
+
+	if !n.table.Files("gone@cosmofs.es", "out1")[0].Online {
+		t.Error("Failure in ConnectedPeer. Files of the peer are not online.")
+	}
+
+	n.peers.seen("gone@cosmofs.es", time.Millisecond)
+
+	if n.PeerStatus()[0].RTT != time.Millisecond {
+		t.Error("Failure in seen. RTT not recorded.")
+	}
+
+	time.Sleep(2 * n.config.PeerTimeout)
+
+	n.checkPeers()
+
+	if len(n.ConnectedPeers()) != 0 {
+		t.Error("Failure in checkPeers. Peer did not time out.")
+	}
+
+	if n.table.Files("gone@cosmofs.es", "out1")[0].Online {
+		t.Error("Failure in checkPeers. Files of the peer are still online.")
+	}
+
+	if n.table.Files(n.ID(), "out1")[0].Online {
+		t.Error("Failure in checkPeers. Own files should be left alone.")
+	}
+}
@@ -0,0 +1,448 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"math/big"
+)
+
+const opensshMagic string = "openssh-key-v1\x00"
+
+var (
+	ErrPassphraseNeeded = errors.New("SSH: private key is encrypted, a passphrase is needed (COSMOFSPASSPHRASE)")
+	ErrBadPassphrase = errors.New("SSH: cannot decrypt private key, wrong passphrase")
+
+	errBadOpenSSHKey = errors.New("SSH: malformed OpenSSH private key")
+)
+
+// parsePKCS8PrivateKey parses an unencrypted PKCS#8 key.
+func parsePKCS8PrivateKey(der []byte) (out crypto.Signer, err error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+
+	if err != nil {
+		return nil, err
+	}
+
+	out, ok := key.(crypto.Signer)
+
+	if !ok {
+		return nil, errors.New("SSH: unsupported PKCS#8 private key")
+	}
+
+	return out, err
+}
+
+// parseOpenSSHPrivateKey parses the "openssh-key-v1" format described in
+// PROTOCOL.key of OpenSSH, encrypted or not.
+func parseOpenSSHPrivateKey(in, passphrase []byte) (out crypto.Signer, err error) {
+	if !bytes.HasPrefix(in, []byte(opensshMagic)) {
+		return nil, errBadOpenSSHKey
+	}
+
+	in = in[len(opensshMagic):]
+
+	cipherName, in, ok := parseKey(in)
+
+	if !ok {
+		return nil, errBadOpenSSHKey
+	}
+
+	kdfName, in, ok := parseKey(in)
+
+	if !ok {
+		return nil, errBadOpenSSHKey
+	}
+
+	kdfOptions, in, ok := parseKey(in)
+
+	if !ok || len(in) < 4 {
+		return nil, errBadOpenSSHKey
+	}
+
+	if binary.BigEndian.Uint32(in) != 1 {
+		return nil, errors.New("SSH: only one key per OpenSSH private key file is supported")
+	}
+
+	// The public key is skipped, it comes again with the private one.
+	_, in, ok = parseKey(in[4:])
+
+	if !ok {
+		return nil, errBadOpenSSHKey
+	}
+
+	private, _, ok := parseKey(in)
+
+	if !ok {
+		return nil, errBadOpenSSHKey
+	}
+
+	if string(cipherName) != "none" {
+		private, err = decryptOpenSSHKey(string(cipherName), string(kdfName), kdfOptions, private, passphrase)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Both check integers are equal when the key was correctly decrypted.
+	if len(private) < 8 {
+		return nil, errBadOpenSSHKey
+	}
+
+	if binary.BigEndian.Uint32(private) != binary.BigEndian.Uint32(private[4:]) {
+		return nil, ErrBadPassphrase
+	}
+
+	algo, private, ok := parseKey(private[8:])
+
+	if !ok {
+		return nil, errBadOpenSSHKey
+	}
+
+	switch string(algo) {
+	case hostAlgoRSA:
+		return parseOpenSSHRSA(private)
+	case hostAlgoEd25519:
+		return parseOpenSSHEd25519(private)
+	case hostAlgoECDSA256, hostAlgoECDSA384, hostAlgoECDSA521:
+		return parseOpenSSHECDSA(string(algo), private)
+	}
+
+	return nil, errors.New("SSH: unknown private key type " + string(algo))
+}
+
+func decryptOpenSSHKey(cipherName, kdfName string, kdfOptions, data, passphrase []byte) (out []byte, err error) {
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseNeeded
+	}
+
+	if kdfName != "bcrypt" {
+		return nil, errors.New("SSH: unsupported key derivation function " + kdfName)
+	}
+
+	var keyLen int
+
+	switch cipherName {
+	case "aes128-ctr", "aes128-cbc":
+		keyLen = 16
+	case "aes192-ctr", "aes192-cbc":
+		keyLen = 24
+	case "aes256-ctr", "aes256-cbc":
+		keyLen = 32
+	default:
+		return nil, errors.New("SSH: unsupported private key cipher " + cipherName)
+	}
+
+	salt, kdfOptions, ok := parseKey(kdfOptions)
+
+	if !ok || len(kdfOptions) < 4 {
+		return nil, errBadOpenSSHKey
+	}
+
+	rounds := int(binary.BigEndian.Uint32(kdfOptions))
+
+	k, err := bcryptPBKDF(passphrase, salt, rounds, keyLen+aes.BlockSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(k[:keyLen])
+
+	if err != nil {
+		return nil, err
+	}
+
+	iv := k[keyLen:]
+	out = make([]byte, len(data))
+
+	if cipherName[len(cipherName)-3:] == "ctr" {
+		cipher.NewCTR(block, iv).XORKeyStream(out, data)
+		return out, err
+	}
+
+	if len(data)%aes.BlockSize != 0 {
+		return nil, errBadOpenSSHKey
+	}
+
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+
+	return out, err
+}
+
+func parseOpenSSHRSA(in []byte) (out crypto.Signer, err error) {
+	// n, e, d, iqmp, p, q
+	var ints [6]*big.Int
+
+	for i := range ints {
+		var ok bool
+
+		ints[i], in, ok = parseInt(in)
+
+		if !ok {
+			return nil, errBadOpenSSHKey
+		}
+	}
+
+	if !ints[1].IsInt64() {
+		return nil, errBadOpenSSHKey
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: ints[0],
+			E: int(ints[1].Int64()),
+		},
+		D: ints[2],
+		Primes: []*big.Int{ints[4], ints[5]},
+	}
+
+	err = key.Validate()
+
+	if err != nil {
+		return nil, err
+	}
+
+	key.Precompute()
+
+	return key, err
+}
+
+func parseOpenSSHEd25519(in []byte) (out crypto.Signer, err error) {
+	pub, in, ok := parseKey(in)
+
+	if !ok || len(pub) != ed25519.PublicKeySize {
+		return nil, errBadOpenSSHKey
+	}
+
+	priv, _, ok := parseKey(in)
+
+	if !ok || len(priv) != ed25519.PrivateKeySize {
+		return nil, errBadOpenSSHKey
+	}
+
+	key := ed25519.PrivateKey(priv)
+
+	if !bytes.Equal(key.Public().(ed25519.PublicKey), pub) {
+		return nil, errBadOpenSSHKey
+	}
+
+	return key, err
+}
+
+func parseOpenSSHECDSA(algo string, in []byte) (out crypto.Signer, err error) {
+	pub, in, ok := parseECDSA(algo, in)
+
+	if !ok {
+		return nil, errBadOpenSSHKey
+	}
+
+	d, _, ok := parseInt(in)
+
+	if !ok || d.Sign() <= 0 {
+		return nil, errBadOpenSSHKey
+	}
+
+	raw := make([]byte, (pub.Curve.Params().BitSize+7)/8)
+
+	if d.BitLen() > len(raw)*8 {
+		return nil, errBadOpenSSHKey
+	}
+
+	key, err := ecdsa.ParseRawPrivateKey(pub.Curve, d.FillBytes(raw))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !key.PublicKey.Equal(pub) {
+		return nil, errBadOpenSSHKey
+	}
+
+	return key, err
+}
+
+var (
+	oidPBES2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+
+	oidHMACWithSHA1 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// Structures of RFC 5208 and RFC 8018.
+type encryptedPrivateKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt []byte
+	IterationCount int
+	KeyLength int `asn1:"optional"`
+	PRF pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// parseEncryptedPKCS8PrivateKey parses a PKCS#8 key encrypted with PBES2,
+// PBKDF2 and AES-CBC, which is what OpenSSL produces by default.
+func parseEncryptedPKCS8PrivateKey(der, passphrase []byte) (out crypto.Signer, err error) {
+	if len(passphrase) == 0 {
+		return nil, ErrPassphraseNeeded
+	}
+
+	var info encryptedPrivateKeyInfo
+	var params pbes2Params
+	var kdf pbkdf2Params
+	var iv []byte
+
+	unsupported := errors.New("SSH: unsupported encryption of PKCS#8 private key")
+
+	_, err = asn1.Unmarshal(der, &info)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, unsupported
+	}
+
+	_, err = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, unsupported
+	}
+
+	_, err = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var prf func() hash.Hash
+
+	switch {
+	case len(kdf.PRF.Algorithm) == 0, kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, unsupported
+	}
+
+	var keyLen int
+
+	switch {
+	case params.EncryptionScheme.Algorithm.Equal(oidAES128CBC):
+		keyLen = 16
+	case params.EncryptionScheme.Algorithm.Equal(oidAES192CBC):
+		keyLen = 24
+	case params.EncryptionScheme.Algorithm.Equal(oidAES256CBC):
+		keyLen = 32
+	default:
+		return nil, unsupported
+	}
+
+	_, err = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv)
+
+	if err != nil || len(iv) != aes.BlockSize {
+		return nil, unsupported
+	}
+
+	key, err := pbkdf2.Key(prf, string(passphrase), kdf.Salt, kdf.IterationCount, keyLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data := info.EncryptedData
+
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, ErrBadPassphrase
+	}
+
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// PKCS#7 padding; wrong passphrases almost always break it.
+	pad := int(plain[len(plain)-1])
+
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, ErrBadPassphrase
+	}
+
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, ErrBadPassphrase
+		}
+	}
+
+	out, err = parsePKCS8PrivateKey(plain[:len(plain)-pad])
+
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+
+	return out, err
+}
@@ -0,0 +1,305 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The known peers file looks like an authorized_keys file, one peer per line:
+//
+//	ssh-ed25519 AAAAC3Nza... alice@example.com addrs=192.168.1.10,10.0.0.2 laptop
+//
+// Key type, key and ID are mandatory. The list of addresses and the trailing
+// comment are optional. Empty lines and lines starting with # are ignored.
+const (
+	knownPeersHeader string = "# Cosmofs known peers: <key type> <key> <ID> [addrs=<addr>,...] [comment]\n"
+	addrsPrefix string = "addrs="
+
+	// maxPeerAddrs is how many of the last addresses of a peer are kept.
+	maxPeerAddrs int = 4
+)
+
+// legacyPeer is how the original gob known peers file stored a Peer.
+type legacyPeer struct {
+	ID string
+	RawKey []byte
+}
+
+// formatKnownPeer returns the line of peer in the known peers file.
+func formatKnownPeer(peer *Peer) string {
+	kind, key, _, ok := parseString(peer.RawKey)
+
+	if !ok {
+		return ""
+	}
+
+	line := string(kind) + " " + string(key) + " " + peer.ID
+
+	if len(peer.Addrs) > 0 {
+		line += " " + addrsPrefix + strings.Join(peer.Addrs, ",")
+	}
+
+	if peer.Comment != "" {
+		line += " " + peer.Comment
+	}
+
+	return line + "\n"
+}
+
+// parseKnownPeer parses one line of the known peers file.
+func parseKnownPeer(line string) (peer *Peer, err error) {
+	fields := strings.Fields(line)
+
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("expected <key type> <key> <ID>, got %q", line)
+	}
+
+	raw := []byte(strings.Join(fields[:3], " ") + "\n")
+
+	key, _, id, ok := parsePubKey(raw)
+
+	if !ok {
+		return nil, fmt.Errorf("cannot parse key of %s", fields[2])
+	}
+
+	err = checkID(string(id))
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID %s", id)
+	}
+
+	peer = &Peer{
+		ID: string(id),
+		PubKey: key,
+		RawKey: raw,
+	}
+
+	rest := fields[3:]
+
+	if len(rest) > 0 && strings.HasPrefix(rest[0], addrsPrefix) {
+		for _, addr := range strings.Split(strings.TrimPrefix(rest[0], addrsPrefix), ",") {
+			if addr != "" {
+				peer.Addrs = append(peer.Addrs, addr)
+			}
+		}
+
+		rest = rest[1:]
+	}
+
+	peer.Comment = strings.Join(rest, " ")
+
+	return peer, err
+}
+
+// parseKnownPeers parses a whole known peers file.
+func parseKnownPeers(data []byte) (peers []*Peer, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	n := 0
+
+	for scanner.Scan() {
+		n++
+
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		peer, err := parseKnownPeer(line)
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+
+		peers = append(peers, peer)
+	}
+
+	return peers, scanner.Err()
+}
+
+// formatKnownPeers returns the contents of a known peers file for peers,
+// sorted by ID.
+func formatKnownPeers(peers map[string]*Peer) []byte {
+	var buf bytes.Buffer
+
+	ids := make([]string, 0, len(peers))
+
+	for id := range peers {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	buf.WriteString(knownPeersHeader)
+
+	for _, id := range ids {
+		buf.WriteString(formatKnownPeer(peers[id]))
+	}
+
+	return buf.Bytes()
+}
+
+// decodeLegacyKnownPeers reads the gob known peers files of older versions.
+func decodeLegacyKnownPeers(data []byte) (peers []*Peer, err error) {
+	var current map[string]*Peer
+
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&current)
+
+	if err == nil {
+		for _, peer := range current {
+			peers = append(peers, peer)
+		}
+		return peers, err
+	}
+
+	var legacy map[string]*legacyPeer
+
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&legacy)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for id, l := range legacy {
+		key, _, _, ok := parsePubKey(l.RawKey)
+
+		if !ok {
+			log.Printf("Dropping peer %s of old known peers file, cannot parse its key", id)
+			continue
+		}
+
+		peers = append(peers, &Peer{
+			ID: l.ID,
+			PubKey: key,
+			RawKey: l.RawKey,
+		})
+	}
+
+	return peers, err
+}
+
+func (n *Node) createKnownPeersFile() (err error) {
+	n.files.Lock()
+	defer n.files.Unlock()
+
+	tmpFileName := n.config.KnownPeersFile + ".tmp"
+
+	err = os.WriteFile(tmpFileName, formatKnownPeers(n.peers.knownPeers()), 0600)
+
+	if err != nil {
+		log.Printf("Error writing known peers file: %s", err)
+		return err
+	}
+
+	return os.Rename(tmpFileName, n.config.KnownPeersFile)
+}
+
+func (n *Node) decodeKnownPeersFile() (err error) {
+	data, err := os.ReadFile(n.config.KnownPeersFile)
+
+	if err != nil {
+		log.Printf("Error opening known peers file: %s", err)
+		return err
+	}
+
+	peers, err := parseKnownPeers(data)
+
+	if err != nil {
+		// Old versions stored a gob encoded map of peers; it is converted to
+		// text and the original is kept next to it.
+		legacy, gobErr := decodeLegacyKnownPeers(data)
+
+		if gobErr != nil {
+			log.Printf("Error decoding known peers file: %s", err)
+			return err
+		}
+
+		peers = legacy
+
+		defer n.migrateKnownPeersFile(data)
+	}
+
+	n.peers.addKnown(peers)
+
+	return nil
+}
+
+func (n *Node) migrateKnownPeersFile(old []byte) {
+	backup := n.config.KnownPeersFile + ".gob"
+
+	err := os.WriteFile(backup, old, 0600)
+
+	if err == nil {
+		err = n.createKnownPeersFile()
+	}
+
+	if err != nil {
+		log.Printf("Error migrating known peers file: %s", err)
+		return
+	}
+
+	log.Printf("Known peers file migrated to text format, the old one is kept in %s", backup)
+}
+
+func (n *Node) encodeKnownPeersFile() (err error) {
+	return n.createKnownPeersFile()
+}
+
+// ExportPeers returns the known peers in the format of the known peers file,
+// so they can be distributed to other nodes with ImportPeers.
+func (n *Node) ExportPeers() []byte {
+	return formatKnownPeers(n.peers.knownPeers())
+}
+
+// ImportPeers adds the peers of a known peers file to the known peers.
+// Peers already known with the same key get their addresses and comment
+// updated; a different key for a known ID is never replaced and is
+// reported in conflicts.
+func (n *Node) ImportPeers(data []byte) (added, updated int, conflicts []string, err error) {
+	peers, err := parseKnownPeers(data)
+
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	added, updated, refused := n.peers.importPeers(peers)
+
+	for _, known := range refused {
+		conflicts = append(conflicts, known.ID)
+		log.Printf("Not importing peer %s: its key differs from the known one (%s)",
+			known.ID, known.Fingerprint())
+	}
+
+	if added+updated > 0 {
+		err = n.encodeKnownPeersFile()
+	}
+
+	return added, updated, conflicts, err
+}
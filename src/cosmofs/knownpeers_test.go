@@ -0,0 +1,109 @@
+package cosmofs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"testing"
+)
+
+func TestKnownPeersFormat(t *testing.T) {
+	peer, _ := newTestPeer(t, "alice@example.com")
+	peer.Addrs = []string{"192.168.1.10:5453", "10.0.0.2:5453"}
+	peer.Comment = "laptop of alice"
+
+	data := formatKnownPeers(map[string]*Peer{peer.ID: peer})
+
+	t.Logf("%s", data)
+
+	peers, err := parseKnownPeers(data)
+
+	if err != nil || len(peers) != 1 {
+		t.Fatal("Failure in parseKnownPeers:", err)
+	}
+
+	p := peers[0]
+
+	if p.ID != peer.ID || !samePublicKey(p.PubKey, peer.PubKey) ||
+		len(p.Addrs) != 2 || p.Addrs[1] != "10.0.0.2:5453" || p.Comment != peer.Comment {
+		t.Errorf("Failure in parseKnownPeers. Got %+v", p)
+	}
+
+	_, err = parseKnownPeers([]byte("ssh-ed25519 AAAA\n"))
+
+	if err == nil {
+		t.Error("Failure in parseKnownPeers. Incomplete line should not pass.")
+	}
+}
+
+func TestKnownPeersMigration(t *testing.T) {
+	peer, _ := newTestPeer(t, "legacy@example.com")
+
+	n := newTestNode(t, "node@cosmofs.es")
+
+	// The original format: a gob encoded map of Peer structs
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(map[string]*legacyPeer{
+		peer.ID: {ID: peer.ID, RawKey: peer.RawKey},
+	})
+
+	if err != nil {
+		t.Fatal("Error encoding legacy file:", err)
+	}
+
+	err = os.WriteFile(n.config.KnownPeersFile, buf.Bytes(), 0600)
+
+	if err != nil {
+		t.Fatal("Error writing legacy file:", err)
+	}
+
+	err = n.decodeKnownPeersFile()
+
+	if err != nil {
+		t.Fatal("Failure in decodeKnownPeersFile:", err)
+	}
+
+	if _, ok := n.SearchPeer(peer.ID); !ok {
+		t.Error("Failure in decodeKnownPeersFile. Legacy peer not loaded.")
+	}
+
+	data, err := os.ReadFile(n.config.KnownPeersFile)
+
+	if err != nil || !bytes.Contains(data, []byte(formatKnownPeer(peer))) {
+		t.Errorf("Failure migrating known peers file: %s", data)
+	}
+
+	if _, err := os.Lstat(n.config.KnownPeersFile + ".gob"); err != nil {
+		t.Error("Failure migrating known peers file. No backup:", err)
+	}
+}
+
+func TestImportPeers(t *testing.T) {
+	peer, _ := newTestPeer(t, "import@example.com")
+	changed, _ := newTestPeer(t, "import@example.com")
+
+	n := newTestNode(t, "node@cosmofs.es")
+
+	added, _, _, err := n.ImportPeers([]byte(formatKnownPeer(peer)))
+
+	if err != nil || added != 1 {
+		t.Error("Failure in ImportPeers:", added, err)
+	}
+
+	peer.Comment = "updated"
+
+	_, updated, _, err := n.ImportPeers([]byte(formatKnownPeer(peer)))
+
+	known, _ := n.SearchPeer(peer.ID)
+
+	if err != nil || updated != 1 || known.Comment != "updated" {
+		t.Error("Failure in ImportPeers. Comment not updated:", updated, err)
+	}
+
+	_, _, conflicts, err := n.ImportPeers([]byte(formatKnownPeer(changed)))
+
+	if err != nil || len(conflicts) != 1 || n.CheckPeer(changed) == nil {
+		t.Error("Failure in ImportPeers. Changed key should not be imported:", conflicts, err)
+	}
+}
@@ -0,0 +1,199 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bufio"
+	"encoding/gob"
+	"io"
+	"log"
+	"net"
+	"strings"
+)
+
+// Legacy peers talk over plain TCP with a line naming the petition,
+// followed by gob encoded values. Only the petitions they know are served.
+const (
+	legacyHello string = "General TCP"
+	legacyHelloAnswer string = "General ANSWER"
+	legacyOpenFile string = "Open File"
+)
+
+// serveLegacy answers the petition of a legacy peer, named by line.
+func (n *Node) serveLegacy(conn *net.TCPConn, reader *bufio.Reader, line, remIP string) {
+	switch line {
+		case legacyHello:
+			n.debug("GENERAL TCP CONNECTION\n")
+
+			peer, decod, err := n.receiveLegacyPeer(conn, reader, remIP)
+
+			if err != nil {
+				return
+			}
+
+			addr := peerAddr(remIP, peer.Port)
+
+			connTCPS, err := n.dialPeer(addr)
+
+			if err != nil {
+				log.Printf("Error: %s\n", err)
+				return
+			}
+
+			defer connTCPS.Close()
+
+			err = n.sendLegacyPeer(connTCPS, legacyHelloAnswer)
+
+			if err != nil {
+				log.Printf("Error authenticating with %s: %s\n", remIP, err)
+				return
+			}
+
+			n.ConnectedPeer(peer.ID, addr)
+
+			log.Printf("CONNECTED: %v\n", n.ConnectedPeers())
+
+			n.receiveLegacyTable(peer.ID, decod, conn)
+
+		case legacyHelloAnswer:
+			n.debug("GENERAL ANSWER\n")
+
+			peer, decod, err := n.receiveLegacyPeer(conn, reader, remIP)
+
+			if err != nil {
+				return
+			}
+
+			n.ConnectedPeer(peer.ID, peerAddr(remIP, peer.Port))
+
+			log.Printf("CONNECTED: %v\n", n.ConnectedPeers())
+
+			n.receiveLegacyTable(peer.ID, decod, conn)
+
+		case legacyOpenFile:
+			n.debug("OPEN FILE CONNECTION\n")
+
+			if n.IsDeniedID(n.remotePeerID(conn, remIP)) {
+				log.Printf("Refusing to serve file to denied peer at %s\n", remIP)
+				return
+			}
+
+			file, err := reader.ReadString('\n')
+
+			if err != nil && err != io.EOF {
+				n.debug("Error reading connection: %s", err)
+				return
+			}
+
+			content, err := n.readSharedFile(strings.TrimRight(file, "\n"), remIP)
+
+			if err != nil {
+				log.Printf("Error reading file %s\n", err)
+				return
+			}
+
+			gob.NewEncoder(conn).Encode(content)
+
+		default:
+			n.debug("Unknown petition from legacy peer %s: %q\n", remIP, line)
+	}
+}
+
+// receiveLegacyPeer reads the peer presented by a legacy peer, which has to
+// prove it owns the key before anything it sends is trusted, and stores it.
+func (n *Node) receiveLegacyPeer(conn io.ReadWriter, reader *bufio.Reader, remIP string) (peer *Peer, decod *gob.Decoder, err error) {
+	encod := gob.NewEncoder(conn)
+	decod = gob.NewDecoder(reader)
+
+	peer, err = ReceivePeer(decod)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = n.VerifyPeer(conn, encod, decod, peer)
+
+	if err == nil {
+		err = n.StorePeer(peer)
+	}
+
+	if err != nil {
+		log.Printf("Rejecting peer %s from %s: %s\n", peer.ID, remIP, err)
+		return nil, nil, err
+	}
+
+	return peer, decod, err
+}
+
+// receiveLegacyTable merges the table that follows the peer id of a legacy
+// petition.
+func (n *Node) receiveLegacyTable(id string, decod *gob.Decoder, conn io.ReadWriter) {
+	var t IDTable
+
+	err := decod.Decode(&t)
+
+	if err != nil {
+		log.Printf("Error decoding table: %s", err)
+		return
+	}
+
+	n.mergeTable(id, t, conn)
+}
+
+// sendLegacyPeer sends the petition line, then our peer, its proof and our
+// table to a legacy peer.
+func (n *Node) sendLegacyPeer(conn io.ReadWriter, petition string) (err error) {
+	_, err = conn.Write([]byte(petition + "\n"))
+
+	if err != nil {
+		return err
+	}
+
+	encod := gob.NewEncoder(conn)
+	decod := gob.NewDecoder(conn)
+
+	err = n.SendPeer(encod)
+
+	if err == nil {
+		err = n.ProvePeer(conn, encod, decod)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// Send the number of shared directories
+	return encod.Encode(n.table.Snapshot())
+}
+
+// openLegacyFile asks a legacy peer for the content of the file at path.
+func openLegacyFile(conn io.ReadWriter, path string) (content []byte, err error) {
+	_, err = conn.Write([]byte(legacyOpenFile + "\n" + path + "\n"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = gob.NewDecoder(conn).Decode(&content)
+
+	return content, err
+}
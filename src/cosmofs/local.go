@@ -0,0 +1,462 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// openFileTimeout bounds the wait for a file of a peer, large ones too.
+const openFileTimeout = 10 * time.Minute
+
+func (n *Node) listDirectories(r *request) (resp interface{}, err error) {
+	n.debug("Table is now: %v\n", n.table.Snapshot())
+
+	dirs, err := n.table.ListAllDirs()
+
+	if err != nil {
+		log.Printf("Error reading dirs %s", err)
+	}
+
+	return ListResponse{Items: dirs}, nil
+}
+
+func (n *Node) listKnownIDs(r *request) (resp interface{}, err error) {
+	ids, err := n.table.ListIDs()
+
+	if err != nil {
+		log.Printf("Error reading ids %s", err)
+	}
+
+	return ListResponse{Items: ids}, nil
+}
+
+func (n *Node) listConnectedIDs(r *request) (resp interface{}, err error) {
+	return ConnectedResponse{Peers: n.ConnectedPeers()}, err
+}
+
+func (n *Node) listPeerStatus(r *request) (resp interface{}, err error) {
+	return StatusResponse{Peers: n.PeerStatus()}, err
+}
+
+func (n *Node) listDirectoriesID(r *request) (resp interface{}, err error) {
+	var req IDRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("List directories for id %s from %s\n", req.ID, r.remIP)
+
+	dirs, err := n.table.ListDirs(req.ID)
+
+	if err != nil {
+		log.Printf("Error reading dirs %s", err)
+		return nil, err
+	}
+
+	return ListResponse{Items: dirs}, nil
+}
+
+func (n *Node) listDirectory(r *request) (resp interface{}, err error) {
+	var req PathRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, dir, err := SplitPath(req.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("List directory %s for id %s from %s\n", dir, id, r.remIP)
+
+	dirs, err := n.table.ListDir(id, dir)
+
+	if err != nil {
+		log.Printf("Error reading dirs %s", err)
+		return nil, err
+	}
+
+	return ListResponse{Items: dirs}, nil
+}
+
+func (n *Node) search(r *request) (resp interface{}, err error) {
+	var req QueryRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Searching for %s from %s\n", req.Query, r.remIP)
+
+	result, err := n.table.Search(req.Query)
+
+	// Nothing found is no error, just an empty list.
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Error searching %s", err)
+		return nil, err
+	}
+
+	return ListResponse{Items: result}, nil
+}
+
+func (n *Node) searchDir(r *request) (resp interface{}, err error) {
+	var req QueryRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Searching Directories for %s from %s\n", req.Query, r.remIP)
+
+	result, err := n.table.SearchDir(req.Query)
+
+	// Nothing found is no error, just an empty list.
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Error searching directories %s", err)
+		return nil, err
+	}
+
+	return ListResponse{Items: result}, nil
+}
+
+func (n *Node) searchFile(r *request) (resp interface{}, err error) {
+	var req QueryRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Searching files for %s from %s\n", req.Query, r.remIP)
+
+	result, err := n.table.SearchFile(req.Query)
+
+	// Nothing found is no error, just an empty list.
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		log.Printf("Error searching files %s", err)
+		return nil, err
+	}
+
+	return ListResponse{Items: result}, nil
+}
+
+// openFile returns the content of a file of ours, or asks its owner for it.
+func (n *Node) openFile(r *request) (resp interface{}, err error) {
+	var req PathRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	id, _, err := SplitPath(req.Path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Local file
+	if strings.EqualFold(id, n.pub.ID) {
+		content, err := n.readSharedFile(req.Path, r.remIP)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return FileContent{Content: content}, err
+	}
+
+	if n.IsDeniedID(id) {
+		log.Printf("Refusing to open %s: peer %s is denied\n", req.Path, id)
+		return nil, ErrPeerDenied
+	}
+
+	//Remote file
+	// Owners we cannot reach are asked through the other peers.
+	c, legacy, err := n.dialOwner(id)
+
+	if err != nil {
+		log.Printf("Peer %v doesn't seem to be online: %s\n", id, err)
+		return nil, peerOffline(id, err)
+	}
+
+	var content FileContent
+
+	if legacy != nil {
+		defer legacy.Close()
+
+		if conn, ok := legacy.(net.Conn); ok {
+			conn.SetDeadline(time.Now().Add(openFileTimeout))
+		}
+
+		content.Content, err = openLegacyFile(legacy, req.Path)
+	} else {
+		defer c.release()
+
+		err = c.call(MsgOpenFile, PathRequest{Path: req.Path}, &content, openFileTimeout)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return content, err
+}
+
+// readSharedFile returns the content of the file of ours at path, asked for
+// by the peer or client at remIP.
+func (n *Node) readSharedFile(path, remIP string) (content []byte, err error) {
+	id, dirC, err := SplitPath(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := filepath.Base(dirC)
+
+	dir := strings.SplitN(dirC, "/", 2)
+
+	log.Printf("Opening File %s in dir %s from %s\n", fileName, dir[0], remIP)
+
+	if !strings.EqualFold(id, n.pub.ID) {
+		return nil, &Error{Kind: ErrNotFound, Path: path, Err: errors.New("not shared by this node")}
+	}
+
+	files := n.table.Files(n.pub.ID, dir[0])
+
+	for _, v := range files {
+		if strings.EqualFold(fileName, v.Filename) {
+			n.debug("Encoding %v\n", filepath.Join(v.LocalPath, v.Filename))
+
+			return ioutil.ReadFile(filepath.Join(v.LocalPath, v.Filename))
+		}
+	}
+
+	log.Printf("Cannot find file %v\n", dirC)
+
+	return nil, notFound(path)
+}
+
+func (n *Node) listFingerprints(r *request) (resp interface{}, err error) {
+	return FingerprintsResponse{Peers: n.ListFingerprints()}, err
+}
+
+func (n *Node) acceptKey(r *request) (resp interface{}, err error) {
+	var req IDRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Accept changed key of %s from %s\n", req.ID, r.remIP)
+
+	return nil, n.AcceptPeerKey(req.ID)
+}
+
+func (n *Node) exportPeers(r *request) (resp interface{}, err error) {
+	return DataMessage{Data: n.ExportPeers()}, err
+}
+
+func (n *Node) importPeers(r *request) (resp interface{}, err error) {
+	var req DataMessage
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	added, updated, conflicts, err := n.ImportPeers(req.Data)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error importing peers: %w", err)
+	}
+
+	result := fmt.Sprintf("%d peers added, %d updated", added, updated)
+
+	if len(conflicts) > 0 {
+		result += fmt.Sprintf(", %d refused because their key changed: %s",
+			len(conflicts), strings.Join(conflicts, " "))
+	}
+
+	log.Printf("Import peers from %s: %s\n", r.remIP, result)
+
+	return ResultResponse{Result: result}, err
+}
+
+func (n *Node) denyPeer(r *request) (resp interface{}, err error) {
+	var req EntryRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Deny %s from %s\n", req.Entry, r.remIP)
+
+	return nil, n.DenyPeer(req.Entry, "")
+}
+
+func (n *Node) allowPeer(r *request) (resp interface{}, err error) {
+	var req EntryRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Allow %s from %s\n", req.Entry, r.remIP)
+
+	return nil, n.AllowPeer(req.Entry)
+}
+
+func (n *Node) listDenied(r *request) (resp interface{}, err error) {
+	return ListResponse{Items: n.ListDenied()}, err
+}
+
+// revokeKey publishes the revocation of our own key to the connected peers.
+func (n *Node) revokeKey(r *request) (resp interface{}, err error) {
+	log.Printf("REVOKING OUR KEY on request from %s\n", r.remIP)
+
+	rev, err := n.NewRevocation()
+
+	if err != nil {
+		return nil, err
+	}
+
+	n.publishRevocation(rev)
+
+	result := fmt.Sprintf("Revocation of %s sent to %d peers", n.pub.Fingerprint(),
+		len(n.ConnectedPeers()))
+
+	return ResultResponse{Result: result}, err
+}
+
+// connectPeer connects to the peer at the address given by the client.
+func (n *Node) connectPeer(r *request) (resp interface{}, err error) {
+	var req AddrRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Connect to %s from %s\n", req.Addr, r.remIP)
+
+	id, err := n.Connect(req.Addr)
+
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to %s: %w", req.Addr, err)
+	}
+
+	if id == "" {
+		return ResultResponse{Result: fmt.Sprintf("Connected to legacy peer at %s", req.Addr)}, err
+	}
+
+	return ResultResponse{Result: fmt.Sprintf("Connected to %s at %s", id, req.Addr)}, err
+}
+
+// findPeer looks up the address of an ID in the DHT. IDs not found, or a
+// disabled DHT, are errors for the client.
+func (n *Node) findPeer(r *request) (resp interface{}, err error) {
+	var req IDRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Contact
+
+	addrs, err := n.FindPeer(req.ID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		result = append(result, Contact{ID: req.ID, Addr: addr})
+	}
+
+	return ContactsResponse{Contacts: result}, nil
+}
+
+// findFile looks up the peers sharing a file in the DHT, like findPeer.
+func (n *Node) findFile(r *request) (resp interface{}, err error) {
+	var req NameRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var result []Contact
+
+	providers, err := n.FindFile(req.Name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range providers {
+		result = append(result, Contact{ID: p.ID, Addr: p.Addr})
+	}
+
+	return ContactsResponse{Contacts: result}, nil
+}
+
+// handleLocalPetition serves the requests of a local client.
+func (n *Node) handleLocalPetition (conn *net.TCPConn) {
+	defer conn.Close()
+
+	n.debug("LOCAL PETITION")
+
+	n.serveFrames(conn, localHandlers, nil, conn.RemoteAddr().String())
+}
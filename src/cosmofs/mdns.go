@@ -0,0 +1,573 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Nodes are also advertised and browsed for with DNS-SD over multicast DNS,
+// which works on networks that filter broadcasts but let mDNS through.
+const (
+	MDNSService string = "_cosmofs._tcp.local."
+	MDNSGroup string = "224.0.0.251:5353"
+
+	mdnsDomain string = "local."
+	mdnsTTL uint32 = 120
+	mdnsMaxSize int = 9000
+)
+
+// DNS types and classes used by DNS-SD.
+const (
+	dnsTypeA uint16 = 1
+	dnsTypePTR uint16 = 12
+	dnsTypeTXT uint16 = 16
+	dnsTypeAAAA uint16 = 28
+	dnsTypeSRV uint16 = 33
+	dnsTypeANY uint16 = 255
+
+	dnsClassIN uint16 = 1
+	dnsCacheFlush uint16 = 1 << 15
+
+	// QR and AA, the flags of every mDNS response.
+	dnsFlagsResponse uint16 = 0x8400
+)
+
+var ErrBadDNSMessage = errors.New("cosmofs: malformed DNS message")
+
+type dnsQuestion struct {
+	Name string
+	Type uint16
+}
+
+// dnsRecord is a resource record of one of the types used by DNS-SD. Only
+// the fields of its type are used.
+type dnsRecord struct {
+	Name string
+	Type uint16
+	TTL uint32
+
+	Target string	// PTR and SRV
+	Port uint16		// SRV
+	Text []string	// TXT
+	IP net.IP		// A and AAAA
+}
+
+// dnsMessage is a DNS query or response. Answers, authority and additional
+// records are all kept in Records, mDNS does not tell them apart.
+type dnsMessage struct {
+	Response bool
+	Questions []dnsQuestion
+	Records []dnsRecord
+}
+
+// pack encodes m, without name compression.
+func (m *dnsMessage) pack() (data []byte, err error) {
+	data = make([]byte, 12, 512)
+
+	if m.Response {
+		binary.BigEndian.PutUint16(data[2:], dnsFlagsResponse)
+	}
+
+	binary.BigEndian.PutUint16(data[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(data[6:], uint16(len(m.Records)))
+
+	for _, q := range m.Questions {
+		data, err = appendName(data, q.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = binary.BigEndian.AppendUint16(data, q.Type)
+		data = binary.BigEndian.AppendUint16(data, dnsClassIN)
+	}
+
+	for _, r := range m.Records {
+		data, err = appendName(data, r.Name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// Shared records, the PTR of a service, must not flush the caches.
+		class := dnsClassIN
+
+		if r.Type != dnsTypePTR {
+			class |= dnsCacheFlush
+		}
+
+		data = binary.BigEndian.AppendUint16(data, r.Type)
+		data = binary.BigEndian.AppendUint16(data, class)
+		data = binary.BigEndian.AppendUint32(data, r.TTL)
+
+		start := len(data)
+		data = append(data, 0, 0)
+
+		switch r.Type {
+		case dnsTypePTR:
+			data, err = appendName(data, r.Target)
+		case dnsTypeSRV:
+			data = append(data, 0, 0, 0, 0)
+			data = binary.BigEndian.AppendUint16(data, r.Port)
+			data, err = appendName(data, r.Target)
+		case dnsTypeTXT:
+			for _, s := range r.Text {
+				if len(s) > 255 {
+					s = s[:255]
+				}
+
+				data = append(data, byte(len(s)))
+				data = append(data, s...)
+			}
+		case dnsTypeA:
+			data = append(data, r.IP.To4()...)
+		case dnsTypeAAAA:
+			data = append(data, r.IP.To16()...)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		binary.BigEndian.PutUint16(data[start:], uint16(len(data)-start-2))
+	}
+
+	return data, err
+}
+
+func appendName(data []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("cosmofs: invalid DNS name %q", name)
+			}
+
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+	}
+
+	return append(data, 0), nil
+}
+
+// unpackDNS decodes a DNS message. Records of other types are skipped.
+func unpackDNS(data []byte) (m *dnsMessage, err error) {
+	if len(data) < 12 {
+		return nil, ErrBadDNSMessage
+	}
+
+	m = &dnsMessage{
+		Response: data[2]&0x80 != 0,
+	}
+
+	questions := int(binary.BigEndian.Uint16(data[4:]))
+	records := int(binary.BigEndian.Uint16(data[6:])) +
+		int(binary.BigEndian.Uint16(data[8:])) +
+		int(binary.BigEndian.Uint16(data[10:]))
+
+	off := 12
+
+	for i := 0; i < questions; i++ {
+		var q dnsQuestion
+
+		q.Name, off, err = readName(data, off)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if off+4 > len(data) {
+			return nil, ErrBadDNSMessage
+		}
+
+		q.Type = binary.BigEndian.Uint16(data[off:])
+		off += 4
+
+		m.Questions = append(m.Questions, q)
+	}
+
+	for i := 0; i < records; i++ {
+		var r dnsRecord
+
+		r.Name, off, err = readName(data, off)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if off+10 > len(data) {
+			return nil, ErrBadDNSMessage
+		}
+
+		r.Type = binary.BigEndian.Uint16(data[off:])
+		r.TTL = binary.BigEndian.Uint32(data[off+4:])
+		length := int(binary.BigEndian.Uint16(data[off+8:]))
+		off += 10
+
+		if off+length > len(data) {
+			return nil, ErrBadDNSMessage
+		}
+
+		rdata := data[off:off+length]
+
+		switch r.Type {
+		case dnsTypePTR:
+			r.Target, _, err = readName(data, off)
+		case dnsTypeSRV:
+			if length < 7 {
+				return nil, ErrBadDNSMessage
+			}
+
+			r.Port = binary.BigEndian.Uint16(rdata[4:])
+			r.Target, _, err = readName(data, off+6)
+		case dnsTypeTXT:
+			for len(rdata) > 0 {
+				size := int(rdata[0])
+
+				if 1+size > len(rdata) {
+					return nil, ErrBadDNSMessage
+				}
+
+				r.Text = append(r.Text, string(rdata[1:1+size]))
+				rdata = rdata[1+size:]
+			}
+		case dnsTypeA, dnsTypeAAAA:
+			if length != net.IPv4len && length != net.IPv6len {
+				return nil, ErrBadDNSMessage
+			}
+
+			r.IP = net.IP(append([]byte(nil), rdata...))
+		default:
+			off += length
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		off += length
+
+		m.Records = append(m.Records, r)
+	}
+
+	return m, err
+}
+
+// readName decodes the name at off, following compression pointers, and
+// returns it with the offset right after it.
+func readName(data []byte, off int) (name string, next int, err error) {
+	var labels []string
+
+	next = -1
+
+	for jumps := 0; ; {
+		if off >= len(data) {
+			return "", 0, ErrBadDNSMessage
+		}
+
+		size := int(data[off])
+
+		switch {
+		case size == 0:
+			if next < 0 {
+				next = off + 1
+			}
+
+			return strings.Join(labels, ".") + ".", next, err
+		case size&0xc0 == 0xc0:
+			if off+2 > len(data) || jumps > 10 {
+				return "", 0, ErrBadDNSMessage
+			}
+
+			if next < 0 {
+				next = off + 2
+			}
+
+			off = int(binary.BigEndian.Uint16(data[off:]) & 0x3fff)
+			jumps++
+		case size > 63 || off+1+size > len(data):
+			return "", 0, ErrBadDNSMessage
+		default:
+			labels = append(labels, string(data[off+1:off+1+size]))
+			off += 1 + size
+		}
+	}
+}
+
+// mdnsInstance returns the name of the service instance of the node and the
+// name of its host. IDs are not valid labels, so a hash of it is used; the
+// ID itself goes in the TXT record.
+func (n *Node) mdnsInstance() (instance, host string) {
+	sum := sha256.Sum256([]byte(n.pub.ID))
+	label := fmt.Sprintf("cosmofs-%x", sum[:6])
+
+	return label + "." + MDNSService, label + "." + mdnsDomain
+}
+
+// mdnsRecords returns the records that advertise the node: the PTR of the
+// service, the SRV and TXT of the instance and the addresses of the host.
+func (n *Node) mdnsRecords() []dnsRecord {
+	instance, host := n.mdnsInstance()
+
+	records := []dnsRecord{
+		{Name: MDNSService, Type: dnsTypePTR, TTL: mdnsTTL, Target: instance},
+		{Name: instance, Type: dnsTypeSRV, TTL: mdnsTTL, Target: host, Port: uint16(n.port)},
+		{Name: instance, Type: dnsTypeTXT, TTL: mdnsTTL, Text: []string{
+			"id=" + n.pub.ID,
+			"fp=" + n.pub.Fingerprint(),
+			"proto=" + strconv.Itoa(n.protocol),
+			"table=" + strconv.FormatUint(n.table.Version(), 10),
+		}},
+	}
+
+	for _, ip := range n.mdnsAddrs() {
+		if ip.To4() != nil {
+			records = append(records, dnsRecord{Name: host, Type: dnsTypeA, TTL: mdnsTTL, IP: ip})
+		} else {
+			records = append(records, dnsRecord{Name: host, Type: dnsTypeAAAA, TTL: mdnsTTL, IP: ip})
+		}
+	}
+
+	return records
+}
+
+// mdnsAddrs returns the addresses the node can be reached at: the bind
+// address, or those of every interface but link-local ones, which cannot be
+// dialed without a zone.
+func (n *Node) mdnsAddrs() (ips []net.IP) {
+	if n.bind != nil && !n.bind.IsUnspecified() {
+		return []net.IP{n.bind}
+	}
+
+	addrs, err := net.InterfaceAddrs()
+
+	if err != nil {
+		return nil
+	}
+
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ips = append(ips, ipnet.IP)
+	}
+
+	return ips
+}
+
+// listenMDNS joins the mDNS group. Other responders on the host, such as
+// Avahi, share the port.
+func (n *Node) listenMDNS() (err error) {
+	group, err := net.ResolveUDPAddr("udp4", MDNSGroup)
+
+	if err != nil {
+		return err
+	}
+
+	n.lnMDNS, err = net.ListenMulticastUDP("udp4", nil, group)
+
+	return err
+}
+
+// serveMDNS answers the queries for the service and hands the nodes found
+// in the responses to handleBeacon, until the node is closed.
+func (n *Node) serveMDNS() {
+	defer n.wg.Done()
+
+	data := make([]byte, mdnsMaxSize)
+
+	for {
+		size, remoteIP, err := n.lnMDNS.ReadFromUDP(data)
+
+		if err != nil {
+			if n.closed() {
+				return
+			}
+
+			n.debug("Error reading mDNS message: %s\n", err)
+			continue
+		}
+
+		n.handleMDNS(data[:size], remoteIP)
+	}
+}
+
+// handleMDNS answers a query about the node, or discovers the nodes
+// advertised in a response.
+func (n *Node) handleMDNS(data []byte, remoteIP *net.UDPAddr) {
+	m, err := unpackDNS(data)
+
+	if err != nil {
+		n.debug("Ignoring mDNS message from %s: %s\n", remoteIP, err)
+		return
+	}
+
+	if !m.Response {
+		if n.mdnsQueried(m) {
+			n.sendMDNS(&dnsMessage{Response: true, Records: n.mdnsRecords()})
+		}
+
+		return
+	}
+
+	for _, b := range mdnsBeacons(m, remoteIP) {
+		n.handleBeacon(b.Beacon, b.addr)
+	}
+}
+
+// mdnsQueried tells whether a query asks for the service or the instance of
+// the node.
+func (n *Node) mdnsQueried(m *dnsMessage) bool {
+	instance, host := n.mdnsInstance()
+
+	for _, q := range m.Questions {
+		switch {
+		case strings.EqualFold(q.Name, MDNSService) && (q.Type == dnsTypePTR || q.Type == dnsTypeANY):
+			return true
+		case strings.EqualFold(q.Name, instance), strings.EqualFold(q.Name, host):
+			return true
+		}
+	}
+
+	return false
+}
+
+type mdnsBeacon struct {
+	*Beacon
+	addr *net.UDPAddr
+}
+
+// mdnsBeacons returns the nodes advertised in a response, as unsigned
+// beacons. Their address is the IPv4 one of their host, if any, or the one
+// the response came from.
+func mdnsBeacons(m *dnsMessage, remoteIP *net.UDPAddr) (beacons []mdnsBeacon) {
+	var instances []string
+
+	srv := make(map[string]dnsRecord)
+	txt := make(map[string][]string)
+	ips := make(map[string]net.IP)
+
+	for _, r := range m.Records {
+		name := strings.ToLower(r.Name)
+
+		switch r.Type {
+		case dnsTypePTR:
+			if strings.EqualFold(r.Name, MDNSService) {
+				instances = append(instances, strings.ToLower(r.Target))
+			}
+		case dnsTypeSRV:
+			srv[name] = r
+		case dnsTypeTXT:
+			txt[name] = r.Text
+		case dnsTypeA:
+			ips[name] = r.IP
+		}
+	}
+
+	for _, instance := range instances {
+		s, ok := srv[instance]
+
+		if !ok {
+			continue
+		}
+
+		b := &Beacon{
+			Version: BeaconVersion,
+			Port: int(s.Port),
+			Capabilities: CapSession,
+			unsigned: true,
+		}
+
+		for _, kv := range txt[instance] {
+			key, value, _ := strings.Cut(kv, "=")
+
+			switch key {
+			case "id":
+				b.ID = value
+			case "fp":
+				b.Fingerprint = value
+			case "proto":
+				b.Protocol, _ = strconv.Atoi(value)
+			case "table":
+				b.TableVersion, _ = strconv.ParseUint(value, 10, 64)
+			}
+		}
+
+		if b.Port <= 0 || checkID(b.ID) != nil || b.Fingerprint == "" {
+			continue
+		}
+
+		addr := remoteIP
+
+		if ip, ok := ips[strings.ToLower(s.Target)]; ok {
+			addr = &net.UDPAddr{IP: ip}
+		}
+
+		beacons = append(beacons, mdnsBeacon{b, addr})
+	}
+
+	return beacons
+}
+
+// sendMDNS multicasts m to the mDNS group.
+func (n *Node) sendMDNS(m *dnsMessage) {
+	data, err := m.pack()
+
+	if err != nil {
+		log.Printf("Error encoding mDNS message: %s\n", err)
+		return
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", MDNSGroup)
+
+	if err != nil {
+		log.Printf("Error resolving %s: %s\n", MDNSGroup, err)
+		return
+	}
+
+	_, err = n.lnMDNS.WriteToUDP(data, group)
+
+	if err != nil {
+		n.debug("Error sending mDNS message: %s\n", err)
+	}
+}
+
+// browseMDNS advertises the node and asks for the other nodes of the
+// service.
+func (n *Node) browseMDNS() {
+	n.sendMDNS(&dnsMessage{Response: true, Records: n.mdnsRecords()})
+	n.sendMDNS(&dnsMessage{Questions: []dnsQuestion{{Name: MDNSService, Type: dnsTypePTR}}})
+}
@@ -0,0 +1,121 @@
+package cosmofs
+
+import (
+	"net"
+	"testing"
+)
+
+func TestDNSMessage(t *testing.T) {
+	m := &dnsMessage{
+		Response: true,
+		Questions: []dnsQuestion{{Name: MDNSService, Type: dnsTypePTR}},
+		Records: []dnsRecord{
+			{Name: MDNSService, Type: dnsTypePTR, TTL: mdnsTTL, Target: "node." + MDNSService},
+			{Name: "node." + MDNSService, Type: dnsTypeSRV, TTL: mdnsTTL, Target: "node.local.", Port: 5453},
+			{Name: "node." + MDNSService, Type: dnsTypeTXT, TTL: mdnsTTL, Text: []string{"id=alice@cosmofs.es", "proto=1"}},
+			{Name: "node.local.", Type: dnsTypeA, TTL: mdnsTTL, IP: net.ParseIP("192.168.1.2")},
+		},
+	}
+
+	data, err := m.pack()
+
+	if err != nil {
+		t.Fatal("Failure in pack:", err)
+	}
+
+	got, err := unpackDNS(data)
+
+	if err != nil {
+		t.Fatal("Failure in unpackDNS:", err)
+	}
+
+	if !got.Response || len(got.Questions) != 1 || len(got.Records) != len(m.Records) {
+		t.Fatalf("Failure in unpackDNS. Got: %+v", got)
+	}
+
+	if got.Records[1].Port != 5453 || got.Records[1].Target != "node.local." {
+		t.Error("Failure in unpackDNS. Wrong SRV record:", got.Records[1])
+	}
+
+	if len(got.Records[2].Text) != 2 || got.Records[2].Text[0] != "id=alice@cosmofs.es" {
+		t.Error("Failure in unpackDNS. Wrong TXT record:", got.Records[2].Text)
+	}
+
+	if !got.Records[3].IP.Equal(net.ParseIP("192.168.1.2")) {
+		t.Error("Failure in unpackDNS. Wrong A record:", got.Records[3].IP)
+	}
+
+	// Names compressed by other responders, pointing to the question
+	compressed := append(data[:len(data):len(data)], 0xc0, 12)
+
+	name, next, err := readName(compressed, len(data))
+
+	if err != nil || name != MDNSService || next != len(compressed) {
+		t.Error("Failure in readName. Got:", name, next, err)
+	}
+
+	// A pointer to itself
+	_, _, err = readName([]byte{0xc0, 0}, 0)
+
+	if err == nil {
+		t.Error("Failure in readName. Accepted a pointer loop.")
+	}
+
+	for i := 0; i < len(data); i++ {
+		unpackDNS(data[:i])
+	}
+}
+
+func TestMDNSDiscovery(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	query := &dnsMessage{Questions: []dnsQuestion{{Name: MDNSService, Type: dnsTypePTR}}}
+
+	if !b.mdnsQueried(query) {
+		t.Error("Failure in mdnsQueried. The service was not answered.")
+	}
+
+	// The response of b, as seen by a, without its addresses so it is
+	// dialed on the one it came from.
+	response := &dnsMessage{Response: true}
+
+	for _, r := range b.mdnsRecords() {
+		if r.Type != dnsTypeA && r.Type != dnsTypeAAAA {
+			response.Records = append(response.Records, r)
+		}
+	}
+
+	data, err := response.pack()
+
+	if err != nil {
+		t.Fatal("Failure in pack:", err)
+	}
+
+	a.handleMDNS(data, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353})
+
+	if !waitFor(func() bool { _, ok := b.ConnectedPeers()[a.ID()]; return ok }) {
+		t.Error("Failure in handleMDNS. The advertised node was not introduced to.")
+	}
+
+	// Its own response is ignored
+	beacons := mdnsBeacons(&dnsMessage{Response: true, Records: a.mdnsRecords()}, &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+
+	if len(beacons) != 1 || beacons[0].ID != a.ID() || beacons[0].Fingerprint != a.pub.Fingerprint() {
+		t.Fatal("Failure in mdnsBeacons. Got:", beacons)
+	}
+
+	if !a.ownAnnouncement(beacons[0].ID, beacons[0].Port, beacons[0].addr.IP) {
+		t.Error("Failure in mdnsBeacons. Its own advertisement was not recognized.")
+	}
+}
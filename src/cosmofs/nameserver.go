@@ -23,6 +23,8 @@ package cosmofs
 
 import (
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
@@ -34,60 +36,33 @@ type FileList []*File
 type DirTable map[string]FileList
 type IDTable map[string]DirTable
 
-var (
-	Table IDTable = make(IDTable)
-	myID string
-)
-
-// TODO: Multiple different kinds of errors
-type NameServerError struct {
-	e error
-}
-
-func (e *NameServerError) Error() string {
-	return "Error in the NameServer"
-}
-
-func init() {
-	// Check if COSMOFSIN environment is set
-	if *Cosmofsin == "" {
-		log.Fatalf("COSMOFSIN not set correctly. Current content <%s>", *Cosmofsin)
+// loadShares fills the table of the node with the shared directories,
+// reading their config files or generating them.
+func (n *Node) loadShares() (err error) {
+	// Check if COSMOFSIN is set
+	if n.config.Inbox == "" {
+		return fmt.Errorf("COSMOFSIN not set correctly. Current content <%s>", n.config.Inbox)
 	}
 
 	// Check if COSMOFSIN is a correct directory
-	if _, err := os.Lstat(*Cosmofsin); err != nil {
-		log.Fatalf("COSMOFSIN not set correctly. Current content <%s>", *Cosmofsin)
+	if _, err := os.Lstat(n.config.Inbox); err != nil {
+		return fmt.Errorf("COSMOFSIN not set correctly. Current content <%s>", n.config.Inbox)
 	}
 
-	sharedDirList := filepath.SplitList(*Cosmofsout)
-
 	// There shall be at least one shared directory
-	if len(sharedDirList) == 0 {
-		log.Fatal("COSMOFSOUT should have at least one directory or file.")
+	if len(n.config.Share) == 0 {
+		return errors.New("COSMOFSOUT should have at least one directory or file.")
 	}
 
-	// TODO: Fix this
-	// HACK to get here myID correctly
-	buffer := parseKeyFile(*pubkeyFileName)
-
-	_, _, id, ok := parsePubKey(buffer)
-
-	if !ok {
-		log.Fatal("Cannot parse Public Key File")
-	}
-
-	myID = string(id)
-
 	// Create a new user in the table
-	// TODO: Decode and create correct ID
-	err := Table.AddID(myID)
+	err = n.table.AddID(n.pub.ID)
 
 	if err != nil {
-		log.Fatal("Could not create new ID")
+		return errors.New("Could not create new ID " + n.pub.ID)
 	}
 
 	// Shared directories are initialized
-	for _, dir := range sharedDirList {
+	for _, dir := range n.config.Share {
 		dir = filepath.Clean(dir)
 
 		// Check wether we can read the current directory
@@ -102,13 +77,13 @@ func init() {
 		if fi.IsDir() {
 			configFileName := filepath.Join(dir, COSMOFSCONFIGFILE)
 
-			if *resetConfig {
+			if n.config.ResetConfig {
 				_, err := os.Lstat(configFileName)
 
 				if err == nil {
 					err := os.Remove(configFileName)
 					if err != nil {
-						log.Fatal("Error re-generating config files.")
+						return errors.New("Error re-generating config files.")
 					}
 				}
 			}
@@ -116,7 +91,7 @@ func init() {
 			_, err := os.Lstat(configFileName)
 
 			if err != nil {
-				err := createConfigFile(dir, configFileName)
+				err := n.createConfigFile(dir, configFileName)
 
 				if err != nil {
 					log.Printf("Error creating config file: %s", err)
@@ -125,13 +100,32 @@ func init() {
 			}
 
 			// Decode the config file and update data structures.
-			err = decodeConfigFile(configFileName)
+			err = n.decodeConfigFile(configFileName)
+
+			// Config files written by older versions may not decode, they
+			// are just a cache of the directory so they are re-generated.
+			if err != nil {
+				log.Printf("Re-generating config file %s", configFileName)
+
+				err = os.Remove(configFileName)
+
+				if err == nil {
+					err = n.createConfigFile(dir, configFileName)
+				}
+
+				if err == nil {
+					err = n.decodeConfigFile(configFileName)
+				}
+			}
+
 			if err != nil {
 				log.Printf("Error decoding config file: %s", err)
 				continue
 			}
 		}
 	}
+
+	return nil
 }
 
 func (t IDTable) AddID (id string) (err error) {
@@ -193,7 +187,6 @@ func (t IDTable) AddDir (id, dir, baseDir string, recursive bool) (err error) {
 				Filename: ent.Name(),
 				Size: ent.Size(),
 				IsDir: ent.IsDir(),
-				Owner: MyPublicPeer,
 				KeepCopy: true,
 				Online: false,
 				NumChunks: 1,
@@ -210,7 +203,7 @@ func (t IDTable) AddDir (id, dir, baseDir string, recursive bool) (err error) {
 
 		return err
 	}
-	return &NameServerError{}
+	return &Error{Kind: ErrInvalidPath, Path: dir, Err: errors.New("not a directory")}
 }
 
 func (t IDTable) ListIDs() (ids []string, err error) {
@@ -220,7 +213,7 @@ func (t IDTable) ListIDs() (ids []string, err error) {
 		}
 		return ids, err
 	}
-	return nil, &NameServerError{}
+	return nil, notFound("")
 }
 
 func (t IDTable) ListAllDirs() (dirs []string, err error) {
@@ -239,37 +232,39 @@ func (t IDTable) ListDirs(id string) (dirs []string, err error) {
 		}
 		return dirs, err
 	}
-	return nil, &NameServerError{}
+	return nil, notFound(id)
 }
 
 func (t IDTable) ListDir (id, dir string) (content []string, err error) {
-	if _, ok := t[id]; ok {
-		if _, ok := t[id][dir]; ok {
-			for _, file := range t[id][dir] {
-				content = append(content, filepath.Join(id, dir, file.Filename))
-			}
-			return content, err
-		}
+	err = t.ExistsDir(id, dir)
+
+	if err != nil {
+		return content, err
+	}
+
+	for _, file := range t[id][dir] {
+		content = append(content, filepath.Join(id, dir, file.Filename))
 	}
-	return content, &NameServerError{}
+
+	return content, err
 }
 
 func (t IDTable) ExistsID (id string) (i string, err error) {
 	if _, ok := t[id]; ok {
 		return id, err
 	}
-	return "", &NameServerError{}
+	return "", notFound(id)
 }
 
 func (t IDTable) ExistsDir (id, dir string) (err error) {
 	_, err = t.ExistsID(id)
 
 	if err != nil {
-		return &NameServerError{}
+		return err
 	}
 
 	if _, ok := t[id][dir]; !ok {
-		return &NameServerError{}
+		return notFound(filepath.Join(id, dir))
 	}
 
 	return err
@@ -290,7 +285,7 @@ func (t IDTable) SearchDir (dir string) (result []string, err error) {
 			return result, err
 		}
 	}
-	return result, &NameServerError{}
+	return result, notFound(dir)
 }
 
 func (t IDTable) SearchFile (name string) (result []string, err error) {
@@ -310,27 +305,33 @@ func (t IDTable) SearchFile (name string) (result []string, err error) {
 			return result, err
 		}
 	}
-	return result, &NameServerError{}
+	return result, notFound(name)
 }
 
+// Search returns the directories and files matching s, which may be only
+// of one of them.
 func (t IDTable) Search (s string) (result []string, err error) {
 	res1, err := t.SearchDir(s)
 
-	if err != nil {
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return result, err
 	}
 
 	res2, err := t.SearchFile(s)
 
-	if err != nil {
+	if err != nil && !errors.Is(err, ErrNotFound) {
 		return result, err
 	}
 
+	if len(res1) + len(res2) == 0 {
+		return result, notFound(s)
+	}
+
 	result = make([]string, len(res1) + len(res2))
 	copy(result, res1)
 	copy(result[len(res1):], res2)
 
-	return result, err
+	return result, nil
 }
 
 func (t IDTable) DeleteID (id string) {
@@ -346,29 +347,45 @@ func (t IDTable) DeleteDir (id, dir string) {
 	}
 }
 
-func (t IDTable) ReceiveAndMergeTable (decod *gob.Decoder) {
-	var recvTable IDTable = make(IDTable)
-
-	err := decod.Decode(&recvTable)
-
-	if err != nil {
-		log.Fatal("Error decoding table: ", err)
+// setOwner marks owner as the owner of every file of id.
+func (t IDTable) setOwner (id string, owner *Peer) {
+	for _, files := range t[id] {
+		for _, file := range files {
+			file.Owner = owner
+		}
 	}
+}
 
-	log.Printf("LOCAL TABLE: %v\n", Table)
-	log.Printf("REMOTE TABLE: %v\n", recvTable)
-
+// Merge adds the directories of recvTable that are not in t yet. Where
+// the files are on the disk of their owner is not taken: only the files
+// of the node have a LocalPath.
+func (t IDTable) Merge (recvTable IDTable) (added int) {
 	for k, v := range recvTable {
 		for d, files := range v {
 			if _, ok := t[k][d]; !ok {
 				t.AddID(k)
-				t[k][d] = files
+				t[k][d] = withoutLocalPath(files)
+				added++
 				log.Printf("Added dir %v from %v\n", d, k)
 			}
 		}
 	}
 
-	encodeConfigFiles()
+	return added
+}
+
+func withoutLocalPath(files FileList) (result FileList) {
+	for _, f := range files {
+		if f != nil {
+			stripped := *f
+			stripped.LocalPath = ""
+			f = &stripped
+		}
+
+		result = append(result, f)
+	}
+
+	return result
 }
 
 func checkID (id string) (err error) {
@@ -382,24 +399,24 @@ func checkID (id string) (err error) {
 		return err
 	}
 
-	return &NameServerError{}
+	return &Error{Kind: ErrInvalidID, Path: id}
 }
 
 func SplitPath (path string) (id, dir string, err error) {
 	res := strings.SplitN(path, "/", 2)
 
 	if len(res) != 2 {
-		return id, dir, &NameServerError{}
+		return id, dir, &Error{Kind: ErrInvalidPath, Path: path}
 	}
 
 	if err := checkID(res[0]); err != nil {
-		return id, dir, &NameServerError{}
+		return id, dir, err
 	}
 
 	return res[0], filepath.Clean(res[1]), err
 }
 
-func createConfigFile(dir, configFileName string) (err error) {
+func (n *Node) createConfigFile(dir, configFileName string) (err error) {
 	// Create the config file.
 	configFile, err := os.Create(configFileName)
 
@@ -407,26 +424,30 @@ func createConfigFile(dir, configFileName string) (err error) {
 		return err
 	}
 
+	defer configFile.Close()
+
 	// Add directory and subdirectories
 	// TODO: Should it be recursive?
-	err = Table.AddDir(myID, dir, filepath.Base(dir), true)
+	err = n.table.AddDir(n.pub.ID, dir, filepath.Base(dir), true)
 
 	if err != nil {
 		log.Printf("Error adding new directory: %s", err)
 		return err
 	}
 
+	n.table.setOwner(n.pub.ID, n.pub)
+
 	configEnc := gob.NewEncoder(configFile)
 
-	err = configEnc.Encode(Table)
+	err = configEnc.Encode(n.table.Snapshot())
 	if err != nil {
-		log.Fatal("Error encoding table in config file: ", err)
+		log.Printf("Error encoding table in config file: %s", err)
 	}
 
 	return err
 }
 
-func decodeConfigFile(configFileName string) (err error){
+func (n *Node) decodeConfigFile(configFileName string) (err error){
 	configFile, err := os.Open(configFileName)
 
 	if err != nil {
@@ -434,22 +455,30 @@ func decodeConfigFile(configFileName string) (err error){
 		return err
 	}
 
+	defer configFile.Close()
+
 	configDec := gob.NewDecoder(configFile)
 
-	err = configDec.Decode(&Table)
+	var table IDTable
+
+	err = configDec.Decode(&table)
 
 	if err != nil {
-		log.Fatal("Error decoding list of files config file: ", err)
+		log.Printf("Error decoding list of files config file: %s", err)
+		return err
 	}
 
+	n.table.update(table)
+
 	return err
 }
 
-func encodeConfigFiles() (err error){
-	sharedDirList := filepath.SplitList(*Cosmofsout)
+func (n *Node) encodeConfigFiles() (err error){
+	n.files.Lock()
+	defer n.files.Unlock()
 
 	// Shared directories are initialized
-	for _, dir := range sharedDirList {
+	for _, dir := range n.config.Share {
 		dir = filepath.Clean(dir)
 
 		// Check wether we can read the current directory
@@ -469,11 +498,12 @@ func encodeConfigFiles() (err error){
 			if err == nil {
 				err := os.Remove(configFileName)
 				if err != nil {
-					log.Fatal("Error re-generating config files.")
+					log.Printf("Error re-generating config files: %s", err)
+					continue
 				}
 			}
 
-			err = createConfigFile(dir, configFileName)
+			err = n.createConfigFile(dir, configFileName)
 
 			if err != nil {
 				log.Printf("Error creating config file: %s", err)
@@ -481,7 +511,7 @@ func encodeConfigFiles() (err error){
 			}
 
 			// Decode the config file and update data structures.
-			err = decodeConfigFile(configFileName)
+			err = n.decodeConfigFile(configFileName)
 			if err != nil {
 				log.Printf("Error decoding config file: %s", err)
 				continue
@@ -492,8 +522,8 @@ func encodeConfigFiles() (err error){
 	return err
 }
 
-func PrintTable() {
-	for k, v := range Table {
+func (n *Node) PrintTable() {
+	for k, v := range n.table.Snapshot() {
 		log.Printf("- %v\n", k)
 		for kk, vv := range v {
 			log.Printf("-- %v\n", kk)
@@ -1,13 +1,41 @@
 package cosmofs
 
 import (
+	"errors"
+	"os"
 	"path/filepath"
 	"testing"
 )
 
-var dir = "/Users/"
+// newTestTable returns a table where roberto@costumero.es shares out1.
+func newTestTable(t *testing.T) IDTable {
+	out1 := filepath.Join(t.TempDir(), "out1")
+
+	err := os.Mkdir(out1, 0700)
+
+	if err == nil {
+		err = os.WriteFile(filepath.Join(out1, "output.txt"), []byte("out1"), 0600)
+	}
+
+	if err != nil {
+		t.Fatal("Error creating shared directory:", err)
+	}
+
+	table := make(IDTable)
+
+	err = table.AddDir("roberto@costumero.es", out1, "out1", true)
+
+	if err != nil {
+		t.Fatal("Error adding shared directory:", err)
+	}
+
+	return table
+}
 
 func TestTable(t *testing.T) {
+	Table := newTestTable(t)
+	dir := t.TempDir()
+
 	err := Table.AddID("prueba@prueba.es")
 
 	if err != nil {
@@ -166,3 +194,46 @@ func TestTable(t *testing.T) {
 		t.Error("Failure in DeleteID.")
 	}
 }
+
+func TestTableErrors(t *testing.T) {
+	table := newTestTable(t)
+
+	tests := []struct {
+		name string
+		err error
+		kind error
+		path string
+	}{
+		{"ListDirs", second(table.ListDirs("nobody@cosmofs.es")), ErrNotFound, "nobody@cosmofs.es"},
+		{"ListDir", second(table.ListDir("nobody@cosmofs.es", "out1")), ErrNotFound, "nobody@cosmofs.es"},
+		{"ListDir", second(table.ListDir("roberto@costumero.es", "empty")), ErrNotFound, "roberto@costumero.es/empty"},
+		{"ExistsDir", table.ExistsDir("roberto@costumero.es", "empty"), ErrNotFound, "roberto@costumero.es/empty"},
+		{"Search", second(table.Search("empty")), ErrNotFound, "empty"},
+		{"AddID", table.AddID("nanana"), ErrInvalidID, "nanana"},
+		{"SplitPath", third(SplitPath("/Users/media/var")), ErrInvalidID, ""},
+		{"SplitPath", third(SplitPath("roberto@costumero.es")), ErrInvalidPath, "roberto@costumero.es"},
+	}
+
+	for _, test := range tests {
+		var e *Error
+
+		if !errors.Is(test.err, test.kind) || !errors.As(test.err, &e) || e.Path != test.path {
+			t.Errorf("Failure in %s. Got %v", test.name, test.err)
+		}
+	}
+
+	// Matches of only directories or only files are found.
+	result, err := table.Search("output")
+
+	if err != nil || len(result) != 1 {
+		t.Errorf("Failure in Search. Got %v: %v", result, err)
+	}
+}
+
+func second(_ interface{}, err error) error {
+	return err
+}
+
+func third(_, _ interface{}, err error) error {
+	return err
+}
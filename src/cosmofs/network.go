@@ -0,0 +1,166 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	networkContext string = "cosmofs-network-v1"
+
+	// maxNetworks bounds the networks of a node and the membership proofs
+	// accepted from a peer.
+	maxNetworks int = 16
+)
+
+var ErrNoSharedNetwork = newError(ErrPermissionDenied, "cosmofs: the peer is not in any of our networks")
+
+// Network is a private swarm. Nodes only talk to the nodes of the networks
+// they share, proving they know the secret without revealing it, nor the
+// name. Nodes without networks only talk to each other.
+type Network struct {
+	Name string
+	Secret string
+}
+
+// networkKey is the key of a network, derived from its name and secret.
+type networkKey struct {
+	name string
+	key []byte
+}
+
+// ParseNetworks parses a list of name:secret separated by commas or spaces.
+func ParseNetworks(list string) (networks []Network, err error) {
+	for i, entry := range SplitPeerList(list) {
+		name, secret, ok := strings.Cut(entry, ":")
+
+		// The entry is not shown, it may be a secret
+		if !ok || name == "" || secret == "" {
+			return nil, fmt.Errorf("cosmofs: invalid network number %d, it has to be name:secret", i+1)
+		}
+
+		networks = append(networks, Network{Name: name, Secret: secret})
+	}
+
+	return networks, err
+}
+
+// networkKeys derives the keys of networks.
+func networkKeys(networks []Network) (keys []networkKey, err error) {
+	if len(networks) > maxNetworks {
+		return nil, fmt.Errorf("cosmofs: too many networks, at most %d", maxNetworks)
+	}
+
+	for _, network := range networks {
+		if network.Name == "" || network.Secret == "" {
+			return nil, errors.New("cosmofs: networks need a name and a secret")
+		}
+
+		key, err := hkdf.Key(sha256.New, []byte(network.Secret), nil, networkContext+" "+network.Name, sha256.Size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, networkKey{name: network.Name, key: key})
+	}
+
+	return keys, err
+}
+
+func (k networkKey) tag(digest []byte) []byte {
+	mac := hmac.New(sha256.New, k.key)
+
+	mac.Write(digest)
+
+	return mac.Sum(nil)
+}
+
+// membershipTags proves that the node is in each of its networks, bound to
+// digest.
+func (n *Node) membershipTags(digest []byte) (tags [][]byte) {
+	for _, k := range n.networks {
+		tags = append(tags, k.tag(digest))
+	}
+
+	return tags
+}
+
+// sharedNetworks returns the names of our networks proved by tags for
+// digest. ok tells whether we can talk to the peer that sent them: it shares
+// one of our networks, or neither of us is in any.
+func (n *Node) sharedNetworks(tags [][]byte, digest []byte) (names []string, ok bool) {
+	if len(tags) > maxNetworks {
+		return nil, false
+	}
+
+	if len(n.networks) == 0 {
+		return nil, len(tags) == 0
+	}
+
+	for _, k := range n.networks {
+		expected := k.tag(digest)
+
+		for _, tag := range tags {
+			if hmac.Equal(tag, expected) {
+				names = append(names, k.name)
+				break
+			}
+		}
+	}
+
+	return names, len(names) > 0
+}
+
+// networkDigest returns what the side of a session handshake proves its
+// memberships over.
+func networkDigest(transcript []byte, initiator bool) []byte {
+	h := sha256.New()
+
+	if initiator {
+		fmt.Fprintf(h, "%s initiator\x00", networkContext)
+	} else {
+		fmt.Fprintf(h, "%s responder\x00", networkContext)
+	}
+
+	h.Write(transcript)
+
+	return h.Sum(nil)
+}
+
+// sharesNetwork tells whether tables can be taken from the peer at the other
+// end of rw. Sessions are only established within shared networks; legacy
+// peers are in none.
+func (n *Node) sharesNetwork(rw io.ReadWriter) bool {
+	if sess, ok := rw.(*Session); ok {
+		return len(n.networks) == 0 || len(sess.Networks) > 0
+	}
+
+	return len(n.networks) == 0
+}
@@ -0,0 +1,117 @@
+package cosmofs
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks("team1:s3cret, team2:other:secret")
+
+	if err != nil || len(networks) != 2 {
+		t.Fatal("Failure in ParseNetworks:", networks, err)
+	}
+
+	if networks[1].Name != "team2" || networks[1].Secret != "other:secret" {
+		t.Error("Failure in ParseNetworks. Got:", networks[1])
+	}
+
+	for _, list := range []string{"team1", "team1:", ":s3cret"} {
+		_, err = ParseNetworks(list)
+
+		if err == nil {
+			t.Error("Failure in ParseNetworks. Accepted:", list)
+		}
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+	c := newTestNode(t, "carol@cosmofs.es")
+	d := newTestNode(t, "dave@cosmofs.es")
+
+	var err error
+
+	a.networks, err = networkKeys([]Network{{"team1", "s3cret"}, {"lab", "other"}})
+
+	if err != nil {
+		t.Fatal("Failure in networkKeys:", err)
+	}
+
+	b.networks, _ = networkKeys([]Network{{"team1", "s3cret"}})
+	c.networks, _ = networkKeys([]Network{{"team1", "wrong"}, {"team2", "s3cret"}})
+
+	for _, n := range []*Node{a, b, c, d} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	beacon, err := a.newBeacon()
+
+	if err != nil {
+		t.Fatal("Failure in newBeacon:", err)
+	}
+
+	if len(beacon.Networks) != 2 {
+		t.Error("Failure in newBeacon. Wrong number of memberships:", len(beacon.Networks))
+	}
+
+	if err := b.checkBeacon(beacon); err != nil {
+		t.Error("Failure in checkBeacon. Beacon of the same network refused:", err)
+	}
+
+	for _, n := range []*Node{c, d} {
+		if err := n.checkBeacon(beacon); err != ErrNoSharedNetwork {
+			t.Error("Failure in checkBeacon. Beacon of another network accepted:", n.ID(), err)
+		}
+	}
+
+	addr, _ := net.ResolveTCPAddr("tcp", peerAddr("127.0.0.1", a.Port()))
+
+	s, err := b.DialSession(addr)
+
+	if err != nil {
+		t.Fatal("Failure in DialSession:", err)
+	}
+
+	s.Close()
+
+	if len(s.Networks) != 1 || s.Networks[0] != "team1" {
+		t.Error("Failure in DialSession. Wrong shared networks:", s.Networks)
+	}
+
+	for _, n := range []*Node{c, d} {
+		_, err = n.DialSession(addr)
+
+		if err != ErrNoSharedNetwork {
+			t.Error("Failure in DialSession. Session established outside the networks:", n.ID(), err)
+		}
+
+		_, err = a.Connect(peerAddr("127.0.0.1", n.Port()))
+
+		if err != ErrNoSharedNetwork {
+			t.Error("Failure in Connect. Connected outside the networks:", n.ID(), err)
+		}
+	}
+
+	_, err = b.Connect(peerAddr("127.0.0.1", a.Port()))
+
+	if err != nil {
+		t.Error("Failure in Connect:", err)
+	}
+
+	if !waitFor(func() bool { ids, _ := b.table.ListIDs(); return len(ids) == 2 }) {
+		t.Error("Failure in Connect. The table of the same network was not merged.")
+	}
+
+	// Legacy peers are in no network
+	if a.sharesNetwork(&net.TCPConn{}) || !d.sharesNetwork(&net.TCPConn{}) {
+		t.Error("Failure in sharesNetwork with a legacy peer.")
+	}
+}
@@ -0,0 +1,487 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrControlAddr = errors.New("cosmofs: the control endpoint has to be a loopback address")
+
+// Node is a running Cosmofs peer. Everything it knows about itself, the
+// shared table and the other peers belongs to it, so several nodes can live
+// in the same process.
+type Node struct {
+	config Config
+
+	priv *localPeer
+	pub *Peer
+
+	table *SharedTable
+	peers *registry
+
+	// networks are the keys of the private swarms of the node.
+	networks []networkKey
+
+	// dht is nil unless it is enabled in the configuration.
+	dht *dht
+
+	// protocol and features are what the node offers to its peers.
+	protocol int
+	features uint32
+
+	// files serializes writing the known and denied peers files and the
+	// config files of the shared directories.
+	files sync.Mutex
+
+	bind net.IP
+	port int
+	discoveryPort int
+	lnTCP *net.TCPListener
+	lnUDP *net.UDPConn
+	lnMulticast []*net.UDPConn
+	lnMDNS *net.UDPConn
+	lnLocal *net.TCPListener
+
+	// announced keeps when each peer was last discovered, to drop the copies
+	// of its announcement received through other interfaces.
+	announced map[string]time.Time
+	announcedMu sync.Mutex
+
+	// exchanged keeps when each peer last sent us its peers, to bound how
+	// often it can. pexNext is when we send ours.
+	exchanged map[string]time.Time
+	exchangedMu sync.Mutex
+	pexNext time.Time
+
+	// conns are the connections shared with each peer, open all of them.
+	conns map[string]*peerConn
+	open map[*peerConn]struct{}
+	connsMu sync.Mutex
+
+	// relaySlots and relayLimit bound the streams relayed for other peers.
+	// They are nil unless relaying is enabled.
+	relaySlots chan struct{}
+	relayLimit *rateLimiter
+
+	done chan struct{}
+	closeOnce sync.Once
+
+	// wg tracks the loops started by Start and the petitions being served.
+	wg sync.WaitGroup
+}
+
+// NewNode loads the keys, the known and denied peers and the shared
+// directories given by config. The node does not touch the network until
+// Start is called.
+func NewNode(config Config) (n *Node, err error) {
+	if config.KnownPeersFile == "" {
+		config.KnownPeersFile = defaultKnownPeersFile()
+	}
+
+	if config.DeniedPeersFile == "" {
+		config.DeniedPeersFile = defaultDeniedPeersFile()
+	}
+
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+
+	if config.PeerTimeout <= 0 {
+		config.PeerTimeout = DefaultPeerTimeout
+	}
+
+	if config.ReconnectMinDelay <= 0 {
+		config.ReconnectMinDelay = DefaultReconnectMinDelay
+	}
+
+	if config.ReconnectMaxDelay < config.ReconnectMinDelay {
+		config.ReconnectMaxDelay = DefaultReconnectMaxDelay
+	}
+
+	if config.ControlAddr == "" {
+		config.ControlAddr = DefaultControlAddr
+	}
+
+	n = &Node{
+		config: config,
+		table: NewSharedTable(),
+		peers: newRegistry(),
+		port: config.Port,
+		protocol: ProtocolVersion,
+		features: allFeatures,
+		done: make(chan struct{}),
+		announced: make(map[string]time.Time),
+		exchanged: make(map[string]time.Time),
+		conns: make(map[string]*peerConn),
+		open: make(map[*peerConn]struct{}),
+	}
+
+	err = n.loadIdentity()
+
+	if err != nil {
+		return nil, err
+	}
+
+	n.networks, err = networkKeys(config.Networks)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if config.DHT {
+		n.dht = newDHT(n)
+	}
+
+	if config.Relay {
+		if config.RelayRate <= 0 {
+			n.config.RelayRate = DefaultRelayRate
+		}
+
+		n.relaySlots = make(chan struct{}, relayMaxStreams)
+		n.relayLimit = newRateLimiter(n.config.RelayRate)
+	}
+
+	n.loadPeers()
+
+	err = n.loadShares()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return n, err
+}
+
+// Start listens for peers and local clients and announces the node to the
+// network.
+func (n *Node) Start() (err error) {
+	n.bind, err = bindIP(n.config.BindAddr)
+
+	if err != nil {
+		return err
+	}
+
+	control, err := net.ResolveTCPAddr("tcp", n.config.ControlAddr)
+
+	if err != nil {
+		return err
+	}
+
+	if !control.IP.IsLoopback() {
+		return ErrControlAddr
+	}
+
+	n.lnTCP, err = net.ListenTCP("tcp", &net.TCPAddr{
+		IP:		n.bind,
+		Port:	n.config.Port,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	// The actual port is only known now when the configured one is 0.
+	n.port = n.lnTCP.Addr().(*net.TCPAddr).Port
+	n.pub.Port = n.port
+
+	n.discoveryPort = n.config.DiscoveryPort
+
+	if n.discoveryPort == 0 {
+		n.discoveryPort = n.port
+	}
+
+	// IPv4 announcements get a socket of their own, so the one of the
+	// IPv6 group can be bound to the same port.
+	network := "udp"
+
+	if n.bind.To4() != nil {
+		network = "udp4"
+	}
+
+	n.lnUDP, err = net.ListenUDP(network, &net.UDPAddr{
+		IP:		n.bind,
+		Port:	n.discoveryPort,
+	})
+
+	if err != nil {
+		n.lnTCP.Close()
+		return err
+	}
+
+	n.lnLocal, err = net.ListenTCP("tcp", control)
+
+	if err != nil {
+		n.lnUDP.Close()
+		n.lnTCP.Close()
+		return err
+	}
+
+	// IPv6 networks are reached through a link-local multicast group on
+	// every interface.
+	if n.config.BindAddr == "" {
+		n.listenMulticast()
+	}
+
+	if n.config.MDNS {
+		err = n.listenMDNS()
+
+		if err != nil {
+			log.Printf("Error joining the mDNS group: %s\n", err)
+			err = nil
+		}
+	}
+
+	n.wg.Add(5 + len(n.lnMulticast))
+
+	go n.serveTCP()
+	go n.serveUDP(n.lnUDP)
+	go n.serveLocal()
+	go n.keepAlive()
+
+	for _, conn := range n.lnMulticast {
+		go n.serveUDP(conn)
+	}
+
+	if n.lnMDNS != nil {
+		n.wg.Add(1)
+		go n.serveMDNS()
+
+		n.browseMDNS()
+	}
+
+	n.announce()
+
+	go n.bootstrap()
+
+	n.reconnectAll()
+
+	return err
+}
+
+// bindIP resolves BindAddr, either an IP address or the name of an
+// interface, whose first IPv4 address is used.
+func bindIP(addr string) (ip net.IP, err error) {
+	if addr == "" {
+		return net.IPv4zero, err
+	}
+
+	ip = net.ParseIP(addr)
+
+	if ip != nil {
+		return ip, err
+	}
+
+	iface, err := net.InterfaceByName(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP, err
+		}
+	}
+
+	return nil, fmt.Errorf("cosmofs: interface %s has no IPv4 address", addr)
+}
+
+// Close says goodbye to the connected peers, stops listening, waits for the
+// petitions being served and saves the state of the node. It can be called
+// more than once.
+func (n *Node) Close() (err error) {
+	n.closeOnce.Do(func() {
+		close(n.done)
+
+		if n.lnTCP != nil {
+			n.sayGoodbye()
+		}
+
+		if n.lnUDP != nil {
+			n.lnUDP.Close()
+		}
+
+		for _, conn := range n.lnMulticast {
+			conn.Close()
+		}
+
+		if n.lnMDNS != nil {
+			n.lnMDNS.Close()
+		}
+
+		if n.lnTCP != nil {
+			err = n.lnTCP.Close()
+		}
+
+		if n.lnLocal != nil {
+			n.lnLocal.Close()
+		}
+
+		n.closeConns()
+
+		n.wait()
+		n.flush()
+	})
+
+	return err
+}
+
+// wait gives the petitions being served shutdownTimeout to finish.
+func (n *Node) wait() {
+	finished := make(chan struct{})
+
+	go func() {
+		n.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(shutdownTimeout):
+		log.Printf("Some petitions are still being served, closing anyway\n")
+	}
+}
+
+// flush saves the peer files and the config files of the shared
+// directories.
+func (n *Node) flush() {
+	err := n.encodeKnownPeersFile()
+
+	if err != nil {
+		log.Printf("Error saving known peers file: %s\n", err)
+	}
+
+	err = n.encodeDeniedPeersFile()
+
+	if err != nil {
+		log.Printf("Error saving denied peers file: %s\n", err)
+	}
+
+	n.encodeConfigFiles()
+}
+
+func (n *Node) closed() bool {
+	select {
+	case <-n.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// ID returns the ID of the node, the comment of its public key.
+func (n *Node) ID() string {
+	return n.pub.ID
+}
+
+// PublicPeer returns the identity of the node as other peers see it.
+func (n *Node) PublicPeer() *Peer {
+	return n.pub
+}
+
+// Port returns the port the node listens on for peers.
+func (n *Node) Port() int {
+	return n.port
+}
+
+// ControlAddr returns the address of the endpoint for local clients, once
+// the node is started.
+func (n *Node) ControlAddr() net.Addr {
+	if n.lnLocal == nil {
+		return nil
+	}
+
+	return n.lnLocal.Addr()
+}
+
+// Table returns the table of shared files known to the node.
+func (n *Node) Table() *SharedTable {
+	return n.table
+}
+
+// ConnectedPeers returns a copy of the ID to address map of connected peers.
+func (n *Node) ConnectedPeers() map[string]string {
+	return n.peers.connectedPeers()
+}
+
+// PeerStatus returns the liveness of the connected peers and the state of
+// those being reconnected, sorted by ID.
+func (n *Node) PeerStatus() []PeerStatus {
+	return n.peers.status()
+}
+
+func (n *Node) debug(format string, v ...interface{}) {
+	if n.config.Verbose {
+		log.Printf(format, v...)
+	}
+}
+
+// serveTCP accepts petitions of other peers until the node is closed.
+func (n *Node) serveTCP() {
+	defer n.wg.Done()
+
+	n.accept(n.lnTCP, n.handleTCPPetition)
+}
+
+// serveLocal accepts petitions of local clients until the node is closed.
+func (n *Node) serveLocal() {
+	defer n.wg.Done()
+
+	n.accept(n.lnLocal, n.handleLocalPetition)
+}
+
+// accept serves every connection of ln with handle.
+func (n *Node) accept(ln *net.TCPListener, handle func(*net.TCPConn)) {
+	for {
+		n.debug("WAITING FOR TCP CONN\n")
+
+		conn, err := ln.AcceptTCP()
+
+		if err != nil {
+			if n.closed() {
+				return
+			}
+
+			n.debug("Error: %s\n", err)
+			continue
+		}
+
+		n.wg.Add(1)
+
+		go func() {
+			defer n.wg.Done()
+			handle(conn)
+		}()
+	}
+}
@@ -0,0 +1,405 @@
+package cosmofs
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestNode returns a node with a fresh Ed25519 identity sharing one
+// directory. Every file it uses lives in a temporary directory.
+func newTestNode(t *testing.T, id string) *Node {
+	peer, priv := newTestPeer(t, id)
+
+	dir := t.TempDir()
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+
+	if err != nil {
+		t.Fatal("Error encoding key:", err)
+	}
+
+	config := Config{
+		PubKeyFile: filepath.Join(dir, "id_ed25519.pub"),
+		PrivKeyFile: filepath.Join(dir, "id_ed25519"),
+		Inbox: filepath.Join(dir, "in"),
+		Share: []string{filepath.Join(dir, "out1")},
+		KnownPeersFile: filepath.Join(dir, "cosmofs_known_peers"),
+		DeniedPeersFile: filepath.Join(dir, "cosmofs_denied_peers"),
+		ControlAddr: "127.0.0.1:0",
+	}
+
+	for _, d := range []string{config.Inbox, config.Share[0]} {
+		err = os.Mkdir(d, 0700)
+
+		if err != nil {
+			t.Fatal("Error creating directory:", err)
+		}
+	}
+
+	files := map[string][]byte{
+		config.PubKeyFile: peer.RawKey,
+		config.PrivKeyFile: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}),
+		filepath.Join(config.Share[0], "shared.txt"): []byte("shared by " + id),
+	}
+
+	for name, data := range files {
+		err = os.WriteFile(name, data, 0600)
+
+		if err != nil {
+			t.Fatal("Error writing file:", err)
+		}
+	}
+
+	n, err := NewNode(config)
+
+	if err != nil {
+		t.Fatal("Failure in NewNode:", err)
+	}
+
+	return n
+}
+
+// localPetition sends a request of type typ to the local endpoint of n and
+// decodes the answer into resp.
+func localPetition(t *testing.T, n *Node, typ MsgType, req, resp interface{}) {
+	conn, err := net.Dial("tcp", n.ControlAddr().String())
+
+	if err != nil {
+		t.Fatal("Error connecting to node:", err)
+	}
+
+	defer conn.Close()
+
+	err = Call(conn, typ, req, resp)
+
+	if err != nil {
+		t.Fatal("Error in petition:", err)
+	}
+}
+
+func TestNode(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	if a.Port() == b.Port() {
+		t.Fatal("Failure in Start. Both nodes got the same port.")
+	}
+
+	for _, n := range []*Node{a, b} {
+		var ids ListResponse
+
+		localPetition(t, n, MsgListKnownIDs, nil, &ids)
+
+		if len(ids.Items) != 1 || ids.Items[0] != n.ID() {
+			t.Errorf("Failure in Node. %s knows %v", n.ID(), ids.Items)
+		}
+
+		var dirs ListResponse
+
+		localPetition(t, n, MsgListDirsID, IDRequest{ID: n.ID()}, &dirs)
+
+		if len(dirs.Items) != 1 || dirs.Items[0] != filepath.Join(n.ID(), "out1") {
+			t.Errorf("Failure in Node. %s shares %v", n.ID(), dirs.Items)
+		}
+
+		owner := n.Table().Files(n.ID(), "out1")[0].Owner
+
+		if owner == nil || owner.ID != n.ID() {
+			t.Errorf("Failure in Node. Files of %s have no owner.", n.ID())
+		}
+	}
+
+	port := a.Port()
+
+	err := a.Close()
+
+	if err != nil {
+		t.Error("Failure in Close:", err)
+	}
+
+	// The port is free again once the node is closed.
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4zero, Port: port})
+
+	if err != nil {
+		t.Error("Failure in Close. Port still in use:", err)
+	} else {
+		ln.Close()
+	}
+}
+
+// waitFor polls cond until it holds or a few seconds have passed.
+func waitFor(cond func() bool) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if cond() {
+			return true
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return cond()
+}
+
+func TestDiscoveryPorts(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	// a announces itself to b. Both listen on the same host, each one on its
+	// own port.
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.Port()})
+
+	if err != nil {
+		t.Fatal("Error dialing:", err)
+	}
+
+	beacon, err := a.newBeacon()
+
+	if err != nil {
+		t.Fatal("Failure in newBeacon:", err)
+	}
+
+	data, err := beacon.encode()
+
+	if err != nil {
+		t.Fatal("Failure in encode:", err)
+	}
+
+	_, err = conn.Write(data)
+	conn.Close()
+
+	if err != nil {
+		t.Fatal("Error announcing:", err)
+	}
+
+	connected := func(n, other *Node) bool {
+		_, err := n.Table().ExistsID(other.ID())
+
+		return err == nil && n.ConnectedPeers()[other.ID()] == peerAddr("127.0.0.1", other.Port())
+	}
+
+	if !waitFor(func() bool { return connected(a, b) && connected(b, a) }) {
+		t.Errorf("Failure in discovery. a: %v, b: %v", a.ConnectedPeers(), b.ConnectedPeers())
+	}
+}
+
+func TestControlAddr(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	n.config.ControlAddr = "192.0.2.1:0"
+
+	err := n.Start()
+
+	if err != ErrControlAddr {
+		n.Close()
+		t.Error("Failure in Start. Control endpoint not on loopback:", err)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	err := a.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	defer a.Close()
+
+	b.config.Bootstrap = []string{peerAddr("127.0.0.1", a.Port())}
+
+	err = b.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	defer b.Close()
+
+	connected := func(n, other *Node) bool {
+		_, err := n.Table().ExistsID(other.ID())
+		_, ok := n.ConnectedPeers()[other.ID()]
+
+		return err == nil && ok
+	}
+
+	if !waitFor(func() bool { return connected(a, b) && connected(b, a) }) {
+		t.Errorf("Failure in bootstrap. a: %v, b: %v", a.ConnectedPeers(), b.ConnectedPeers())
+	}
+}
+
+func TestConnectPetition(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	var result ResultResponse
+
+	localPetition(t, b, MsgConnectPeer, AddrRequest{Addr: peerAddr("127.0.0.1", a.Port())}, &result)
+
+	if !strings.HasPrefix(result.Result, "Connected to "+a.ID()) {
+		t.Error("Failure in Connect Peer:", result.Result)
+	}
+
+	if !waitFor(func() bool { _, ok := a.ConnectedPeers()[b.ID()]; return ok }) {
+		t.Error("Failure in Connect Peer. The peer did not connect back.")
+	}
+
+	_, err := b.Connect(peerAddr("127.0.0.1", b.Port()))
+
+	if err != ErrSelfConnect {
+		t.Error("Failure in Connect. Connected to itself:", err)
+	}
+}
+
+// TestConnectPetitionErrors makes sure failed connections keep their kind,
+// which the client takes as its exit status.
+func TestConnectPetitionErrors(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	connect := func() error {
+		conn, err := net.Dial("tcp", b.ControlAddr().String())
+
+		if err != nil {
+			t.Fatal("Error connecting to node:", err)
+		}
+
+		defer conn.Close()
+
+		return Call(conn, MsgConnectPeer, AddrRequest{Addr: peerAddr("127.0.0.1", a.Port())}, &ResultResponse{})
+	}
+
+	var e *WireError
+
+	// bob denies alice.
+	err := b.DenyPeer(a.ID(), "test")
+
+	if err != nil {
+		t.Fatal("Failure in DenyPeer:", err)
+	}
+
+	err = connect()
+
+	if !errors.As(err, &e) || e.Code != CodePermissionDenied {
+		t.Error("Failure in Connect Peer. A denied peer answered with:", err)
+	}
+
+	// And then knows her by another key.
+	err = b.AllowPeer(a.ID())
+
+	if err != nil {
+		t.Fatal("Failure in AllowPeer:", err)
+	}
+
+	old, _ := newTestPeer(t, "alice@cosmofs.es")
+
+	err = b.StorePeer(old)
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	err = connect()
+
+	if !errors.As(err, &e) || e.Code != CodePermissionDenied {
+		t.Error("Failure in Connect Peer. A changed key answered with:", err)
+	}
+}
+
+func TestHello(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	err := a.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	defer a.Close()
+
+	// Not listening, as behind a NAT: a cannot dial back.
+	defer b.Close()
+
+	id, err := b.Connect(peerAddr("127.0.0.1", a.Port()))
+
+	if err != nil || id != a.ID() {
+		t.Fatalf("Failure in Connect. Got %q: %v", id, err)
+	}
+
+	if _, ok := a.ConnectedPeers()[b.ID()]; !ok {
+		t.Error("Failure in Connect. The peer does not know us.")
+	}
+
+	if _, ok := b.ConnectedPeers()[a.ID()]; !ok {
+		t.Error("Failure in Connect. The peer is not connected.")
+	}
+
+	for _, n := range []*Node{a, b} {
+		for _, other := range []*Node{a, b} {
+			if len(n.Table().Files(other.ID(), "out1")) == 0 {
+				t.Errorf("Failure in Connect. %s has no files of %s.", n.ID(), other.ID())
+			}
+		}
+	}
+
+	// The connection of the hello is the one used afterwards.
+	var content FileContent
+
+	c, err := a.connTo(b.ID(), peerAddr("127.0.0.1", 1))
+
+	if err == nil {
+		err = c.call(MsgOpenFile, PathRequest{Path: filepath.Join(b.ID(), "out1", "shared.txt")}, &content, 5*time.Second)
+	}
+
+	if err != nil || string(content.Content) != "shared by "+b.ID() {
+		t.Errorf("Failure in connTo. Got %q: %v", content.Content, err)
+	}
+}
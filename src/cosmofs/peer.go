@@ -23,253 +23,397 @@ package cosmofs
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/binary"
 	"encoding/base64"
 	"encoding/gob"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"log"
 	"math/big"
 	"os"
-	"path/filepath"
 )
 
 const (
 	hostAlgoRSA = "ssh-rsa"
+	hostAlgoEd25519 = "ssh-ed25519"
+	hostAlgoECDSA256 = "ecdsa-sha2-nistp256"
+	hostAlgoECDSA384 = "ecdsa-sha2-nistp384"
+	hostAlgoECDSA521 = "ecdsa-sha2-nistp521"
 )
 
 var (
-	MyPrivatePeer *localPeer
-	MyPublicPeer *Peer
-	PeerList map[string]*Peer = make(map[string]*Peer)
-	ConnectedPeers map[string]string = make(map[string]string)
-
-	knownPeersFileName = filepath.Join(os.Getenv("HOME"), ".ssh", "cosmofs_known_peers")
+	ErrKeyChanged = newError(ErrPermissionDenied, "cosmofs: the key of a known peer has changed")
 )
 
 type localPeer struct {
 	id string
-	key *rsa.PrivateKey
+	key crypto.Signer
 	rawKey []byte
 }
 
+// Peer is the public identity of a node. PubKey is one of *rsa.PublicKey,
+// *ecdsa.PublicKey or ed25519.PublicKey, parsed from the SSH public key line
+// kept in RawKey. Port is the one the peer listens on, as it advertised it.
+// Addrs and Comment come from the known peers file and are never sent to
+// other peers.
 type Peer struct {
 	ID string
-	PubKey *rsa.PublicKey
+	PubKey crypto.PublicKey
 	RawKey []byte
+	Port int
+
+	Addrs []string
+	Comment string
+}
+
+// peerWire is what travels for a Peer. The key is parsed again from RawKey on
+// reception, so every supported algorithm goes through the same path.
+type peerWire struct {
+	ID string
+	RawKey []byte
+	Port int
+}
+
+func (p Peer) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(peerWire{
+		ID: p.ID,
+		RawKey: p.RawKey,
+		Port: p.Port,
+	})
+
+	return buf.Bytes(), err
 }
 
-func init() {
-	buffer := parseKeyFile(*pubkeyFileName)
+func (p *Peer) GobDecode(data []byte) (err error) {
+	var w peerWire
+
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(&w)
+
+	if err != nil {
+		return err
+	}
+
+	key, _, _, ok := parsePubKey(w.RawKey)
+
+	if !ok {
+		return errors.New("cosmofs: cannot parse public key of peer " + w.ID)
+	}
+
+	p.ID = w.ID
+	p.PubKey = key
+	p.RawKey = w.RawKey
+	p.Port = w.Port
+
+	return err
+}
+
+// loadIdentity reads the key pair of the node. The private key has to match
+// the public one.
+func (n *Node) loadIdentity() (err error) {
+	buffer, err := os.ReadFile(n.config.PubKeyFile)
+
+	if err != nil {
+		return fmt.Errorf("cosmofs: cannot read Public Key File: %w", err)
+	}
 
 	key, _, id, ok := parsePubKey(buffer)
 
 	if !ok {
-		log.Fatal("Cannot parse Public Key File")
+		return errors.New("cosmofs: cannot parse Public Key File " + n.config.PubKeyFile)
 	}
 
-	MyPublicPeer = &Peer{
+	n.pub = &Peer{
 		ID: string(id),
-		PubKey: key.(*rsa.PublicKey),
+		PubKey: key,
 		RawKey: buffer,
 	}
 
-	buffer = parseKeyFile(*privkeyFileName)
+	buffer, err = os.ReadFile(n.config.PrivKeyFile)
 
-	key, err := parsePrivateKey(buffer)
+	if err != nil {
+		return fmt.Errorf("cosmofs: cannot read Private Key File: %w", err)
+	}
+
+	signer, err := parsePrivateKey(buffer, []byte(n.config.Passphrase))
+
+	if err != nil {
+		return fmt.Errorf("cosmofs: cannot parse Private Key File: %w", err)
+	}
 
-	if err != nil{
-		log.Fatal("Cannot parse Private Key File:", err)
+	if !samePublicKey(signer.Public(), key) {
+		return errors.New("cosmofs: Private Key File does not match Public Key File")
 	}
 
-	MyPrivatePeer = &localPeer{
+	n.priv = &localPeer{
 		id: string(id),
-		key: key.(*rsa.PrivateKey),
+		key: signer,
 		rawKey: buffer,
 	}
 
-	createKnownPeersFile()
+	return err
+}
 
-	_, err = os.Lstat(knownPeersFileName)
+// loadPeers reads the known and denied peers files, creating the first one
+// if it does not exist yet.
+func (n *Node) loadPeers() {
+	_, err := os.Lstat(n.config.KnownPeersFile)
 
 	if err != nil {
-		err := createKnownPeersFile()
+		err := n.createKnownPeersFile()
 
 		if err != nil {
 			log.Printf("Error creating known peers file: %s", err)
 		}
 	}
 
-	err = decodeKnownPeersFile()
+	err = n.decodeKnownPeersFile()
 
 	if err != nil {
 		log.Printf("Error decoding known peers file: %s", err)
 	}
-}
 
-func SearchPeer(id string) (*Peer, bool){
-	if peer, ok := PeerList[id]; ok {
-		return peer, ok
+	err = n.decodeDeniedPeersFile()
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error decoding denied peers file: %s", err)
 	}
-	return nil, false
 }
 
-func StorePeer(peer *Peer) {
-	PeerList[peer.ID] = peer
+func (n *Node) SearchPeer(id string) (*Peer, bool){
+	return n.peers.lookup(id)
 }
 
-func SendPeer(encod *gob.Encoder) {
-	err := encod.Encode(*MyPublicPeer)
+// CheckPeer compares the key of peer with the one pinned the first time its
+// ID was seen. Unknown IDs are fine.
+func (n *Node) CheckPeer(peer *Peer) (err error) {
+	known, ok := n.peers.lookup(peer.ID)
 
-	if err != nil {
-		log.Fatal("Error sending Public Peer: ", err)
+	if ok && !samePublicKey(known.PubKey, peer.PubKey) {
+		return ErrKeyChanged
 	}
-}
 
-func ReceivePeer (decod *gob.Decoder) (string){
-	var receivedPeer Peer
+	return err
+}
 
-	err := decod.Decode(&receivedPeer)
+// StorePeer pins the key of a new peer in the known peers file, trust on first
+// use. A different key for a known ID is refused and kept aside until the
+// user accepts it with AcceptPeerKey.
+func (n *Node) StorePeer(peer *Peer) (err error) {
+	err = n.CheckDenied(peer)
 
 	if err != nil {
-		log.Fatal("Error decoding received Peer: ", err)
-		return ""
+		return err
 	}
 
-	StorePeer(&receivedPeer)
+	known, isNew, err := n.peers.pin(peer)
 
-	return receivedPeer.ID
-}
+	if err != nil {
+		log.Printf("WARNING: THE KEY OF PEER %s HAS CHANGED!", peer.ID)
+		log.Printf("WARNING: Known fingerprint is %s, presented fingerprint is %s",
+			known.Fingerprint(), peer.Fingerprint())
+		log.Printf("WARNING: Connection refused. Somebody could be impersonating %s. "+
+			"If the change is legitimate accept it with: client -acceptKey %s", peer.ID, peer.ID)
 
-func ConnectedPeer(id string, addr string) {
-	ConnectedPeers[id] = addr
-}
+		return err
+	}
+
+	if !isNew {
+		return err
+	}
 
-func DisconnectedPeer(id string) {
-	delete(ConnectedPeers, id)
+	log.Printf("Pinned key of new peer %s: %s", peer.ID, peer.Fingerprint())
+
+	return n.encodeKnownPeersFile()
 }
 
-func createKnownPeersFile() (err error) {
-	knownPeersFile, err := os.Create(knownPeersFileName)
+// AcceptPeerKey replaces the pinned key of id with the changed key that was
+// last refused by StorePeer.
+func (n *Node) AcceptPeerKey(id string) (err error) {
+	peer, ok := n.peers.acceptChanged(id)
 
-	if err != nil {
-		return err
+	if !ok {
+		return errors.New("cosmofs: there is no changed key to accept for " + id)
 	}
 
-	configEnc := gob.NewEncoder(knownPeersFile)
+	log.Printf("Accepted new key of peer %s: %s", id, peer.Fingerprint())
 
-	err = configEnc.Encode(PeerList)
+	return n.encodeKnownPeersFile()
+}
 
-	if err != nil {
-		log.Fatal("Error encoding peer list in known peers file: ", err)
-	}
+// PeerFingerprint describes a known peer. Pending holds the fingerprint of a
+// changed key waiting to be accepted, if any.
+type PeerFingerprint struct {
+	ID string
+	Fingerprint string
+	Pending string
+}
 
-	return err
+// ListFingerprints returns the known peers sorted by ID.
+func (n *Node) ListFingerprints() (list []PeerFingerprint) {
+	return n.peers.fingerprints()
 }
 
-func decodeKnownPeersFile() (err error) {
-	knownPeersFile, err := os.Open(knownPeersFileName)
+// Fingerprint returns the SHA256 fingerprint of the key, as ssh-keygen -l
+// prints it.
+func (p *Peer) Fingerprint() string {
+	_, key, _, ok := parseString(p.RawKey)
 
-	if err != nil {
-		log.Printf("Error opening config file: %s", err)
-		return err
+	if !ok {
+		return ""
 	}
 
-	configDec := gob.NewDecoder(knownPeersFile)
-
-	err = configDec.Decode(&PeerList)
+	blob, err := base64.StdEncoding.DecodeString(string(key))
 
 	if err != nil {
-		log.Fatal("Error decoding list of files config file: ", err)
+		return ""
 	}
 
-	return err
+	sum := sha256.Sum256(blob)
+
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
 }
 
-func encodeKnownPeersFile() (err error) {
-	err = os.Remove(knownPeersFileName)
+func (n *Node) SendPeer(encod *gob.Encoder) (err error) {
+	err = encod.Encode(*n.pub)
 
 	if err != nil {
-		log.Printf("Error removing known peers file: %s", err)
-		return err
+		log.Printf("Error sending Public Peer: %s", err)
 	}
 
-	createKnownPeersFile()
-
 	return err
 }
 
-func parseKeyFile(keyFileName string) ([]byte) {
-	fi, err := os.Lstat(keyFileName)
+// ReceivePeer decodes a Peer sent by the remote side. The peer is not stored
+// among the known peers: it has to pass Challenge first.
+func ReceivePeer (decod *gob.Decoder) (peer *Peer, err error) {
+	var receivedPeer Peer
+
+	err = decod.Decode(&receivedPeer)
 
 	if err != nil {
-		log.Fatal("Error: Cannot find SSH Key file.")
+		log.Printf("Error decoding received Peer: %s", err)
+		return nil, err
 	}
 
-	keyFile, err := os.Open(keyFileName)
-
-	if err != nil {
-		log.Fatal("Error: Cannot open SSH Key file.")
+	if receivedPeer.PubKey == nil {
+		return nil, errors.New("cosmofs: received peer without public key")
 	}
 
-	defer keyFile.Close()
+	return &receivedPeer, err
+}
 
-	buffer := make([]byte, fi.Size())
+// ConnectedPeer marks id as connected from addr, the one it listens on, and
+// remembers the address to reconnect after a restart.
+func (n *Node) ConnectedPeer(id string, addr string) {
+	n.peers.connect(id, addr)
+	n.refreshOnline()
 
-	keyFile.Read(buffer)
+	if n.dht != nil {
+		n.dht.update(Contact{ID: id, Addr: addr})
+	}
+
+	if n.peers.rememberAddr(id, addr) {
+		err := n.encodeKnownPeersFile()
+
+		if err != nil {
+			log.Printf("Error saving known peers file: %s\n", err)
+		}
+	}
+}
 
-	return buffer
+func (n *Node) DisconnectedPeer(id string) {
+	n.peers.disconnect(id)
+	n.dropConn(id)
+	n.refreshOnline()
 }
 
-// parsePrivateKey parses a private RSA PKCS1 Key
-func parsePrivateKey(in []byte) (out interface{}, err error) {
+// parsePrivateKey parses a PEM encoded private key: PKCS#1, SEC1, PKCS#8 or
+// OpenSSH. passphrase is only needed for encrypted keys.
+func parsePrivateKey(in, passphrase []byte) (out crypto.Signer, err error) {
 	block, _ := pem.Decode(in)
 
 	if block == nil {
 		return nil, errors.New("SSH: no private key found")
 	}
 
-	out, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	der := block.Bytes
 
-	if err != nil {
-		return nil, err
+	// Legacy "Proc-Type: 4,ENCRYPTED" PEM blocks
+	if x509.IsEncryptedPEMBlock(block) {
+		if len(passphrase) == 0 {
+			return nil, ErrPassphraseNeeded
+		}
+
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+
+		if err != nil {
+			return nil, ErrBadPassphrase
+		}
 	}
 
-	return
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		return parsePKCS8PrivateKey(der)
+	case "ENCRYPTED PRIVATE KEY":
+		return parseEncryptedPKCS8PrivateKey(der, passphrase)
+	case "OPENSSH PRIVATE KEY":
+		return parseOpenSSHPrivateKey(der, passphrase)
+	}
+
+	return nil, errors.New("SSH: unsupported private key type " + block.Type)
 }
 
-// parsePubKey parses a Public SSH-RSA Key encoded in Base64 format
-func parsePubKey(in []byte) (out interface{}, rest, id []byte, ok bool) {
-	algo, key, id, ok := parseString(in)
+// parsePubKey parses a Public SSH Key line in authorized_keys format:
+// algorithm, key encoded in Base64 and ID.
+func parsePubKey(in []byte) (out crypto.PublicKey, rest, id []byte, ok bool) {
+	kind, key, id, ok := parseString(in)
 
 	if !ok {
 		return
 	}
 
-	dst := make([]byte, base64.StdEncoding.DecodedLen(len(key)))
-
-	_, err := base64.StdEncoding.Decode(dst, key)
+	dst, err := base64.StdEncoding.DecodeString(string(key))
 
 	if err != nil {
-		log.Println("Error decoding rsa key:", err)
-		return
+		log.Println("Error decoding public key:", err)
+		return nil, nil, id, false
 	}
 
-	algo, key, ok = parseKey(dst)
+	algo, key, ok := parseKey(dst)
 
-	if !ok {
-		return
+	if !ok || !bytes.Equal(algo, kind) {
+		return nil, nil, id, false
 	}
 
-
 	switch string(algo) {
 	case hostAlgoRSA:
 		pubkey, rest, ok := parseRSA(key)
 		return pubkey, rest, id, ok
+	case hostAlgoEd25519:
+		pubkey, rest, ok := parseEd25519(key)
+		return pubkey, rest, id, ok
+	case hostAlgoECDSA256, hostAlgoECDSA384, hostAlgoECDSA521:
+		pubkey, rest, ok := parseECDSA(string(algo), key)
+		return pubkey, rest, id, ok
 	}
-	panic("ssh: unknown public key type")
+
+	log.Printf("SSH: unknown public key type %s", algo)
+
+	return nil, nil, id, false
 }
 
 // parseRSA parses an RSA key according to RFC 4253, section 6.6.
@@ -295,13 +439,75 @@ func parseRSA(in []byte) (out *rsa.PublicKey, rest []byte, ok bool) {
 	return key, in, ok
 }
 
+// parseEd25519 parses an Ed25519 key according to RFC 8709.
+func parseEd25519(in []byte) (out ed25519.PublicKey, rest []byte, ok bool) {
+	key, rest, ok := parseKey(in)
+
+	if !ok || len(key) != ed25519.PublicKeySize {
+		return nil, nil, false
+	}
+
+	return ed25519.PublicKey(key), rest, ok
+}
+
+// parseECDSA parses an ECDSA key according to RFC 5656, section 3.1.
+func parseECDSA(algo string, in []byte) (out *ecdsa.PublicKey, rest []byte, ok bool) {
+	name, in, ok := parseKey(in)
+
+	if !ok {
+		return
+	}
+
+	curve := curveByName(string(name))
+
+	if curve == nil || "ecdsa-sha2-"+string(name) != algo {
+		return nil, nil, false
+	}
+
+	point, rest, ok := parseKey(in)
+
+	if !ok {
+		return
+	}
+
+	out, err := ecdsa.ParseUncompressedPublicKey(curve, point)
+
+	if err != nil {
+		return nil, nil, false
+	}
+
+	return out, rest, ok
+}
+
+func curveByName(name string) elliptic.Curve {
+	switch name {
+	case "nistp256":
+		return elliptic.P256()
+	case "nistp384":
+		return elliptic.P384()
+	case "nistp521":
+		return elliptic.P521()
+	}
+	return nil
+}
+
+// samePublicKey reports whether a and b are the same key.
+func samePublicKey(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+
+	return ok && b != nil && k.Equal(b)
+}
+
 func parseString(in []byte) (kind, key, id []byte, ok bool) {
-	parts := bytes.Split(in, []byte(" "))
+	parts := bytes.Fields(in)
+
+	if len(parts) < 3 {
+		return
+	}
 
 	kind = parts[0]
 	key = parts[1]
 	id = parts[2]
-	id = id[:len(id)-1]
 	ok = true
 	return
 }
@@ -312,7 +518,8 @@ func parseKey(in []byte) (out, rest []byte, ok bool) {
 	}
 
 	length := binary.BigEndian.Uint32(in)
-	if uint32(len(in)) < 4+length {
+	// In 64 bits, so a length near 2^32 cannot wrap around
+	if uint64(len(in)) < 4+uint64(length) {
 		return
 	}
 	out = in[4 : 4+length]
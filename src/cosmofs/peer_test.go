@@ -1,12 +1,40 @@
 package cosmofs
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
 	"os"
 	"path/filepath"
 	"testing"
 )
 
+func sshString(s []byte) []byte {
+	out := make([]byte, 4, 4+len(s))
+	binary.BigEndian.PutUint32(out, uint32(len(s)))
+	return append(out, s...)
+}
+
+// newTestPeer returns a Peer with a fresh Ed25519 key.
+func newTestPeer(t *testing.T, id string) (*Peer, ed25519.PrivateKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal("Error generating key:", err)
+	}
+
+	blob := append(sshString([]byte(hostAlgoEd25519)), sshString(pub)...)
+	raw := []byte(hostAlgoEd25519 + " " + base64.StdEncoding.EncodeToString(blob) + " " + id + "\n")
+
+	return &Peer{
+		ID: id,
+		PubKey: pub,
+		RawKey: raw,
+	}, priv
+}
+
 func TestParsePubKey(t *testing.T) {
 	keyFileName := filepath.Join(os.Getenv("HOME"), ".ssh", "prueba.pub")
 
@@ -77,7 +105,7 @@ func TestParsePrivKey(t *testing.T) {
 
 	t.Logf("%s", buffer)
 
-	key, err := parsePrivateKey(buffer)
+	key, err := parsePrivateKey(buffer, nil)
 
 	if err != nil {
 		t.Fatal("Error:", err)
@@ -102,3 +130,52 @@ func TestParsePrivKey(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestStorePeer(t *testing.T) {
+	peer, _ := newTestPeer(t, "tofu@cosmofs.es")
+	impostor, _ := newTestPeer(t, "tofu@cosmofs.es")
+
+	n := newTestNode(t, "node@cosmofs.es")
+
+	err := n.StorePeer(peer)
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	err = n.StorePeer(peer)
+
+	if err != nil {
+		t.Error("Failure in StorePeer. Same key should pass:", err)
+	}
+
+	err = n.StorePeer(impostor)
+
+	if err != ErrKeyChanged {
+		t.Error("Failure in StorePeer. Changed key should be refused:", err)
+	}
+
+	found := false
+
+	for _, fp := range n.ListFingerprints() {
+		if fp.ID == peer.ID {
+			found = fp.Fingerprint == peer.Fingerprint() && fp.Pending == impostor.Fingerprint()
+		}
+	}
+
+	if !found {
+		t.Error("Failure in ListFingerprints.")
+	}
+
+	err = n.AcceptPeerKey(peer.ID)
+
+	if err != nil || n.CheckPeer(impostor) != nil {
+		t.Error("Failure in AcceptPeerKey:", err)
+	}
+
+	err = n.AcceptPeerKey(peer.ID)
+
+	if err == nil {
+		t.Error("Failure in AcceptPeerKey. There is nothing left to accept.")
+	}
+}
@@ -0,0 +1,385 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	pexContext string = "cosmofs-pex-v1"
+
+	// Connected peers exchange the peers they know every pexInterval.
+	pexInterval time.Duration = 5 * time.Minute
+
+	// pexMaxAge bounds how old a list can be, so a captured one cannot be
+	// replayed for long.
+	pexMaxAge time.Duration = 5 * time.Minute
+
+	// pexMaxPeers bounds the lists sent and received; longer ones are
+	// rejected whole. At most pexMaxNew of the peers of a list that we are
+	// not connected to are dialed.
+	pexMaxPeers int = 32
+	pexMaxNew int = 8
+
+	pexTimeout time.Duration = 10 * time.Second
+)
+
+var (
+	ErrBadPeerExchange = errors.New("cosmofs: invalid peer exchange")
+	ErrPexTooSoon = errors.New("cosmofs: peer exchange sent too soon")
+)
+
+// PeerRecord is a peer as shared in a peer exchange. The fingerprint lets
+// the receiver check that whoever answers at the addresses is that peer.
+type PeerRecord struct {
+	ID string
+	Fingerprint string
+	Addrs []string
+}
+
+// PeerExchange is the list of peers a node knows, signed with its key.
+type PeerExchange struct {
+	ID string
+	Time int64
+	Peers []PeerRecord
+	Signature []byte
+}
+
+// pexDigest returns the hash that the sender of x has to sign.
+func pexDigest(x *PeerExchange) []byte {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%d\x00", pexContext, x.ID, x.Time, len(x.Peers))
+
+	for _, p := range x.Peers {
+		fmt.Fprintf(h, "%s\x00%s\x00%d\x00", p.ID, p.Fingerprint, len(p.Addrs))
+
+		for _, addr := range p.Addrs {
+			fmt.Fprintf(h, "%s\x00", addr)
+		}
+	}
+
+	return h.Sum(nil)
+}
+
+// newPeerExchange returns the signed list of the peers known to the node
+// for peer to, connected ones first, at most pexMaxPeers of them.
+func (n *Node) newPeerExchange(to string) (x *PeerExchange, err error) {
+	x = &PeerExchange{
+		ID: n.pub.ID,
+		Time: time.Now().UnixNano(),
+	}
+
+	connected := n.ConnectedPeers()
+	known := n.peers.knownPeers()
+
+	ids := make([]string, 0, len(known))
+
+	for id := range known {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		_, ci := connected[ids[i]]
+		_, cj := connected[ids[j]]
+
+		if ci != cj {
+			return ci
+		}
+
+		return ids[i] < ids[j]
+	})
+
+	for _, id := range ids {
+		peer := known[id]
+
+		if id == to || id == n.pub.ID || n.peers.isDenied(peer) {
+			continue
+		}
+
+		var addrs []string
+
+		if addr, ok := connected[id]; ok {
+			addrs = append(addrs, addr)
+		}
+
+		for _, addr := range peer.Addrs {
+			if len(addrs) < maxPeerAddrs && (len(addrs) == 0 || addrs[0] != addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+
+		if len(addrs) == 0 {
+			continue
+		}
+
+		x.Peers = append(x.Peers, PeerRecord{
+			ID: id,
+			Fingerprint: peer.Fingerprint(),
+			Addrs: addrs,
+		})
+
+		if len(x.Peers) == pexMaxPeers {
+			break
+		}
+	}
+
+	x.Signature, err = n.signDigest(pexDigest(x))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return x, err
+}
+
+// exchangePeers exchanges peer lists with every connected peer.
+func (n *Node) exchangePeers() {
+	for id, addr := range n.ConnectedPeers() {
+		n.wg.Add(1)
+
+		go func(id, addr string) {
+			defer n.wg.Done()
+
+			err := n.sendPeerExchange(id, addr)
+
+			if err != nil {
+				n.debug("Error exchanging peers with %s: %s\n", id, err)
+			}
+		}(id, addr)
+	}
+}
+
+// sendPeerExchange sends our list to peer id and learns from its answer.
+func (n *Node) sendPeerExchange(id, addr string) (err error) {
+	c, err := n.connTo(id, addr)
+
+	if err != nil {
+		return err
+	}
+
+	x, err := n.newPeerExchange(id)
+
+	if err != nil {
+		return err
+	}
+
+	var answer PeerExchange
+
+	err = c.call(MsgPeerExchange, x, &answer, pexTimeout)
+
+	if err != nil {
+		return err
+	}
+
+	return n.learnPeers(&answer, id, addr)
+}
+
+// answerPeerExchange answers the list of the peer at the other end of the
+// session with ours, and learns from it once answered.
+func (n *Node) answerPeerExchange(r *request) (resp interface{}, err error) {
+	id := r.peer.ID
+
+	if !n.pexAllowed(id) {
+		return nil, ErrPexTooSoon
+	}
+
+	var x PeerExchange
+
+	err = r.decode(&x)
+
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := n.newPeerExchange(id)
+
+	if err != nil {
+		log.Printf("Error signing peer exchange: %s\n", err)
+		return nil, err
+	}
+
+	n.wg.Add(1)
+
+	go func() {
+		defer n.wg.Done()
+
+		err := n.learnPeers(&x, id, peerAddr(r.remIP, r.peer.Port))
+
+		if err != nil {
+			log.Printf("Rejected peer exchange from %s: %s\n", id, err)
+		}
+	}()
+
+	return answer, err
+}
+
+// pexAllowed tells whether peer id can send us its peers now, at most
+// twice every pexInterval.
+func (n *Node) pexAllowed(id string) bool {
+	n.exchangedMu.Lock()
+	defer n.exchangedMu.Unlock()
+
+	if time.Since(n.exchanged[id]) < pexInterval/2 {
+		return false
+	}
+
+	n.exchanged[id] = time.Now()
+
+	return true
+}
+
+// checkPeerExchange verifies that x was signed by the pinned key of peer id,
+// the one at the other end of the session, not long ago.
+func (n *Node) checkPeerExchange(x *PeerExchange, id string) (err error) {
+	if id == "" || x.ID != id || len(x.Peers) > pexMaxPeers {
+		return ErrBadPeerExchange
+	}
+
+	age := time.Since(time.Unix(0, x.Time))
+
+	if age > pexMaxAge || age < -pexMaxAge {
+		return ErrBadPeerExchange
+	}
+
+	peer, ok := n.SearchPeer(id)
+
+	if !ok {
+		return ErrBadPeerExchange
+	}
+
+	return verifyDigest(peer.PubKey, pexDigest(x), x.Signature)
+}
+
+// pexCandidates returns the peers of x worth dialing, with the addresses
+// that are valid for a list received from the peer at from. Peers that are
+// ourselves, denied, connected, or pinned to another key are left out, and
+// so are loopback addresses from peers on other hosts and host names, which
+// would make us resolve names chosen by the sender.
+func (n *Node) pexCandidates(x *PeerExchange, from string) (candidates []PeerRecord) {
+	fromHost, _, _ := net.SplitHostPort(from)
+	fromIP := net.ParseIP(fromHost)
+
+	connected := n.ConnectedPeers()
+
+	for _, p := range x.Peers {
+		if p.ID == n.pub.ID || checkID(p.ID) != nil || p.Fingerprint == "" {
+			continue
+		}
+
+		if _, ok := connected[p.ID]; ok {
+			continue
+		}
+
+		if n.IsDeniedID(p.ID) || n.peers.isDeniedEntry(p.Fingerprint) {
+			continue
+		}
+
+		if known, ok := n.SearchPeer(p.ID); ok && known.Fingerprint() != p.Fingerprint {
+			continue
+		}
+
+		var addrs []string
+
+		for _, addr := range p.Addrs {
+			if len(addrs) == maxPeerAddrs {
+				break
+			}
+
+			host, port, err := net.SplitHostPort(addr)
+
+			if err != nil {
+				continue
+			}
+
+			ip := net.ParseIP(host)
+			portNum, err := strconv.Atoi(port)
+
+			if ip == nil || err != nil || portNum <= 0 || portNum > 65535 {
+				continue
+			}
+
+			if ip.IsUnspecified() || ip.IsMulticast() || (ip.IsLoopback() && (fromIP == nil || !fromIP.IsLoopback())) {
+				continue
+			}
+
+			addrs = append(addrs, addr)
+		}
+
+		if len(addrs) == 0 {
+			continue
+		}
+
+		p.Addrs = addrs
+		candidates = append(candidates, p)
+
+		if len(candidates) == pexMaxNew {
+			break
+		}
+	}
+
+	return candidates
+}
+
+// learnPeers connects to the peers of the list x sent by peer id at addr.
+// Nothing in the list is trusted: peers are only connected once they prove
+// the key of their fingerprint in the handshake.
+func (n *Node) learnPeers(x *PeerExchange, id, addr string) (err error) {
+	err = n.checkPeerExchange(x, id)
+
+	if err != nil {
+		return err
+	}
+
+	for _, p := range n.pexCandidates(x, addr) {
+		if !n.discovered(p.ID) {
+			continue
+		}
+
+		for _, a := range p.Addrs {
+			_, err := n.introduce(a, func(peer *Peer) error {
+				if peer == nil || peer.ID != p.ID || peer.Fingerprint() != p.Fingerprint {
+					return ErrBadPeerExchange
+				}
+
+				return nil
+			})
+
+			if err == nil {
+				log.Printf("Connected to %s, learnt from %s\n", p.ID, id)
+				break
+			}
+
+			n.debug("Error connecting to %s at %s, learnt from %s: %s\n", p.ID, a, id, err)
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,136 @@
+package cosmofs
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPeerExchange(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+	c := newTestNode(t, "carol@cosmofs.es")
+
+	for _, n := range []*Node{a, b, c} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	// b knows both, but a and c do not know each other
+	for _, n := range []*Node{a, c} {
+		_, err := b.Connect(peerAddr("127.0.0.1", n.Port()))
+
+		if err != nil {
+			t.Fatal("Failure in Connect:", err)
+		}
+
+		// Peers are shared once their key is pinned, when they connect back
+		if !waitFor(func() bool { _, ok := b.SearchPeer(n.ID()); return ok }) {
+			t.Fatal("Failure in Connect. The peer did not connect back.")
+		}
+	}
+
+	x, err := b.newPeerExchange(a.ID())
+
+	if err != nil {
+		t.Fatal("Failure in newPeerExchange:", err)
+	}
+
+	if len(x.Peers) != 1 || x.Peers[0].ID != c.ID() || x.Peers[0].Fingerprint != c.pub.Fingerprint() {
+		t.Fatalf("Failure in newPeerExchange. Got: %+v", x.Peers)
+	}
+
+	err = a.checkPeerExchange(x, b.ID())
+
+	if err != nil {
+		t.Error("Failure in checkPeerExchange:", err)
+	}
+
+	err = a.checkPeerExchange(x, c.ID())
+
+	if err != ErrBadPeerExchange {
+		t.Error("Failure in checkPeerExchange. Accepted the list of another peer:", err)
+	}
+
+	x.Peers[0].Addrs = []string{"127.0.0.1:1"}
+
+	err = a.checkPeerExchange(x, b.ID())
+
+	if err == nil {
+		t.Error("Failure in checkPeerExchange. Accepted a tampered list.")
+	}
+
+	b.exchangePeers()
+
+	if !waitFor(func() bool { _, ok := a.ConnectedPeers()[c.ID()]; return ok }) {
+		t.Error("Failure in exchangePeers. a did not connect to c.")
+	}
+
+	if !waitFor(func() bool { _, ok := c.ConnectedPeers()[a.ID()]; return ok }) {
+		t.Error("Failure in exchangePeers. c did not connect to a.")
+	}
+
+	if a.pexAllowed(b.ID()) {
+		t.Error("Failure in pexAllowed. b can send its peers again right away.")
+	}
+}
+
+func TestPexCandidates(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b, _ := newTestPeer(t, "bob@cosmofs.es")
+
+	a.StorePeer(b)
+
+	x := &PeerExchange{
+		Peers: []PeerRecord{
+			{ID: a.ID(), Fingerprint: a.pub.Fingerprint(), Addrs: []string{"192.0.2.1:5453"}},
+			{ID: b.ID, Fingerprint: "SHA256:other", Addrs: []string{"192.0.2.2:5453"}},
+			{ID: "not an ID", Fingerprint: "SHA256:x", Addrs: []string{"192.0.2.3:5453"}},
+			{ID: "dave@cosmofs.es", Fingerprint: "SHA256:x", Addrs: []string{"evil.example.com:5453", "127.0.0.1:5453", "0.0.0.0:5453", "224.0.0.1:5453", "192.0.2.4:0"}},
+			{ID: "erin@cosmofs.es", Fingerprint: "SHA256:x", Addrs: []string{"192.0.2.5:5453", "[2001:db8::5]:5453", "192.0.2.6:5453", "192.0.2.7:5453", "192.0.2.8:5453"}},
+		},
+	}
+
+	candidates := a.pexCandidates(x, "192.0.2.9:5453")
+
+	if len(candidates) != 1 || candidates[0].ID != "erin@cosmofs.es" || len(candidates[0].Addrs) != maxPeerAddrs {
+		t.Fatalf("Failure in pexCandidates. Got: %+v", candidates)
+	}
+
+	// Loopback addresses are fine from peers on the same host
+	candidates = a.pexCandidates(x, "127.0.0.1:5453")
+
+	if len(candidates) != 2 || candidates[0].ID != "dave@cosmofs.es" || candidates[0].Addrs[0] != "127.0.0.1:5453" {
+		t.Errorf("Failure in pexCandidates. Got: %+v", candidates)
+	}
+
+	x.Peers = nil
+
+	for i := 0; i < 2*pexMaxNew; i++ {
+		x.Peers = append(x.Peers, PeerRecord{
+			ID: fmt.Sprintf("peer%d@cosmofs.es", i),
+			Fingerprint: "SHA256:x",
+			Addrs: []string{fmt.Sprintf("192.0.2.%d:5453", i+1)},
+		})
+	}
+
+	if len(a.pexCandidates(x, "192.0.2.9:5453")) != pexMaxNew {
+		t.Error("Failure in pexCandidates. More than pexMaxNew peers to dial.")
+	}
+
+	for len(x.Peers) <= pexMaxPeers {
+		x.Peers = append(x.Peers, x.Peers[0])
+	}
+
+	x.ID = b.ID
+	x.Time = time.Now().UnixNano()
+
+	if a.checkPeerExchange(x, b.ID) != ErrBadPeerExchange {
+		t.Error("Failure in checkPeerExchange. Accepted a list longer than pexMaxPeers.")
+	}
+}
@@ -0,0 +1,249 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+)
+
+// Peers agree on a protocol version and on the features both know during
+// the session handshake, so neither sends what the other cannot read.
+// Changes to the petitions, or to how File and IDTable are encoded, go
+// behind a new version or feature. Peers of the first version do not
+// negotiate: their handshake leaves both fields zero.
+const (
+	// ProtocolVersion is the version of the petitions between peers.
+	ProtocolVersion int = 2
+
+	// MinProtocolVersion is the oldest version still spoken.
+	MinProtocolVersion int = 1
+
+	tableContext string = "cosmofs-table-v1"
+
+	// downgradeSentinel ends the handshake nonce of peers which offer a
+	// version. Peers of the first version take it as random, and sign it
+	// in the transcript as any other nonce.
+	downgradeSentinel string = "cosmofs2"
+
+	// compressMinSize is the smallest body worth compressing.
+	compressMinSize int = 1024
+)
+
+// Features peers of version 2 and later can agree on.
+const (
+	FeatureCompression uint32 = 1 << iota	// bodies compressed with flate
+	FeatureChunked							// large bodies in chunks, see peerConn
+	FeatureSignedTables						// hellos signed by the owner of the table
+	FeatureDeltaSync						// hellos answered with what the peer lacks
+
+	allFeatures = FeatureCompression | FeatureChunked | FeatureSignedTables | FeatureDeltaSync
+)
+
+var (
+	ErrOldProtocol = errors.New("cosmofs: the peer speaks a protocol version no longer supported")
+	ErrBadTableSignature = newError(ErrIntegrity, "cosmofs: the table of the peer is not signed by it")
+	ErrDowngrade = newError(ErrIntegrity, "cosmofs: the protocol offer of the peer was removed on the way")
+)
+
+// offer returns the version and features the node announces in the
+// session handshake.
+func (n *Node) offer() (version int, features uint32) {
+	if n.protocol < 2 {
+		return 0, 0
+	}
+
+	return n.protocol, n.features
+}
+
+// markNonce ends nonce with downgradeSentinel when the node offers a
+// version in the handshake.
+func (n *Node) markNonce(nonce []byte) {
+	if n.protocol >= 2 {
+		copy(nonce[len(nonce)-len(downgradeSentinel):], downgradeSentinel)
+	}
+}
+
+// downgraded tells whether remote offered nothing while its nonce says it
+// knows about versions: the offer was removed on the way, before the
+// transcript could bind it.
+func (n *Node) downgraded(remote *hello) bool {
+	return n.protocol >= 2 && remote.Protocol == 0 &&
+		bytes.HasSuffix(remote.Nonce, []byte(downgradeSentinel))
+}
+
+// negotiate returns the version and features to use with a peer which
+// offered version and features in its handshake.
+func (n *Node) negotiate(version int, features uint32) (int, uint32, error) {
+	if version == 0 {
+		version, features = 1, 0
+	}
+
+	if version > n.protocol {
+		version = n.protocol
+	}
+
+	if version < MinProtocolVersion {
+		return 0, 0, ErrOldProtocol
+	}
+
+	if version < 2 {
+		return version, 0, nil
+	}
+
+	return version, features & n.features, nil
+}
+
+// tableDigest returns the hash of the directories of id in t, which id
+// signs in its hellos when FeatureSignedTables is agreed.
+func tableDigest(id string, t IDTable) []byte {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00%s\x00", tableContext, id)
+
+	dirs := make([]string, 0, len(t[id]))
+
+	for dir := range t[id] {
+		dirs = append(dirs, dir)
+	}
+
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		files := t[id][dir]
+
+		fmt.Fprintf(h, "%s\x00%d\x00", dir, len(files))
+
+		for _, f := range files {
+			if f == nil {
+				fmt.Fprintf(h, "\x00")
+				continue
+			}
+
+			fmt.Fprintf(h, "%s\x00%s\x00%d\x00%t\x00", f.GlobalPath, f.Filename, f.Size, f.IsDir)
+		}
+	}
+
+	return h.Sum(nil)
+}
+
+// newHello returns our peer and table for a peer we agreed features with.
+// With delta sync, hellos sent first carry the directories we have, and
+// answers leave out have, the ones the peer has.
+func (n *Node) newHello(features uint32, have []string) (hello HelloMessage, err error) {
+	hello = HelloMessage{Peer: *n.pub, Table: n.table.Snapshot()}
+
+	if features&FeatureDeltaSync != 0 {
+		if have != nil {
+			hello.Table = hello.Table.without(have)
+		} else {
+			hello.Have, err = n.table.ListAllDirs()
+
+			if err != nil {
+				return hello, err
+			}
+
+			// Not nil, so the peer knows we have nothing.
+			if hello.Have == nil {
+				hello.Have = []string{}
+			}
+		}
+	}
+
+	if features&FeatureSignedTables != 0 {
+		hello.Signature, err = n.signDigest(tableDigest(n.pub.ID, hello.Table))
+	}
+
+	return hello, err
+}
+
+// without returns the directories of t not in dirs, as ListAllDirs names
+// them. t is not changed.
+func (t IDTable) without(dirs []string) (delta IDTable) {
+	have := make(map[string]bool, len(dirs))
+
+	for _, dir := range dirs {
+		have[dir] = true
+	}
+
+	delta = make(IDTable)
+
+	for id, v := range t {
+		for dir, files := range v {
+			if have[filepath.Join(id, dir)] {
+				continue
+			}
+
+			if _, ok := delta[id]; !ok {
+				delta[id] = make(DirTable)
+			}
+
+			delta[id][dir] = files
+		}
+	}
+
+	return delta
+}
+
+// compressBody returns data compressed, or nil if it does not get smaller.
+func compressBody(data []byte) []byte {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+
+	if err != nil {
+		return nil
+	}
+
+	w.Write(data)
+
+	if w.Close() != nil || buf.Len() >= len(data) {
+		return nil
+	}
+
+	return buf.Bytes()
+}
+
+// decompressBody returns the body compressed in data, which cannot be
+// larger than a frame.
+func decompressBody(data []byte) (body []byte, err error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	body, err = io.ReadAll(io.LimitReader(r, int64(maxFrameSize)+1))
+
+	if err != nil {
+		return nil, ErrBadFrame
+	}
+
+	if len(body) > maxFrameSize {
+		return nil, ErrBadFrame
+	}
+
+	return body, err
+}
@@ -0,0 +1,246 @@
+package cosmofs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNegotiate(t *testing.T) {
+	n := newTestNode(t, "alice@cosmofs.es")
+
+	tests := []struct {
+		protocol int
+		features uint32
+		version int
+		agreed uint32
+	}{
+		{0, 0, 1, 0},
+		{1, allFeatures, 1, 0},
+		{2, FeatureChunked | FeatureDeltaSync, 2, FeatureChunked | FeatureDeltaSync},
+		{3, allFeatures | 1<<31, 2, allFeatures},
+	}
+
+	for _, test := range tests {
+		version, agreed, err := n.negotiate(test.protocol, test.features)
+
+		if err != nil || version != test.version || agreed != test.agreed {
+			t.Errorf("Failure in negotiate of %d %#x. Got %d %#x: %v", test.protocol, test.features, version, agreed, err)
+		}
+	}
+
+	// Nodes of the first version do not offer anything.
+	n.protocol, n.features = 1, 0
+
+	if version, features := n.offer(); version != 0 || features != 0 {
+		t.Errorf("Failure in offer. Got %d %#x", version, features)
+	}
+
+	version, agreed, err := n.negotiate(2, allFeatures)
+
+	if err != nil || version != 1 || agreed != 0 {
+		t.Errorf("Failure in negotiate. Got %d %#x: %v", version, agreed, err)
+	}
+}
+
+// newVersionNode returns a started node which speaks protocol with
+// features, sharing a large file.
+func newVersionNode(t *testing.T, id string, protocol int, features uint32) *Node {
+	n := newTestNode(t, id)
+
+	n.protocol, n.features = protocol, features
+
+	big := bytes.Repeat([]byte("shared by "+id+"\n"), 4*streamWindow/len(id))
+
+	err := os.WriteFile(filepath.Join(n.config.Share[0], "big.txt"), big, 0600)
+
+	if err != nil {
+		t.Fatal("Error writing file:", err)
+	}
+
+	// Scanned again with the new file.
+	n.table.DeleteDir(n.ID(), "out1")
+	n.config.ResetConfig = true
+
+	err = n.loadShares()
+
+	if err != nil {
+		t.Fatal("Failure in loadShares:", err)
+	}
+
+	err = n.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	return n
+}
+
+func TestProtocolCompat(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b int
+		version int
+		features uint32
+	}{
+		{"v1 to v2", 1, 2, 1, 0},
+		{"v2 to v1", 2, 1, 1, 0},
+		{"v2 to v2", 2, 2, 2, allFeatures},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			features := map[int]uint32{1: 0, 2: allFeatures}
+
+			a := newVersionNode(t, "alice@cosmofs.es", test.a, features[test.a])
+			defer a.Close()
+
+			b := newVersionNode(t, "bob@cosmofs.es", test.b, features[test.b])
+			defer b.Close()
+
+			_, err := a.Connect(peerAddr("127.0.0.1", b.Port()))
+
+			if err != nil {
+				t.Fatal("Failure in Connect:", err)
+			}
+
+			for _, n := range []*Node{a, b} {
+				for _, other := range []*Node{a, b} {
+					if len(n.Table().Files(other.ID(), "out1")) == 0 {
+						t.Errorf("Failure in Connect. %s has no files of %s.", n.ID(), other.ID())
+					}
+				}
+			}
+
+			for _, pair := range [][2]*Node{{a, b}, {b, a}} {
+				n, other := pair[0], pair[1]
+
+				c, err := n.connTo(other.ID(), peerAddr("127.0.0.1", other.Port()))
+
+				if err != nil {
+					t.Fatal("Failure in connTo:", err)
+				}
+
+				if c.sess.Protocol != test.version || c.sess.Features != test.features {
+					t.Errorf("Failure in negotiate. Got %d %#x", c.sess.Protocol, c.sess.Features)
+				}
+
+				want, _ := os.ReadFile(filepath.Join(other.config.Share[0], "big.txt"))
+
+				var content FileContent
+
+				err = c.call(MsgOpenFile, PathRequest{Path: filepath.Join(other.ID(), "out1", "big.txt")}, &content, 10*time.Second)
+
+				if err != nil || !bytes.Equal(content.Content, want) {
+					t.Errorf("Failure in call. Got %d bytes: %v", len(content.Content), err)
+				}
+			}
+		})
+	}
+}
+
+func TestSignedHello(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	hello, err := a.newHello(FeatureSignedTables|FeatureDeltaSync, nil)
+
+	if err != nil {
+		t.Fatal("Failure in newHello:", err)
+	}
+
+	if hello.Have == nil {
+		t.Error("Failure in newHello. Nothing said of our directories.")
+	}
+
+	err = b.checkHello(a.PublicPeer(), &hello, FeatureSignedTables)
+
+	if err != nil {
+		t.Error("Failure in checkHello:", err)
+	}
+
+	hello.Table[a.ID()]["forged"] = FileList{}
+
+	err = b.checkHello(a.PublicPeer(), &hello, FeatureSignedTables)
+
+	if err != ErrBadTableSignature {
+		t.Error("Failure in checkHello. Took a changed table:", err)
+	}
+
+	// Without the feature there is nothing to check.
+	err = b.checkHello(a.PublicPeer(), &hello, 0)
+
+	if err != nil {
+		t.Error("Failure in checkHello:", err)
+	}
+
+	// Answers leave out what the peer has.
+	answer, err := b.newHello(FeatureDeltaSync, []string{filepath.Join(b.ID(), "out1")})
+
+	if err != nil || len(answer.Table[b.ID()]) != 0 || answer.Have != nil {
+		t.Errorf("Failure in newHello. Got %v: %v", answer.Table, err)
+	}
+}
+
+// TestForeignTableEntries makes sure peers only publish their own
+// directories, with or without signed tables.
+func TestForeignTableEntries(t *testing.T) {
+	m := newTestNode(t, "mallory@cosmofs.es")
+	v := newTestNode(t, "victim@cosmofs.es")
+
+	m.features = allFeatures &^ FeatureSignedTables
+
+	secret := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(secret, "hostname"), []byte("secret"), 0600)
+
+	if err != nil {
+		t.Fatal("Error writing file:", err)
+	}
+
+	m.table.update(IDTable{
+		v.ID(): DirTable{"evil": FileList{{LocalPath: secret, Filename: "hostname"}}},
+		"carol@cosmofs.es": DirTable{"out1": FileList{{LocalPath: secret, Filename: "hostname"}}},
+	})
+
+	for _, n := range []*Node{m, v} {
+		err = n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	_, err = m.Connect(peerAddr("127.0.0.1", v.Port()))
+
+	if err != nil {
+		t.Fatal("Failure in Connect:", err)
+	}
+
+	content, err := v.readSharedFile(v.ID()+"/evil/hostname", "127.0.0.1")
+
+	if err == nil {
+		t.Errorf("Failure in readSharedFile. Served %q of a foreign entry.", content)
+	}
+
+	if len(v.Table().Files(v.ID(), "evil")) != 0 || len(v.Table().Files("carol@cosmofs.es", "out1")) != 0 {
+		t.Error("Failure in mergeTable. Took directories of others:", v.Table().Snapshot())
+	}
+
+	files := v.Table().Files(m.ID(), "out1")
+
+	if len(files) == 0 {
+		t.Error("Failure in mergeTable. No files of the peer.")
+	}
+
+	for _, f := range files {
+		if f.LocalPath != "" {
+			t.Error("Failure in Merge. Kept the LocalPath of a remote file:", f.LocalPath)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"log"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// reconnectAll tries to reach every known peer at its last addresses, when
+// the node starts.
+func (n *Node) reconnectAll() {
+	for id, peer := range n.peers.knownPeers() {
+		if id != n.pub.ID && len(peer.Addrs) > 0 {
+			n.scheduleReconnect(id)
+		}
+	}
+}
+
+// scheduleReconnect starts reconnecting the known peer id, unless it is
+// connected or being reconnected already.
+func (n *Node) scheduleReconnect(id string) {
+	if n.closed() {
+		return
+	}
+
+	peer, ok := n.SearchPeer(id)
+
+	if !ok || len(peer.Addrs) == 0 || !n.peers.startReconnect(id) {
+		return
+	}
+
+	n.wg.Add(1)
+
+	go n.reconnect(id)
+}
+
+// reconnect tries the addresses of id until it connects, some other way
+// connects it, it is denied or forgotten, or the node is closed. Failed
+// attempts are retried with exponential backoff and jitter.
+func (n *Node) reconnect(id string) {
+	defer n.wg.Done()
+
+	for attempt := 0; ; attempt++ {
+		peer, ok := n.SearchPeer(id)
+
+		if !ok || n.IsDeniedID(id) || !n.peers.isReconnecting(id) {
+			n.peers.stopReconnect(id)
+			return
+		}
+
+		addr, err := n.tryAddrs(peer)
+
+		if err == nil {
+			log.Printf("Reconnected to %s at %s\n", id, addr)
+			n.peers.stopReconnect(id)
+			return
+		}
+
+		delay := backoff(attempt, n.config.ReconnectMinDelay, n.config.ReconnectMaxDelay)
+
+		attempts, ok := n.peers.reconnectFailed(id, addr, err, time.Now().Add(delay))
+
+		if !ok {
+			return
+		}
+
+		n.debug("Reconnecting %s failed %d times, next in %v: %s\n", id, attempts, delay, err)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-n.done:
+			timer.Stop()
+			n.peers.stopReconnect(id)
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// tryAddrs introduces the node to peer at each of its last addresses in turn,
+// making sure the one answering holds its pinned key. It returns the address
+// that worked, or the last one tried and its error.
+func (n *Node) tryAddrs(peer *Peer) (addr string, err error) {
+	for _, addr = range peer.Addrs {
+		// Older files only kept the IP of the peer
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = peerAddr(addr, 0)
+		}
+
+		_, err = n.introduce(addr, func(p *Peer) error {
+			if p == nil {
+				return nil
+			}
+
+			if p.ID != peer.ID || !samePublicKey(p.PubKey, peer.PubKey) {
+				return ErrAuthFailed
+			}
+
+			return nil
+		})
+
+		if err == nil {
+			return addr, err
+		}
+	}
+
+	return addr, err
+}
+
+// backoff returns how long to wait after attempt failed: min doubled on every
+// attempt up to max, half of it random so peers do not retry in lockstep.
+func backoff(attempt int, min, max time.Duration) time.Duration {
+	d := max
+
+	if attempt < 32 && min<<attempt > 0 && min<<attempt < max {
+		d = min << attempt
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
@@ -0,0 +1,116 @@
+package cosmofs
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	min, max := 100*time.Millisecond, 10*time.Second
+
+	for attempt := 0; attempt < 70; attempt++ {
+		base := max
+
+		if attempt < 7 {
+			base = min << attempt
+		}
+
+		d := backoff(attempt, min, max)
+
+		if d < base/2 || d > base {
+			t.Errorf("Failure in backoff. Attempt %d waits %v", attempt, d)
+		}
+	}
+}
+
+func TestRememberAddr(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+	peer := newTestNode(t, "peer@cosmofs.es").PublicPeer()
+
+	err := n.StorePeer(peer)
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	for _, addr := range []string{"192.0.2.1:5453", "192.0.2.2:5453", "192.0.2.3:5453", "192.0.2.4:5453", "192.0.2.5:5453", "192.0.2.2:5453"} {
+		n.ConnectedPeer(peer.ID, addr)
+	}
+
+	known, _ := n.SearchPeer(peer.ID)
+	want := []string{"192.0.2.2:5453", "192.0.2.5:5453", "192.0.2.4:5453", "192.0.2.3:5453"}
+
+	if strings.Join(known.Addrs, ",") != strings.Join(want, ",") {
+		t.Errorf("Failure in ConnectedPeer. Addresses are %v", known.Addrs)
+	}
+
+	data, err := os.ReadFile(n.config.KnownPeersFile)
+
+	if err != nil || !strings.Contains(string(data), addrsPrefix+strings.Join(want, ",")) {
+		t.Errorf("Failure in ConnectedPeer. Addresses not saved: %s %v", data, err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+	b.config.ReconnectMinDelay = 10 * time.Millisecond
+	b.config.ReconnectMaxDelay = 50 * time.Millisecond
+
+	// A free port for a, which is not listening yet.
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	peer := *a.PublicPeer()
+	peer.Addrs = []string{peerAddr("127.0.0.1", port)}
+
+	b.peers.addKnown([]*Peer{&peer})
+
+	err = b.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	defer b.Close()
+
+	reconnecting := func() bool {
+		status := b.PeerStatus()
+
+		return len(status) == 1 && status[0].Reconnecting && status[0].Attempts >= 2 && status[0].LastError != ""
+	}
+
+	if !waitFor(reconnecting) {
+		t.Fatalf("Failure in reconnect. Status is %+v", b.PeerStatus())
+	}
+
+	a.config.Port = port
+
+	err = a.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	defer a.Close()
+
+	connected := func() bool {
+		status := b.PeerStatus()
+		_, err := b.Table().ExistsID(a.ID())
+
+		return err == nil && len(status) == 1 && !status[0].Reconnecting
+	}
+
+	if !waitFor(connected) {
+		t.Errorf("Failure in reconnect. Status is %+v", b.PeerStatus())
+	}
+}
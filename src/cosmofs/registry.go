@@ -0,0 +1,518 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// registry holds what a node knows about other peers: their pinned keys,
+// changed keys waiting to be accepted, the peers connected right now, those
+// being reconnected and the deny list. Petitions are served concurrently,
+// so every access goes through mu and nothing returned shares memory with
+// the maps.
+type registry struct {
+	mu sync.RWMutex
+
+	known map[string]*Peer
+	changed map[string]*Peer
+	connected map[string]*PeerStatus
+	reconnecting map[string]*PeerStatus
+	denied map[string]string
+}
+
+// PeerStatus describes a connected peer: where it is, when we last heard of
+// it and the round trip time of the last heartbeat it answered. It also
+// describes the known peers being reconnected.
+type PeerStatus struct {
+	ID string
+	Addr string
+	LastSeen time.Time
+	RTT time.Duration
+
+	// TableVersion is the version of its table the peer announced last.
+	TableVersion uint64
+
+	// Reconnecting peers are not connected. Attempts have failed so far,
+	// the last one with LastError, and the next one is at NextAttempt.
+	Reconnecting bool
+	Attempts int
+	NextAttempt time.Time
+	LastError string
+}
+
+func newRegistry() *registry {
+	return &registry{
+		known: make(map[string]*Peer),
+		changed: make(map[string]*Peer),
+		connected: make(map[string]*PeerStatus),
+		reconnecting: make(map[string]*PeerStatus),
+		denied: make(map[string]string),
+	}
+}
+
+// lookup returns the pinned identity of id. Peers are never modified once
+// stored, updates replace them.
+func (r *registry) lookup(id string) (peer *Peer, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peer, ok = r.known[id]
+
+	return peer, ok
+}
+
+// knownPeers returns a copy of the known peers.
+func (r *registry) knownPeers() map[string]*Peer {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peers := make(map[string]*Peer, len(r.known))
+
+	for id, peer := range r.known {
+		peers[id] = peer
+	}
+
+	return peers
+}
+
+// addKnown stores peers read from the known peers file.
+func (r *registry) addKnown(peers []*Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range peers {
+		r.known[peer.ID] = peer
+	}
+}
+
+// pin stores a new peer, trust on first use. A different key for a known ID
+// is kept aside as changed and ErrKeyChanged is returned with the pinned
+// identity. isNew tells whether the peer was not known before.
+func (r *registry) pin(peer *Peer) (known *Peer, isNew bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	known, ok := r.known[peer.ID]
+
+	if !ok {
+		r.known[peer.ID] = peer
+		return peer, true, err
+	}
+
+	if !samePublicKey(known.PubKey, peer.PubKey) {
+		r.changed[peer.ID] = peer
+		return known, false, ErrKeyChanged
+	}
+
+	return known, false, err
+}
+
+// acceptChanged pins the changed key of id in place of the known one.
+func (r *registry) acceptChanged(id string) (peer *Peer, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	peer, ok = r.changed[id]
+
+	if ok {
+		r.known[id] = peer
+		delete(r.changed, id)
+	}
+
+	return peer, ok
+}
+
+// fingerprints lists the known peers sorted by ID.
+func (r *registry) fingerprints() (list []PeerFingerprint) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for id, peer := range r.known {
+		fp := PeerFingerprint{
+			ID: id,
+			Fingerprint: peer.Fingerprint(),
+		}
+
+		if changed, ok := r.changed[id]; ok {
+			fp.Pending = changed.Fingerprint()
+		}
+
+		list = append(list, fp)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list
+}
+
+// importPeers adds or updates known peers, refusing changed keys.
+func (r *registry) importPeers(peers []*Peer) (added, updated int, conflicts []*Peer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, peer := range peers {
+		known, ok := r.known[peer.ID]
+
+		switch {
+		case !ok:
+			r.known[peer.ID] = peer
+			added++
+		case samePublicKey(known.PubKey, peer.PubKey):
+			update := *known
+			update.Addrs = peer.Addrs
+			update.Comment = peer.Comment
+			r.known[peer.ID] = &update
+			updated++
+		default:
+			conflicts = append(conflicts, known)
+		}
+	}
+
+	return added, updated, conflicts
+}
+
+// forget removes peer from the known peers if its key is the pinned one.
+func (r *registry) forget(peer *Peer) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	known, ok := r.known[peer.ID]
+
+	if !ok || !samePublicKey(known.PubKey, peer.PubKey) {
+		return false
+	}
+
+	delete(r.known, peer.ID)
+
+	return true
+}
+
+// connect marks id as connected from addr and seen right now.
+func (r *registry) connect(id, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.connected[id]
+
+	if !ok {
+		status = &PeerStatus{ID: id}
+		r.connected[id] = status
+	}
+
+	status.Addr = addr
+	status.LastSeen = time.Now()
+
+	delete(r.reconnecting, id)
+}
+
+// rememberAddr puts addr first in the addresses of the known peer id, keeping
+// maxPeerAddrs of them. It returns false if nothing changed.
+func (r *registry) rememberAddr(id, addr string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	known, ok := r.known[id]
+
+	if !ok || (len(known.Addrs) > 0 && known.Addrs[0] == addr) {
+		return false
+	}
+
+	addrs := []string{addr}
+
+	for _, a := range known.Addrs {
+		if a != addr && len(addrs) < maxPeerAddrs {
+			addrs = append(addrs, a)
+		}
+	}
+
+	update := *known
+	update.Addrs = addrs
+	r.known[id] = &update
+
+	return true
+}
+
+// startReconnect marks id as being reconnected. It returns false if it is
+// connected or being reconnected already.
+func (r *registry) startReconnect(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, connected := r.connected[id]
+	_, reconnecting := r.reconnecting[id]
+
+	if connected || reconnecting {
+		return false
+	}
+
+	r.reconnecting[id] = &PeerStatus{ID: id, Reconnecting: true}
+
+	return true
+}
+
+// reconnectFailed records a failed attempt to reconnect id at addr and when
+// the next one is due. It returns the number of attempts so far, and false
+// if id is not being reconnected anymore.
+func (r *registry) reconnectFailed(id, addr string, err error, next time.Time) (attempts int, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.reconnecting[id]
+
+	if !ok {
+		return 0, false
+	}
+
+	status.Addr = addr
+	status.Attempts++
+	status.NextAttempt = next
+	status.LastError = err.Error()
+
+	return status.Attempts, ok
+}
+
+// stopReconnect tells the reconnection of id to give up.
+func (r *registry) stopReconnect(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.reconnecting, id)
+}
+
+// isReconnecting reports whether id is still being reconnected.
+func (r *registry) isReconnecting(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.reconnecting[id]
+
+	return ok
+}
+
+// seen records that a connected peer is alive. A round trip time of zero
+// keeps the last one measured. It returns false if id is not connected.
+func (r *registry) seen(id string, rtt time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.connected[id]
+
+	if !ok {
+		return false
+	}
+
+	status.LastSeen = time.Now()
+
+	if rtt > 0 {
+		status.RTT = rtt
+	}
+
+	return true
+}
+
+// sameTable tells whether id is connected from addr and already announced
+// version of its table, which is then taken as a sign of life.
+func (r *registry) sameTable(id, addr string, version uint64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status, ok := r.connected[id]
+
+	if !ok || version == 0 || status.Addr != addr || status.TableVersion != version {
+		return false
+	}
+
+	status.LastSeen = time.Now()
+
+	return true
+}
+
+// setTableVersion records the table version announced by a connected peer.
+func (r *registry) setTableVersion(id string, version uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if status, ok := r.connected[id]; ok {
+		status.TableVersion = version
+	}
+}
+
+// expired returns the connected peers not seen for longer than timeout.
+func (r *registry) expired(timeout time.Duration) (ids []string) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for id, status := range r.connected {
+		if time.Since(status.LastSeen) > timeout {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// status lists the connected peers and those being reconnected, sorted by
+// ID.
+func (r *registry) status() (list []PeerStatus) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, status := range r.connected {
+		list = append(list, *status)
+	}
+
+	for _, status := range r.reconnecting {
+		list = append(list, *status)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+
+	return list
+}
+
+func (r *registry) disconnect(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.connected, id)
+}
+
+// connectedAddr returns the address of a connected peer.
+func (r *registry) connectedAddr(id string) (addr string, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	status, ok := r.connected[id]
+
+	if !ok {
+		return "", false
+	}
+
+	return status.Addr, ok
+}
+
+// connectedPeers returns a copy of the ID to address map of connected peers.
+func (r *registry) connectedPeers() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	peers := make(map[string]string, len(r.connected))
+
+	for id, status := range r.connected {
+		peers[id] = status.Addr
+	}
+
+	return peers
+}
+
+// isDenied reports whether the ID or the key of peer are denied.
+func (r *registry) isDenied(peer *Peer) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.isDeniedLocked(peer)
+}
+
+func (r *registry) isDeniedLocked(peer *Peer) bool {
+	if _, ok := r.denied[peer.ID]; ok {
+		return true
+	}
+
+	_, ok := r.denied[peer.Fingerprint()]
+
+	return ok
+}
+
+// isDeniedID reports whether id, or the key pinned for it, is denied.
+func (r *registry) isDeniedID(id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if _, ok := r.denied[id]; ok {
+		return true
+	}
+
+	if peer, ok := r.known[id]; ok {
+		return r.isDeniedLocked(peer)
+	}
+
+	return false
+}
+
+// isDeniedEntry reports whether an ID or a key fingerprint is in the deny
+// list itself.
+func (r *registry) isDeniedEntry(entry string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, ok := r.denied[entry]
+
+	return ok
+}
+
+// deny adds entry to the deny list. isNew is false if it was already there.
+// New entries are refused once the list has maxDeniedPeers.
+func (r *registry) deny(entry, reason string) (isNew bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.denied[entry]
+
+	if !ok && len(r.denied) >= maxDeniedPeers {
+		return false, ErrDenyListFull
+	}
+
+	r.denied[entry] = reason
+
+	return !ok, err
+}
+
+func (r *registry) allow(entry string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.denied[entry]
+	delete(r.denied, entry)
+
+	return ok
+}
+
+// deniedEntries returns a copy of the deny list.
+func (r *registry) deniedEntries() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	denied := make(map[string]string, len(r.denied))
+
+	for entry, reason := range r.denied {
+		denied[entry] = reason
+	}
+
+	return denied
+}
@@ -0,0 +1,101 @@
+package cosmofs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestRegistryConcurrent(t *testing.T) {
+	n := newTestNode(t, "node@cosmofs.es")
+
+	const workers = 8
+	const rounds = 20
+
+	peers := make([][]*Peer, workers)
+
+	for w := range peers {
+		for i := 0; i < rounds; i++ {
+			peer, _ := newTestPeer(t, fmt.Sprintf("peer%d.%d@cosmofs.es", w, i))
+			peers[w] = append(peers[w], peer)
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+
+		// Handshakes
+		go func(w int) {
+			defer wg.Done()
+
+			for _, peer := range peers[w] {
+				err := n.StorePeer(peer)
+
+				if err != nil {
+					t.Error("Failure in StorePeer:", err)
+				}
+
+				n.ConnectedPeer(peer.ID, "192.0.2.1")
+
+				if w%2 == 0 {
+					n.DisconnectedPeer(peer.ID)
+				}
+			}
+		}(w)
+
+		// Clients listing and checking peers meanwhile
+		go func(w int) {
+			defer wg.Done()
+
+			for _, peer := range peers[w] {
+				n.ListFingerprints()
+				n.ExportPeers()
+				n.IsDeniedID(peer.ID)
+				n.SearchPeer(peer.ID)
+
+				for id := range n.ConnectedPeers() {
+					n.IsDeniedID(id)
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	if len(n.ListFingerprints()) != workers*rounds {
+		t.Error("Failure in StorePeer. Peers lost:", len(n.ListFingerprints()))
+	}
+
+	if len(n.ConnectedPeers()) != workers/2*rounds {
+		t.Error("Failure in ConnectedPeer. Wrong connected peers:", len(n.ConnectedPeers()))
+	}
+
+	peers2, err := parseKnownPeers(n.ExportPeers())
+
+	if err != nil || len(peers2) != workers*rounds {
+		t.Error("Failure in ExportPeers:", len(peers2), err)
+	}
+
+	// Denying while peers connect
+	wg.Add(workers)
+
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+
+			for _, peer := range peers[w] {
+				n.ConnectedPeer(peer.ID, "192.0.2.1")
+				n.DenyPeer(peer.Fingerprint(), "")
+				n.CheckDenied(peer)
+			}
+		}(w)
+	}
+
+	wg.Wait()
+
+	if len(n.ConnectedPeers()) != 0 || len(n.ListDenied()) != workers*rounds {
+		t.Error("Failure in DenyPeer. Denied peers still connected:", len(n.ConnectedPeers()))
+	}
+}
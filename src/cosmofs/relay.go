@@ -0,0 +1,380 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRelayRate is the bandwidth, in bytes per second, shared by all
+	// the streams a node relays.
+	DefaultRelayRate int = 1 << 20
+
+	// relayMaxStreams bounds the streams relayed at the same time, and
+	// relayIdleTimeout how long they can go without traffic.
+	relayMaxStreams int = 8
+	relayIdleTimeout time.Duration = 2 * time.Minute
+
+	relayBufferSize int = 32 * 1024
+)
+
+var (
+	ErrRelayDisabled = errors.New("cosmofs: the peer does not relay streams")
+	ErrRelayBusy = errors.New("cosmofs: the peer is relaying too many streams")
+	ErrNoRelay = newError(ErrPeerOffline, "cosmofs: no connected peer can relay a stream to the peer")
+)
+
+// relayRequest asks a peer to relay a stream to peer To.
+type relayRequest struct {
+	To string
+}
+
+// relayOpen tells the peer at the end of a relayed stream who is at the
+// other end.
+type relayOpen struct {
+	From string
+}
+
+// rateLimiter is a token bucket of rate bytes per second, with a burst of
+// one second worth of them.
+type rateLimiter struct {
+	mu sync.Mutex
+	rate float64
+	tokens float64
+	last time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{
+		rate: float64(rate),
+		tokens: float64(rate),
+		last: time.Now(),
+	}
+}
+
+// wait blocks until size bytes can be sent.
+func (l *rateLimiter) wait(size int) {
+	l.mu.Lock()
+
+	now := time.Now()
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+
+	l.last = now
+	l.tokens -= float64(size)
+
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// dialOwner returns a connection with peer id to ask for its files: the
+// one shared with it if it is connected, otherwise one relayed by another
+// connected peer, which has to be released. Legacy peers get a plain TCP
+// connection instead.
+func (n *Node) dialOwner(id string) (c *peerConn, legacy io.ReadWriteCloser, err error) {
+	addr, ok := n.peers.connectedAddr(id)
+
+	if !ok {
+		c, err = n.dialRelayed(id)
+		return c, nil, err
+	}
+
+	c, err = n.connTo(id, addr)
+
+	switch err {
+	case nil:
+		return c, nil, err
+	case ErrLegacyPeer:
+		legacy, err = n.dialPeer(addr)
+		return nil, legacy, err
+	case ErrAuthFailed, ErrKeyChanged, ErrPeerDenied:
+		return nil, nil, err
+	}
+
+	log.Printf("Error dialing %s at %s, trying a relay: %s\n", id, addr, err)
+
+	c, err = n.dialRelayed(id)
+
+	return c, nil, err
+}
+
+// dialRelayed asks the connected peers, in turn, to relay a stream to id.
+func (n *Node) dialRelayed(id string) (c *peerConn, err error) {
+	err = ErrNoRelay
+
+	for via := range n.ConnectedPeers() {
+		if via == id {
+			continue
+		}
+
+		var s *Session
+
+		s, err = n.dialRelay(via, id)
+
+		if err == nil {
+			log.Printf("Reaching %s through %s\n", id, via)
+
+			c = n.newPeerConn(s, via, nil)
+			n.runConn(c)
+
+			return c, err
+		}
+
+		n.debug("Error relaying to %s through %s: %s\n", id, via, err)
+	}
+
+	return nil, err
+}
+
+// dialRelay asks the connected peer via to relay a stream to id, and
+// negotiates a session with id through it. The relay only sees the records
+// of that session, which are encrypted and authenticated end to end.
+func (n *Node) dialRelay(via, id string) (s *Session, err error) {
+	addr, ok := n.peers.connectedAddr(via)
+
+	if !ok {
+		return nil, ErrPeerOffline
+	}
+
+	rw, err := n.dialPeer(addr)
+
+	if err != nil {
+		return nil, err
+	}
+
+	outer, ok := rw.(*Session)
+
+	if !ok || outer.Peer.ID != via {
+		rw.Close()
+		return nil, ErrAuthFailed
+	}
+
+	outer.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	// Once answered, the session carries the stream to the peer.
+	err = Call(outer, MsgRelay, relayRequest{To: id}, nil)
+
+	if err == nil {
+		s, err = n.handshake(outer, bufio.NewReader(outer), true)
+	}
+
+	if err == nil {
+		err = n.CheckPeer(s.Peer)
+
+		if err == nil && s.Peer.ID != id {
+			err = ErrAuthFailed
+		}
+	}
+
+	if err != nil {
+		outer.Close()
+		return nil, err
+	}
+
+	return s, err
+}
+
+// answerRelay relays a stream from the peer at the other end of the
+// session to the connected peer it asks for, if relaying is enabled.
+func (n *Node) answerRelay(r *request) (resp interface{}, err error) {
+	var req relayRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sess := r.rw.(*Session)
+
+	to, err := n.openRelay(sess.Peer.ID, req.To)
+
+	if err != nil {
+		n.debug("Refusing to relay %s to %s: %s\n", sess.Peer.ID, req.To, err)
+		return nil, err
+	}
+
+	defer func() { <-n.relaySlots }()
+	defer to.Close()
+
+	err = writeFrame(sess, Header{Type: MsgRelay, Flags: flagResponse, ID: r.ID}, nil)
+
+	if err != nil {
+		n.debug("Error answering relay request: %s\n", err)
+		return nil, errTakenOver
+	}
+
+	log.Printf("Relaying %s to %s\n", sess.Peer.ID, req.To)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		n.pipe(to, sess, sess)
+		to.Close()
+	}()
+
+	n.pipe(sess, to, to)
+	sess.Close()
+
+	wg.Wait()
+
+	log.Printf("Finished relaying %s to %s\n", sess.Peer.ID, req.To)
+
+	return nil, errTakenOver
+}
+
+// openRelay takes a relay slot and opens the stream to peer to on behalf of
+// peer from. The slot is kept when the stream is returned.
+func (n *Node) openRelay(from, to string) (s *Session, err error) {
+	if n.relaySlots == nil {
+		return nil, ErrRelayDisabled
+	}
+
+	if _, ok := n.peers.connectedAddr(from); !ok || n.IsDeniedID(to) {
+		return nil, ErrRelayDisabled
+	}
+
+	addr, ok := n.peers.connectedAddr(to)
+
+	if !ok {
+		return nil, ErrPeerOffline
+	}
+
+	select {
+	case n.relaySlots <- struct{}{}:
+	default:
+		return nil, ErrRelayBusy
+	}
+
+	rw, err := n.dialPeer(addr)
+
+	if err == nil {
+		var ok bool
+
+		s, ok = rw.(*Session)
+
+		if !ok || s.Peer.ID != to {
+			rw.Close()
+			err = ErrAuthFailed
+		}
+	}
+
+	if err == nil {
+		// Not answered: the stream follows right away.
+		err = writeFrame(s, Header{Type: MsgRelayOpen, ID: requestIDs.Add(1)}, relayOpen{From: from})
+
+		if err != nil {
+			s.Close()
+		}
+	}
+
+	if err != nil {
+		<-n.relaySlots
+		return nil, err
+	}
+
+	return s, err
+}
+
+// pipe copies src into dst within the bandwidth of the node, until either
+// fails or src goes quiet for relayIdleTimeout. from is the session src
+// reads from.
+func (n *Node) pipe(dst io.Writer, src io.Reader, from *Session) {
+	buf := make([]byte, relayBufferSize)
+
+	for {
+		from.SetReadDeadline(time.Now().Add(relayIdleTimeout))
+
+		size, err := src.Read(buf)
+
+		if size > 0 {
+			n.relayLimit.wait(size)
+
+			_, werr := dst.Write(buf[:size])
+
+			if werr != nil {
+				return
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answerRelayed serves a stream relayed by the peer at the other end of
+// the session: a session is negotiated with the peer at the other end of the
+// stream, which can then open our files.
+func (n *Node) answerRelayed(r *request) (resp interface{}, err error) {
+	var open relayOpen
+
+	err = r.decode(&open)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sess := r.rw.(*Session)
+
+	inner, err := n.AcceptSession(sess, bufio.NewReader(sess))
+
+	if err == nil && inner.Peer.ID != open.From {
+		err = ErrAuthFailed
+	}
+
+	if err == nil {
+		err = n.CheckDenied(inner.Peer)
+	}
+
+	if err == nil {
+		err = n.CheckPeer(inner.Peer)
+	}
+
+	if err != nil {
+		log.Printf("Refusing stream of %s relayed by %s: %s\n", open.From, sess.Peer.ID, err)
+		return nil, errTakenOver
+	}
+
+	n.newPeerConn(inner, sess.Peer.ID, relayedHandlers).run()
+
+	return nil, errTakenOver
+}
@@ -0,0 +1,103 @@
+package cosmofs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+
+	start := time.Now()
+
+	// The burst goes right away, the rest at the rate
+	l.wait(1000)
+	l.wait(500)
+
+	elapsed := time.Since(start)
+
+	if elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Error("Failure in rateLimiter. 1500 bytes at 1000 B/s took", elapsed)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+	c := newTestNode(t, "carol@cosmofs.es")
+
+	for _, n := range []*Node{a, b, c} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	// a and c only know b
+	for _, n := range []*Node{a, c} {
+		_, err := b.Connect(peerAddr("127.0.0.1", n.Port()))
+
+		if err != nil {
+			t.Fatal("Failure in Connect:", err)
+		}
+
+		if !waitFor(func() bool { _, ok := n.ConnectedPeers()[b.ID()]; return ok }) {
+			t.Fatal("Failure in Connect. The peer did not connect back.")
+		}
+	}
+
+	_, err := a.dialRelay(b.ID(), c.ID())
+
+	if err == nil || !strings.Contains(err.Error(), ErrRelayDisabled.Error()) {
+		t.Error("Failure in dialRelay. Relayed by a node that does not relay:", err)
+	}
+
+	b.relaySlots = make(chan struct{}, relayMaxStreams)
+	b.relayLimit = newRateLimiter(DefaultRelayRate)
+
+	_, err = a.dialRelay(b.ID(), "dave@cosmofs.es")
+
+	if err == nil || !strings.Contains(err.Error(), ErrPeerOffline.Error()) {
+		t.Error("Failure in dialRelay. Relayed to a peer that is not connected:", err)
+	}
+
+	var content FileContent
+
+	localPetition(t, a, MsgLocalOpenFile, PathRequest{Path: c.ID() + "/out1/shared.txt"}, &content)
+
+	if string(content.Content) != "shared by "+c.ID() {
+		t.Errorf("Failure in Open File through a relay. Got: %q", content.Content)
+	}
+
+	if !waitFor(func() bool { return len(b.relaySlots) == 0 }) {
+		t.Error("Failure in answerRelay. The relay slot was not released.")
+	}
+
+	s, err := a.dialRelay(b.ID(), c.ID())
+
+	if err != nil {
+		t.Fatal("Failure in dialRelay:", err)
+	}
+
+	defer s.Close()
+
+	if s.Peer.ID != c.ID() || s.Peer.Fingerprint() != c.pub.Fingerprint() {
+		t.Error("Failure in dialRelay. The session is not with c:", s.Peer.ID)
+	}
+
+	// Only files can be asked for through a relay
+	s.SetDeadline(time.Now().Add(5 * time.Second))
+
+	err = Call(s, MsgHello, HelloMessage{Peer: *a.pub, Table: a.table.Snapshot()}, nil)
+
+	var e *WireError
+
+	if !errors.As(err, &e) || e.Code != CodeUnknownType {
+		t.Error("Failure in answerRelayed. Served a request other than Open File:", err)
+	}
+}
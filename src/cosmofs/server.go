@@ -0,0 +1,622 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrSelfConnect = errors.New("cosmofs: the peer is this node")
+
+// peerAddr returns the address of a peer listening on port at ip. Legacy
+// peers do not advertise their port, they all use DefaultPort.
+func peerAddr(ip string, port int) string {
+	if port == 0 {
+		port = DefaultPort
+	}
+
+	return net.JoinHostPort(ip, strconv.Itoa(port))
+}
+
+// dialPeer opens an encrypted session with the peer at host:port. Plain TCP
+// is only used for legacy peers when Insecure is set.
+func (n *Node) dialPeer(hostport string) (rw io.ReadWriteCloser, err error) {
+	addr, err := net.ResolveTCPAddr("tcp", hostport)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := n.DialSession(addr)
+
+	if err == nil {
+		return sess, err
+	}
+
+	if err == ErrLegacyPeer && len(n.networks) > 0 {
+		return nil, ErrNoSharedNetwork
+	}
+
+	if err == ErrLegacyPeer && n.config.Insecure {
+		log.Printf("Peer %s does not support encrypted sessions, using plain TCP\n", hostport)
+
+		conn, err := net.DialTCP("tcp", nil, addr)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return conn, err
+	}
+
+	if err == ErrLegacyPeer {
+		return nil, fmt.Errorf("%w (run with -insecure to allow it)", err)
+	}
+
+	return nil, err
+}
+
+// Handles petitions from the peers.
+func (n *Node) handleTCPPetition (conn *net.TCPConn) {
+	defer conn.Close()
+
+	remIP, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	n.debug("Connection made from: %s\n", conn.RemoteAddr())
+
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+
+	if err != nil && err != io.EOF {
+		n.debug("Error reading connection: %s", err)
+		return
+	}
+
+	line = strings.TrimRight(line, "\n")
+
+	// Everything but legacy peers negotiates an encrypted session first, and
+	// the requests come framed through it.
+	if line != SessionPreamble {
+		if !n.config.Insecure {
+			log.Printf("Refusing unencrypted petition from legacy peer %s (run with -insecure to allow it)\n", remIP)
+			return
+		}
+
+		if len(n.networks) > 0 {
+			log.Printf("Refusing unencrypted petition from legacy peer %s: %s\n", remIP, ErrNoSharedNetwork)
+			return
+		}
+
+		n.serveLegacy(conn, reader, line, remIP)
+		return
+	}
+
+	sess, err := n.AcceptSession(conn, reader)
+
+	if err != nil {
+		log.Printf("Error negotiating session with %s: %s\n", remIP, err)
+		return
+	}
+
+	n.debug("Session established with %s\n", sess.Peer.ID)
+
+	err = n.CheckDenied(sess.Peer)
+
+	// Keys other than the pinned one are refused before anything is
+	// served. StorePeer warns and keeps the key aside for the user.
+	if err == nil && n.CheckPeer(sess.Peer) != nil {
+		err = n.StorePeer(sess.Peer)
+	}
+
+	if err != nil {
+		log.Printf("Refusing peer %s from %s: %s\n", sess.Peer.ID, remIP, err)
+		return
+	}
+
+	n.servePeer(sess, remIP)
+}
+
+// servePeer serves the session of a peer. Relays are asked for in a session
+// of their own, the rest is the connection shared with the peer.
+func (n *Node) servePeer(sess *Session, remIP string) {
+	sess.SetReadDeadline(time.Now().Add(n.config.PeerTimeout))
+
+	h, body, err := readFrame(sess, frameLimit(sess.Features))
+
+	if err != nil {
+		n.debug("Error reading request from %s: %s\n", remIP, err)
+		return
+	}
+
+	if _, ok := streamHandlers[h.Type]; ok {
+		sess.SetReadDeadline(time.Time{})
+
+		n.serveRequest(&request{
+			Header: h,
+			body: body,
+			rw: sess,
+			peer: sess.Peer,
+			remIP: remIP,
+		}, streamHandlers)
+
+		return
+	}
+
+	c := n.newPeerConn(sess, remIP, peerHandlers)
+
+	if sess.Peer.ID != n.pub.ID {
+		n.shareConn(c)
+	}
+
+	err = c.handle(h, body)
+
+	if err != nil {
+		c.close(err)
+		return
+	}
+
+	c.run()
+}
+
+// dialConn opens a connection with the peer at addr and shares it, unless
+// there is one with that peer already, which is returned instead. Legacy
+// peers get a plain TCP connection.
+// check, if not nil, is given the peer proved by the session handshake
+// before the connection is shared; if it fails the session is closed.
+func (n *Node) dialConn(addr string, check func(peer *Peer) error) (c *peerConn, legacy io.ReadWriteCloser, err error) {
+	rw, err := n.dialPeer(addr)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sess, ok := rw.(*Session)
+
+	if !ok {
+		return nil, rw, err
+	}
+
+	if sess.Peer.ID == n.pub.ID {
+		sess.Close()
+		return nil, nil, ErrSelfConnect
+	}
+
+	err = n.CheckPeer(sess.Peer)
+
+	// Refused as when accepting it: StorePeer warns and keeps the changed
+	// key aside for the user.
+	if err != nil {
+		err = n.StorePeer(sess.Peer)
+		sess.Close()
+		return nil, nil, err
+	}
+
+	if check != nil {
+		err = check(sess.Peer)
+
+		if err != nil {
+			sess.Close()
+			return nil, nil, err
+		}
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+
+	c = n.newPeerConn(sess, host, peerHandlers)
+	c.dialed = true
+
+	if shared := n.shareConn(c); shared != c {
+		c.Close()
+		return shared, nil, err
+	}
+
+	n.runConn(c)
+
+	return c, nil, err
+}
+
+// connTo returns the connection shared with peer id, dialing it at addr if
+// there is none. Legacy peers cannot share one.
+func (n *Node) connTo(id, addr string) (c *peerConn, err error) {
+	n.connsMu.Lock()
+	c, ok := n.conns[id]
+	n.connsMu.Unlock()
+
+	// The key pinned may have changed since
+	if ok && n.CheckPeer(c.peer) != nil {
+		c.Close()
+		ok = false
+	}
+
+	if !ok {
+		var legacy io.ReadWriteCloser
+
+		c, legacy, err = n.dialConn(addr, func(peer *Peer) error {
+			if peer.ID != id {
+				return ErrAuthFailed
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if legacy != nil {
+			legacy.Close()
+			return nil, ErrLegacyPeer
+		}
+	}
+
+	return c, n.CheckDenied(c.peer)
+}
+
+// checkHello makes sure the peer introduced in a hello is the one proved
+// by the session, and that it signed its table if agreed, and stores it.
+func (n *Node) checkHello(proved *Peer, hello *HelloMessage, features uint32) (err error) {
+	peer := &hello.Peer
+
+	if proved == nil || peer.ID != proved.ID || !samePublicKey(peer.PubKey, proved.PubKey) {
+		return ErrAuthFailed
+	}
+
+	if features&FeatureSignedTables != 0 {
+		if verifyDigest(proved.PubKey, tableDigest(peer.ID, hello.Table), hello.Signature) != nil {
+			return ErrBadTableSignature
+		}
+	}
+
+	return n.StorePeer(peer)
+}
+
+// answerHello takes the peer introducing itself and its table, and answers
+// with our own peer and table through the same connection: the peer may
+// not be reachable from here.
+func (n *Node) answerHello(r *request) (resp interface{}, err error) {
+	var hello HelloMessage
+
+	err = r.decode(&hello)
+
+	if err != nil {
+		return nil, err
+	}
+
+	peer := &hello.Peer
+
+	err = n.checkHello(r.peer, &hello, r.features)
+
+	if err != nil {
+		log.Printf("Rejecting peer %s from %s: %s\n", peer.ID, r.remIP, err)
+		return nil, err
+	}
+
+	n.ConnectedPeer(peer.ID, peerAddr(r.remIP, peer.Port))
+
+	log.Printf("CONNECTED: %v\n", n.ConnectedPeers())
+
+	n.debug("List of Peers: %v\n", n.peers.knownPeers())
+
+	n.mergeTable(peer.ID, hello.Table, r.rw)
+
+	return n.newHello(r.features, hello.Have)
+}
+
+// answerOpenFile sends the content of a shared file of ours to the peer.
+func (n *Node) answerOpenFile(r *request) (resp interface{}, err error) {
+	if n.IsDeniedID(r.peer.ID) {
+		log.Printf("Refusing to serve file to denied peer at %s\n", r.remIP)
+		return nil, ErrPeerDenied
+	}
+
+	var req PathRequest
+
+	err = r.decode(&req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := n.readSharedFile(req.Path, r.remIP)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return FileContent{Content: content}, err
+}
+
+// answerRevocation applies the revocation sent by a peer and passes it on,
+// so it reaches the peers that sender does not know.
+func (n *Node) answerRevocation(r *request) (resp interface{}, err error) {
+	var rev Revocation
+
+	err = r.decode(&rev)
+
+	if err != nil {
+		return nil, err
+	}
+
+	isNew, err := n.ApplyRevocation(&rev)
+
+	if err != nil {
+		log.Printf("Error applying revocation of %s from %s: %s\n", rev.ID, r.remIP, err)
+		return nil, err
+	}
+
+	if isNew {
+		n.wg.Add(1)
+
+		go func() {
+			defer n.wg.Done()
+
+			n.publishRevocation(&rev)
+		}()
+	}
+
+	return nil, err
+}
+
+// mergeTable merges the table sent by the peer id at the other end of rw
+// into ours and refreshes the config files. Only peers of our networks are
+// listened to, and only about their own directories.
+func (n *Node) mergeTable(id string, t IDTable, rw io.ReadWriter) {
+	if !n.sharesNetwork(rw) {
+		log.Printf("Ignoring table of %s: %s\n", id, ErrNoSharedNetwork)
+		return
+	}
+
+	log.Printf("REMOTE TABLE: %v\n", t)
+
+	if strings.EqualFold(id, n.pub.ID) || t[id] == nil {
+		return
+	}
+
+	n.table.Merge(IDTable{id: t[id]})
+
+	n.refreshOnline()
+	n.encodeConfigFiles()
+
+	n.PrintTable()
+}
+
+// remotePeerID returns the ID of the peer at the other end of rw: the one
+// authenticated by the session or, for legacy peers, the one connected from
+// ip.
+func (n *Node) remotePeerID(rw io.ReadWriter, ip string) string {
+	if sess, ok := rw.(*Session); ok {
+		return sess.Peer.ID
+	}
+
+	for id, addr := range n.ConnectedPeers() {
+		if host, _, _ := net.SplitHostPort(addr); host == ip {
+			return id
+		}
+	}
+
+	return ""
+}
+
+// publishRevocation sends a revocation statement to every connected peer.
+// Legacy peers do not know about revocations.
+func (n *Node) publishRevocation(r *Revocation) {
+	for id, ip := range n.ConnectedPeers() {
+		c, err := n.connTo(id, ip)
+
+		if err == nil {
+			err = c.call(MsgRevocation, r, nil, n.config.PeerTimeout)
+		}
+
+		if err != nil && err != ErrLegacyPeer {
+			log.Printf("Error sending revocation to %s: %s\n", id, err)
+		}
+	}
+}
+
+// handleUDPPetition answers the beacon of a peer.
+func (n *Node) handleUDPPetition (data []byte, remoteIP *net.UDPAddr) {
+	b, err := parseBeacon(data)
+
+	if err != nil {
+		n.debug("Ignoring announcement from %s: %s\n", remoteIP, err)
+		return
+	}
+
+	n.handleBeacon(b, remoteIP)
+}
+
+// handleBeacon introduces ourselves over TCP to the peer that sent b from
+// remoteIP, on the port it advertised, however the beacon arrived. Nothing
+// is done until the beacon is known to be genuine.
+func (n *Node) handleBeacon(b *Beacon, remoteIP *net.UDPAddr) {
+	// Link-local IPv6 addresses need the zone to be dialed.
+	remIP, _, _ := net.SplitHostPort(remoteIP.String())
+
+	if n.ownAnnouncement(b.ID, b.Port, remoteIP.IP) {
+		return
+	}
+
+	err := n.checkBeacon(b)
+
+	if err != nil {
+		log.Printf("Ignoring announcement of %s from %s: %s\n", b.ID, remIP, err)
+		return
+	}
+
+	addr := peerAddr(remIP, b.Port)
+
+	// Nothing new since its last beacon
+	if n.peers.sameTable(b.ID, addr, b.TableVersion) || !n.discovered(b.ID) {
+		return
+	}
+
+	log.Printf("Announcement of %s from %s\n", b.ID, remIP)
+
+	// Beacons of unknown peers are verified with the key they proved in
+	// the handshake.
+	id, err := n.introduce(addr, func(peer *Peer) error {
+		if b.Version == 0 {
+			return nil
+		}
+
+		return b.verify(peer)
+	})
+
+	if err != nil {
+		log.Printf("Error answering announcement of %s from %s: %s\n", b.ID, remIP, err)
+		return
+	}
+
+	// Legacy peers are taken at their word
+	if id == "" {
+		n.ConnectedPeer(b.ID, addr)
+	}
+
+	n.peers.setTableVersion(b.ID, b.TableVersion)
+}
+
+// Connect introduces the node to the peer listening on hostport, the same
+// way announcements are answered: the peer answers with its own table.
+// It returns the ID of the peer, which is empty for legacy peers.
+func (n *Node) Connect(hostport string) (id string, err error) {
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		hostport = peerAddr(hostport, 0)
+	}
+
+	return n.introduce(hostport, nil)
+}
+
+// introduce sends a hello to the peer at addr with our peer and table, and
+// takes its own from the answer.
+// check, if not nil, is given the peer proved by the session handshake, or
+// nil for legacy peers, before anything is sent.
+func (n *Node) introduce(addr string, check func(peer *Peer) error) (id string, err error) {
+	c, legacy, err := n.dialConn(addr, check)
+
+	if err != nil {
+		return "", err
+	}
+
+	if legacy != nil {
+		defer legacy.Close()
+
+		if check != nil {
+			err = check(nil)
+
+			if err != nil {
+				return "", err
+			}
+		}
+
+		err = n.sendLegacyPeer(legacy, legacyHello)
+
+		if err != nil {
+			return "", fmt.Errorf("cosmofs: cannot authenticate with %s: %w", addr, err)
+		}
+
+		return "", err
+	}
+
+	peer := c.peer
+
+	err = n.CheckDenied(peer)
+
+	if err != nil {
+		c.Close()
+		return "", err
+	}
+
+	n.debug("TCP DIAL DONE\n")
+
+	n.debug("Protocol %d with %s, features %#x\n", c.sess.Protocol, peer.ID, c.sess.Features)
+
+	hello, err := n.newHello(c.sess.Features, nil)
+
+	if err != nil {
+		return "", err
+	}
+
+	// The peer answers with its own peer and table.
+	var answer HelloMessage
+
+	err = c.call(MsgHello, hello, &answer, n.config.PeerTimeout)
+
+	if err != nil {
+		return "", fmt.Errorf("cosmofs: cannot introduce ourselves to %s: %w", addr, err)
+	}
+
+	err = n.checkHello(peer, &answer, c.sess.Features)
+
+	if err != nil {
+		log.Printf("Rejecting peer %s from %s: %s\n", answer.Peer.ID, addr, err)
+		return "", err
+	}
+
+	n.ConnectedPeer(peer.ID, addr)
+
+	log.Printf("CONNECTED: %v\n", n.ConnectedPeers())
+
+	n.mergeTable(peer.ID, answer.Table, c.sess)
+
+	return peer.ID, err
+}
+
+// bootstrap connects to the peers of the configuration, which cannot be
+// discovered.
+func (n *Node) bootstrap() {
+	defer n.wg.Done()
+
+	var wg sync.WaitGroup
+
+	for _, addr := range n.config.Bootstrap {
+		wg.Add(1)
+
+		go func(addr string) {
+			defer wg.Done()
+
+			id, err := n.Connect(addr)
+
+			if err != nil {
+				log.Printf("Error connecting to bootstrap peer %s: %s\n", addr, err)
+				return
+			}
+
+			log.Printf("Connected to bootstrap peer %s at %s\n", id, addr)
+		}(addr)
+	}
+
+	wg.Wait()
+
+	if n.dht != nil {
+		n.RefreshDHT()
+	}
+}
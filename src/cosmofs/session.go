@@ -0,0 +1,487 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Every peer to peer connection starts with this line. The rest of the
+// conversation goes encrypted through a Session.
+const SessionPreamble string = "Secure Session"
+
+const (
+	sessionContext string = "cosmofs-session-v1"
+	sessionKeySize int = 32
+	maxRecordSize int = 64 * 1024
+	handshakeTimeout = 30 * time.Second
+)
+
+var (
+	ErrLegacyPeer = errors.New("cosmofs: remote peer closed the connection during session negotiation; it is probably a legacy peer without encrypted transport")
+	ErrBadRecord = newError(ErrIntegrity, "cosmofs: malformed or tampered session record")
+)
+
+// hello is the first message of the session handshake. Ephemeral is an
+// X25519 public key; the long term identity of the peer signs the transcript.
+// Protocol and Features are what the peer offers, see negotiate.
+type hello struct {
+	Peer Peer
+	Ephemeral []byte
+	Nonce []byte
+	Protocol int
+	Features uint32
+}
+
+// Session is an encrypted and authenticated connection with a remote peer.
+// Keys are derived from an ephemeral X25519 exchange which both sides sign
+// with the keys of their identities, so Peer is known to be genuine.
+type Session struct {
+	Peer *Peer
+
+	// Networks are the names of the networks shared with Peer.
+	Networks []string
+
+	// Protocol and Features are the version and features agreed with Peer.
+	Protocol int
+	Features uint32
+
+	conn net.Conn
+	reader *bufio.Reader
+
+	sealer cipher.AEAD
+	opener cipher.AEAD
+	sendSeq uint64
+	recvSeq uint64
+
+	pending []byte
+}
+
+// DialSession connects to a remote peer and negotiates an encrypted session.
+// ErrLegacyPeer is returned when the remote side does not understand it.
+func (n *Node) DialSession(addr *net.TCPAddr) (s *Session, err error) {
+	conn, err := net.DialTimeout("tcp", addr.String(), handshakeTimeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write([]byte(SessionPreamble + "\n"))
+
+	if err == nil {
+		s, err = n.handshake(conn, bufio.NewReader(conn), true)
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return s, err
+}
+
+// AcceptSession runs the server side of the handshake once SessionPreamble
+// has been read from reader, which must be the buffered reader of conn.
+func (n *Node) AcceptSession(conn net.Conn, reader *bufio.Reader) (s *Session, err error) {
+	return n.handshake(conn, reader, false)
+}
+
+func (n *Node) handshake(conn net.Conn, reader *bufio.Reader, initiator bool) (s *Session, err error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, challengeSize)
+
+	_, err = rand.Read(nonce)
+
+	if err != nil {
+		return nil, err
+	}
+
+	n.markNonce(nonce)
+
+	local := hello{
+		Peer: *n.pub,
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Nonce: nonce,
+	}
+
+	local.Protocol, local.Features = n.offer()
+
+	var remote hello
+
+	encod := gob.NewEncoder(conn)
+	decod := gob.NewDecoder(reader)
+
+	if initiator {
+		err = encod.Encode(local)
+
+		if err == nil {
+			err = decod.Decode(&remote)
+
+			if isClosed(err) {
+				err = ErrLegacyPeer
+			}
+		}
+	} else {
+		err = decod.Decode(&remote)
+
+		if err == nil {
+			err = encod.Encode(local)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if remote.Peer.PubKey == nil || len(remote.Nonce) != challengeSize {
+		return nil, ErrBadChallenge
+	}
+
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(remote.Ephemeral)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if n.downgraded(&remote) {
+		return nil, ErrDowngrade
+	}
+
+	protocol, features, err := n.negotiate(remote.Protocol, remote.Features)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var transcript []byte
+
+	if initiator {
+		transcript, err = sessionTranscript(&local, &remote)
+	} else {
+		transcript, err = sessionTranscript(&remote, &local)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Each side signs the transcript, which proves possession of the key of
+	// its identity and binds it to the ephemeral keys of this session.
+	proof, err := n.signDigest(proofDigest(transcript, initiator))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var remoteProof []byte
+
+	if initiator {
+		err = encod.Encode(proof)
+
+		if err == nil {
+			err = decod.Decode(&remoteProof)
+		}
+	} else {
+		err = decod.Decode(&remoteProof)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyDigest(remote.Peer.PubKey, proofDigest(transcript, !initiator), remoteProof)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !initiator {
+		err = encod.Encode(proof)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Both sides prove they are in their networks, bound to this session.
+	tags := n.membershipTags(networkDigest(transcript, initiator))
+
+	var remoteTags [][]byte
+
+	if initiator {
+		err = encod.Encode(tags)
+
+		if err == nil {
+			err = decod.Decode(&remoteTags)
+		}
+	} else {
+		err = decod.Decode(&remoteTags)
+
+		if err == nil {
+			err = encod.Encode(tags)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	networks, ok := n.sharedNetworks(remoteTags, networkDigest(transcript, !initiator))
+
+	if !ok {
+		return nil, ErrNoSharedNetwork
+	}
+
+	shared, err := ephemeral.ECDH(remoteEphemeral)
+
+	if err != nil {
+		return nil, err
+	}
+
+	toResponder, err := sessionCipher(shared, transcript, "initiator to responder")
+
+	if err != nil {
+		return nil, err
+	}
+
+	toInitiator, err := sessionCipher(shared, transcript, "responder to initiator")
+
+	if err != nil {
+		return nil, err
+	}
+
+	s = &Session{
+		Peer: &remote.Peer,
+		Networks: networks,
+		Protocol: protocol,
+		Features: features,
+		conn: conn,
+		reader: reader,
+	}
+
+	if initiator {
+		s.sealer, s.opener = toResponder, toInitiator
+	} else {
+		s.sealer, s.opener = toInitiator, toResponder
+	}
+
+	return s, err
+}
+
+// sessionTranscript hashes both hello messages, initiator first. What they
+// offered is left out when either side is of the first version, which knows
+// nothing of it; otherwise it cannot be changed on the way. Removing the
+// offer altogether is caught by the nonce, see markNonce.
+func sessionTranscript(initiator, responder *hello) (transcript []byte, err error) {
+	h := sha256.New()
+
+	fmt.Fprintf(h, "%s\x00", sessionContext)
+
+	for _, m := range []*hello{initiator, responder} {
+		key, err := x509.MarshalPKIXPublicKey(m.Peer.PubKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fmt.Fprintf(h, "%s\x00", m.Peer.ID)
+		writeField(h, key)
+		writeField(h, m.Ephemeral)
+		writeField(h, m.Nonce)
+	}
+
+	if initiator.Protocol != 0 && responder.Protocol != 0 {
+		fmt.Fprintf(h, "%d\x00%d\x00%d\x00%d\x00", initiator.Protocol,
+			initiator.Features, responder.Protocol, responder.Features)
+	}
+
+	return h.Sum(nil), err
+}
+
+func proofDigest(transcript []byte, initiator bool) []byte {
+	h := sha256.New()
+
+	if initiator {
+		fmt.Fprintf(h, "%s initiator\x00", sessionContext)
+	} else {
+		fmt.Fprintf(h, "%s responder\x00", sessionContext)
+	}
+
+	h.Write(transcript)
+
+	return h.Sum(nil)
+}
+
+func sessionCipher(shared, transcript []byte, direction string) (aead cipher.AEAD, err error) {
+	key, err := hkdf.Key(sha256.New, shared, transcript, sessionContext+" "+direction, sessionKeySize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// writeField writes a length prefixed field, so that the concatenation of
+// several of them is unambiguous.
+func writeField(w io.Writer, field []byte) {
+	var length [4]byte
+
+	binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+	w.Write(length[:])
+	w.Write(field)
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET)
+}
+
+func recordNonce(seq uint64, size int) []byte {
+	nonce := make([]byte, size)
+
+	binary.BigEndian.PutUint64(nonce[size-8:], seq)
+
+	return nonce
+}
+
+// Write encrypts p into one or more records.
+func (s *Session) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+
+		if len(chunk) > maxRecordSize {
+			chunk = chunk[:maxRecordSize]
+		}
+
+		record := make([]byte, 4, 4+len(chunk)+s.sealer.Overhead())
+
+		binary.BigEndian.PutUint32(record, uint32(len(chunk)+s.sealer.Overhead()))
+
+		record = s.sealer.Seal(record, recordNonce(s.sendSeq, s.sealer.NonceSize()), chunk, record[:4])
+		s.sendSeq++
+
+		_, err = s.conn.Write(record)
+
+		if err != nil {
+			return n, err
+		}
+
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+
+	return n, err
+}
+
+// Read decrypts the next record when there is no pending plain text left.
+func (s *Session) Read(p []byte) (n int, err error) {
+	if len(s.pending) == 0 {
+		var header [4]byte
+
+		_, err = io.ReadFull(s.reader, header[:])
+
+		if err != nil {
+			return 0, err
+		}
+
+		length := binary.BigEndian.Uint32(header[:])
+
+		if length > uint32(maxRecordSize+s.opener.Overhead()) {
+			return 0, ErrBadRecord
+		}
+
+		record := make([]byte, length)
+
+		_, err = io.ReadFull(s.reader, record)
+
+		if err != nil {
+			return 0, err
+		}
+
+		s.pending, err = s.opener.Open(record[:0], recordNonce(s.recvSeq, s.opener.NonceSize()), record, header[:])
+
+		if err != nil {
+			return 0, ErrBadRecord
+		}
+
+		s.recvSeq++
+	}
+
+	n = copy(p, s.pending)
+	s.pending = s.pending[n:]
+
+	return n, err
+}
+
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+func (s *Session) SetDeadline(t time.Time) error {
+	return s.conn.SetDeadline(t)
+}
+
+func (s *Session) SetReadDeadline(t time.Time) error {
+	return s.conn.SetReadDeadline(t)
+}
+
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	return s.conn.SetWriteDeadline(t)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
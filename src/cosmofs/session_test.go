@@ -0,0 +1,275 @@
+package cosmofs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	n := newTestNode(t, "session@cosmofs.es")
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+
+	defer ln.Close()
+
+	payload := bytes.Repeat([]byte("cosmofs"), 3*maxRecordSize/7)
+
+	go func() {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+
+		line, _ := reader.ReadString('\n')
+
+		if line != SessionPreamble+"\n" {
+			return
+		}
+
+		s, err := n.AcceptSession(conn, reader)
+
+		if err != nil {
+			return
+		}
+
+		// Echo everything back
+		io.CopyN(s, s, int64(len(payload)))
+	}()
+
+	s, err := n.DialSession(ln.Addr().(*net.TCPAddr))
+
+	if err != nil {
+		t.Fatal("Failure in DialSession:", err)
+	}
+
+	defer s.Close()
+
+	if s.Peer.ID != n.ID() {
+		t.Error("Failure in DialSession. Wrong remote peer:", s.Peer.ID)
+	}
+
+	go s.Write(payload)
+
+	echo := make([]byte, len(payload))
+
+	_, err = io.ReadFull(s, echo)
+
+	if err != nil || !bytes.Equal(echo, payload) {
+		t.Error("Failure in Session. Echoed data differs:", err)
+	}
+}
+
+func TestSessionLegacyPeer(t *testing.T) {
+	n := newTestNode(t, "legacy@cosmofs.es")
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal("Error listening:", err)
+	}
+
+	defer ln.Close()
+
+	// A legacy peer reads an unknown command and hangs up.
+	go func() {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			return
+		}
+
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}()
+
+	_, err = n.DialSession(ln.Addr().(*net.TCPAddr))
+
+	if err != ErrLegacyPeer {
+		t.Error("Failure in DialSession. Expected ErrLegacyPeer, got:", err)
+	}
+}
+
+func TestSessionDowngrade(t *testing.T) {
+	n := newTestNode(t, "downgrade@cosmofs.es")
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal("Error generating key:", err)
+	}
+
+	for _, marked := range []bool{true, false} {
+		conn, mitm := net.Pipe()
+
+		done := make(chan error, 1)
+
+		go func() {
+			_, err := n.AcceptSession(conn, bufio.NewReader(conn))
+			done <- err
+		}()
+
+		// A hello which offers nothing, as peers of the first version send
+		// and as left by someone removing the offer on the way.
+		nonce := make([]byte, challengeSize)
+
+		if marked {
+			n.markNonce(nonce)
+		}
+
+		stripped := hello{Peer: *n.pub, Ephemeral: ephemeral.PublicKey().Bytes(), Nonce: nonce}
+
+		go gob.NewDecoder(mitm).Decode(&hello{})
+
+		err = gob.NewEncoder(mitm).Encode(stripped)
+
+		if err != nil {
+			t.Fatal("Error sending hello:", err)
+		}
+
+		// The first version goes on, waiting for the proof.
+		if !marked {
+			mitm.Close()
+		}
+
+		err = <-done
+
+		if marked && err != ErrDowngrade {
+			t.Error("Failure in AcceptSession. Expected ErrDowngrade, got:", err)
+		}
+
+		if !marked && err == ErrDowngrade {
+			t.Error("Failure in AcceptSession. Refused a peer of the first version.")
+		}
+
+		mitm.Close()
+		conn.Close()
+	}
+}
+
+func TestSessionChangedKey(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	err := a.Start()
+
+	if err != nil {
+		t.Fatal("Failure in Start:", err)
+	}
+
+	defer a.Close()
+
+	// alice knows bob by another key.
+	old, _ := newTestPeer(t, "bob@cosmofs.es")
+
+	err = a.StorePeer(old)
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	s, err := b.DialSession(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.Port()})
+
+	if err == nil {
+		defer s.Close()
+
+		err = Call(s, MsgHeartbeat, heartbeat{}, nil)
+	}
+
+	if err == nil {
+		t.Error("Failure in handleTCPPetition. A changed key was served.")
+	}
+
+	pending := waitFor(func() bool {
+		for _, f := range a.ListFingerprints() {
+			if f.ID == b.ID() && f.Pending != "" {
+				return true
+			}
+		}
+
+		return false
+	})
+
+	if !pending {
+		t.Error("Failure in handleTCPPetition. The changed key was not kept aside.")
+	}
+}
+
+// TestDialChangedKey makes sure changed keys are kept aside for the user
+// when we are the ones dialing, after a beacon or to connect.
+func TestDialChangedKey(t *testing.T) {
+	a := newTestNode(t, "alice@cosmofs.es")
+	b := newTestNode(t, "bob@cosmofs.es")
+
+	for _, n := range []*Node{a, b} {
+		err := n.Start()
+
+		if err != nil {
+			t.Fatal("Failure in Start:", err)
+		}
+
+		defer n.Close()
+	}
+
+	// bob knows alice by another key.
+	old, _ := newTestPeer(t, "alice@cosmofs.es")
+
+	err := b.StorePeer(old)
+
+	if err != nil {
+		t.Fatal("Failure in StorePeer:", err)
+	}
+
+	beacon, err := a.newBeacon()
+
+	if err != nil {
+		t.Fatal("Failure in newBeacon:", err)
+	}
+
+	b.handleBeacon(beacon, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: a.Port()})
+
+	pending := false
+
+	for _, f := range b.ListFingerprints() {
+		if f.ID == a.ID() && f.Pending == a.PublicPeer().Fingerprint() {
+			pending = true
+		}
+	}
+
+	if !pending {
+		t.Error("Failure in handleBeacon. The changed key was not kept aside.")
+	}
+
+	_, err = b.Connect(peerAddr("127.0.0.1", a.Port()))
+
+	if !errors.Is(err, ErrKeyChanged) {
+		t.Error("Failure in Connect. A changed key answered with:", err)
+	}
+
+	err = b.AcceptPeerKey(a.ID())
+
+	if err != nil {
+		t.Fatal("Failure in AcceptPeerKey:", err)
+	}
+
+	_, err = b.Connect(peerAddr("127.0.0.1", a.Port()))
+
+	if err != nil {
+		t.Error("Failure in Connect after accepting the key:", err)
+	}
+}
@@ -0,0 +1,278 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"sort"
+	"sync"
+)
+
+// SharedTable is an IDTable that can be used from several goroutines. Lookups
+// share a read lock, changes take the write lock, and Snapshot returns a copy
+// to encode or walk without holding either. The version grows with every
+// change, so peers can tell whether they have seen the table already.
+type SharedTable struct {
+	mu sync.RWMutex
+	t IDTable
+	version uint64
+}
+
+func NewSharedTable() *SharedTable {
+	return &SharedTable{
+		t: make(IDTable),
+	}
+}
+
+// Snapshot returns a deep copy of the table.
+func (s *SharedTable) Snapshot() IDTable {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.t.copy()
+}
+
+// Version returns the number of changes made to the table.
+func (s *SharedTable) Version() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.version
+}
+
+// Files returns a copy of the files of dir shared by id.
+func (s *SharedTable) Files(id, dir string) FileList {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.t[id][dir].copy()
+}
+
+func (s *SharedTable) AddID(id string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+
+	return s.t.AddID(id)
+}
+
+func (s *SharedTable) AddDir(id, dir, baseDir string, recursive bool) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+
+	return s.t.AddDir(id, dir, baseDir, recursive)
+}
+
+func (s *SharedTable) DeleteID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+
+	s.t.DeleteID(id)
+}
+
+func (s *SharedTable) DeleteDir(id, dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+
+	s.t.DeleteDir(id, dir)
+}
+
+func (s *SharedTable) ListIDs() (ids []string, err error) {
+	s.mu.RLock()
+	ids, err = s.t.ListIDs()
+	s.mu.RUnlock()
+
+	sort.Strings(ids)
+
+	return ids, err
+}
+
+func (s *SharedTable) ListAllDirs() (dirs []string, err error) {
+	s.mu.RLock()
+	dirs, err = s.t.ListAllDirs()
+	s.mu.RUnlock()
+
+	sort.Strings(dirs)
+
+	return dirs, err
+}
+
+func (s *SharedTable) ListDirs(id string) (dirs []string, err error) {
+	s.mu.RLock()
+	dirs, err = s.t.ListDirs(id)
+	s.mu.RUnlock()
+
+	sort.Strings(dirs)
+
+	return dirs, err
+}
+
+func (s *SharedTable) ListDir(id, dir string) (content []string, err error) {
+	s.mu.RLock()
+	content, err = s.t.ListDir(id, dir)
+	s.mu.RUnlock()
+
+	sort.Strings(content)
+
+	return content, err
+}
+
+func (s *SharedTable) ExistsID(id string) (i string, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.t.ExistsID(id)
+}
+
+func (s *SharedTable) ExistsDir(id, dir string) (err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.t.ExistsDir(id, dir)
+}
+
+func (s *SharedTable) SearchDir(dir string) (result []string, err error) {
+	s.mu.RLock()
+	result, err = s.t.SearchDir(dir)
+	s.mu.RUnlock()
+
+	sort.Strings(result)
+
+	return result, err
+}
+
+func (s *SharedTable) SearchFile(name string) (result []string, err error) {
+	s.mu.RLock()
+	result, err = s.t.SearchFile(name)
+	s.mu.RUnlock()
+
+	sort.Strings(result)
+
+	return result, err
+}
+
+func (s *SharedTable) Search(str string) (result []string, err error) {
+	s.mu.RLock()
+	result, err = s.t.Search(str)
+	s.mu.RUnlock()
+
+	sort.Strings(result)
+
+	return result, err
+}
+
+// Merge adds the directories of t that are not in the table yet.
+func (s *SharedTable) Merge(t IDTable) (added int) {
+	t = t.copy()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added = s.t.Merge(t)
+
+	if added > 0 {
+		s.version++
+	}
+
+	return added
+}
+
+// update replaces the directories of the table that are in t, the way
+// decoding a config file over the table did.
+func (s *SharedTable) update(t IDTable) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.version++
+
+	for id, dirs := range t {
+		s.t.AddID(id)
+
+		for dir, files := range dirs {
+			s.t[id][dir] = files
+		}
+	}
+}
+
+// setOnline sets the Online flag of the files of every ID but self.
+func (s *SharedTable) setOnline(self string, online func(id string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, dirs := range s.t {
+		if id == self {
+			continue
+		}
+
+		isOnline := online(id)
+
+		for _, files := range dirs {
+			for _, file := range files {
+				file.Online = isOnline
+			}
+		}
+	}
+}
+
+func (s *SharedTable) setOwner(id string, owner *Peer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.t.setOwner(id, owner)
+}
+
+// copy returns a deep copy of the table. Owners are shared, peers are never
+// modified.
+func (t IDTable) copy() IDTable {
+	c := make(IDTable, len(t))
+
+	for id, dirs := range t {
+		c[id] = make(DirTable, len(dirs))
+
+		for dir, files := range dirs {
+			c[id][dir] = files.copy()
+		}
+	}
+
+	return c
+}
+
+func (l FileList) copy() FileList {
+	if l == nil {
+		return nil
+	}
+
+	c := make(FileList, len(l))
+
+	for i, file := range l {
+		f := *file
+		c[i] = &f
+	}
+
+	return c
+}
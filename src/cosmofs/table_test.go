@@ -0,0 +1,92 @@
+package cosmofs
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestSharedTableConcurrent(t *testing.T) {
+	table := NewSharedTable()
+
+	const workers = 8
+	const rounds = 50
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(2)
+
+		// Peers sending their tables
+		go func(w int) {
+			defer wg.Done()
+
+			for i := 0; i < rounds; i++ {
+				id := fmt.Sprintf("peer%d@cosmofs.es", w)
+				dir := fmt.Sprintf("out%d", i)
+
+				table.Merge(IDTable{
+					id: DirTable{
+						dir: FileList{{Filename: "file" + dir, GlobalPath: id + "/" + dir}},
+					},
+				})
+
+				if i%10 == 0 {
+					table.DeleteDir(id, dir)
+				}
+			}
+		}(w)
+
+		// Clients and peers reading it meanwhile
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < rounds; i++ {
+				dirs, _ := table.ListAllDirs()
+
+				if !sort.StringsAreSorted(dirs) {
+					t.Error("Failure in ListAllDirs. Unsorted result.")
+				}
+
+				table.Search("out")
+				table.SearchFile("file")
+				table.ListIDs()
+
+				err := gob.NewEncoder(&bytes.Buffer{}).Encode(table.Snapshot())
+
+				if err != nil {
+					t.Error("Failure encoding Snapshot:", err)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	dirs, err := table.ListAllDirs()
+
+	if err != nil || len(dirs) != workers*(rounds-rounds/10) {
+		t.Error("Failure in Merge. Wrong number of dirs:", len(dirs), err)
+	}
+}
+
+func TestSharedTableSnapshot(t *testing.T) {
+	table := NewSharedTable()
+
+	table.Merge(IDTable{
+		"a@cosmofs.es": DirTable{"out1": FileList{{Filename: "a"}}},
+	})
+
+	snapshot := table.Snapshot()
+	snapshot["a@cosmofs.es"]["out1"][0].Filename = "changed"
+	delete(snapshot, "a@cosmofs.es")
+
+	files := table.Files("a@cosmofs.es", "out1")
+
+	if len(files) != 1 || files[0].Filename != "a" {
+		t.Error("Failure in Snapshot. Changes reached the table.")
+	}
+}
@@ -0,0 +1,637 @@
+/**
+
+Copyright (C) 2012  Roberto Costumero Moreno <roberto@costumero.es>
+
+This file is part of Cosmofs.
+
+Cosmofs is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+Cosmofs is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with Cosmofs.  If not, see <http://www.gnu.org/licenses/>.
+
+**/
+
+package cosmofs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+// Peers and local clients talk with frames: a header with the version of
+// the protocol, the type of the message, the ID of the request it belongs to
+// and the length of the body, which is a gob encoded value of the type of
+// the message. Answers carry the ID of their request.
+//
+// Legacy peers still use lines with the name of the petition, see
+// serveLegacy.
+const (
+	// WireVersion is the version of the framed protocol. The line based
+	// one of legacy peers is the first.
+	WireVersion uint8 = 2
+
+	frameMagic byte = 0xcf
+	frameHeaderSize int = 16
+
+	// maxFrameSize bounds the body of a frame; files go whole in one.
+	maxFrameSize int = 256 << 20
+
+	flagResponse uint8 = 1 << 0
+
+	// flagMore tells that more chunks of the body follow, see peerConn.
+	flagMore uint8 = 1 << 1
+
+	// flagCompressed tells that the body is compressed, once whole. Only
+	// sent to peers which agreed on FeatureCompression.
+	flagCompressed uint8 = 1 << 2
+)
+
+// MsgType is the type of a message, which tells the type of its body.
+type MsgType uint16
+
+// Messages between peers.
+const (
+	MsgError MsgType = iota + 1
+	MsgHello
+	MsgOpenFile
+	MsgHeartbeat
+	MsgGoodbye
+	MsgRevocation
+	MsgDHT
+	MsgPeerExchange
+	MsgRelay
+	MsgRelayOpen
+	MsgWindow
+)
+
+// Messages of local clients.
+const (
+	MsgListDirs MsgType = iota + 64
+	MsgListDirsID
+	MsgListDir
+	MsgListKnownIDs
+	MsgListConnected
+	MsgPeerStatus
+	MsgSearch
+	MsgSearchDir
+	MsgSearchFile
+	MsgLocalOpenFile
+	MsgListFingerprints
+	MsgAcceptKey
+	MsgExportPeers
+	MsgImportPeers
+	MsgDenyPeer
+	MsgAllowPeer
+	MsgListDenied
+	MsgRevokeKey
+	MsgConnectPeer
+	MsgFindPeer
+	MsgFindFile
+)
+
+var msgNames = map[MsgType]string{
+	MsgError: "Error",
+	MsgHello: "Hello",
+	MsgOpenFile: "Open File",
+	MsgHeartbeat: "Heartbeat",
+	MsgGoodbye: "Goodbye",
+	MsgRevocation: "Revocation",
+	MsgDHT: "DHT",
+	MsgPeerExchange: "Peer Exchange",
+	MsgRelay: "Relay",
+	MsgRelayOpen: "Relay Open",
+	MsgWindow: "Window",
+
+	MsgListDirs: "List Directories",
+	MsgListDirsID: "List Directories ID",
+	MsgListDir: "List Directory",
+	MsgListKnownIDs: "List Known IDs",
+	MsgListConnected: "List Connected IDs",
+	MsgPeerStatus: "List Peer Status",
+	MsgSearch: "Search",
+	MsgSearchDir: "Search Directory",
+	MsgSearchFile: "Search File",
+	MsgLocalOpenFile: "Open File",
+	MsgListFingerprints: "List Fingerprints",
+	MsgAcceptKey: "Accept Key",
+	MsgExportPeers: "Export Peers",
+	MsgImportPeers: "Import Peers",
+	MsgDenyPeer: "Deny Peer",
+	MsgAllowPeer: "Allow Peer",
+	MsgListDenied: "List Denied",
+	MsgRevokeKey: "Revoke Key",
+	MsgConnectPeer: "Connect Peer",
+	MsgFindPeer: "Find Peer",
+	MsgFindFile: "Find File",
+}
+
+func (t MsgType) String() string {
+	if name, ok := msgNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("message type %d", uint16(t))
+}
+
+// Header starts every frame.
+type Header struct {
+	Version uint8
+	Type MsgType
+	Flags uint8
+	ID uint32
+	Length uint32
+}
+
+var ErrBadFrame = errors.New("cosmofs: malformed frame")
+
+// ErrorCode tells what kind of failure an error answer is.
+type ErrorCode uint16
+
+const (
+	CodeFailed ErrorCode = iota + 1
+	CodeBadVersion
+	CodeUnknownType
+	CodeBadRequest
+	CodeNotFound
+	CodeInvalidID
+	CodeInvalidPath
+	CodePermissionDenied
+	CodePeerOffline
+	CodeTimeout
+	CodeIntegrity
+)
+
+// errorKinds are the kinds of errors with a code of their own, in the order
+// they are looked for.
+var errorKinds = []struct {
+	code ErrorCode
+	kind error
+}{
+	{CodeNotFound, ErrNotFound},
+	{CodeInvalidID, ErrInvalidID},
+	{CodeInvalidPath, ErrInvalidPath},
+	{CodePermissionDenied, ErrPermissionDenied},
+	{CodePeerOffline, ErrPeerOffline},
+	{CodeTimeout, ErrTimeout},
+	{CodeIntegrity, ErrIntegrity},
+}
+
+// WireError is the body of the error answers. It is returned by call as
+// the error of the request, and unwraps to the kind of its code.
+type WireError struct {
+	Code ErrorCode
+	Message string
+}
+
+func (e *WireError) Error() string {
+	return e.Message
+}
+
+func (e *WireError) Unwrap() error {
+	for _, k := range errorKinds {
+		if k.code == e.Code {
+			return k.kind
+		}
+	}
+
+	return nil
+}
+
+// errorCode returns the code of the kind of err, CodeFailed if it has none.
+// Errors of the system are taken for the kind they mean.
+func errorCode(err error) ErrorCode {
+	var e *WireError
+
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	for _, k := range errorKinds {
+		if errors.Is(err, k.kind) {
+			return k.code
+		}
+	}
+
+	var ne net.Error
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return CodeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return CodePermissionDenied
+	case errors.As(err, &ne) && ne.Timeout():
+		return CodeTimeout
+	}
+
+	return CodeFailed
+}
+
+// Bodies of the messages. Messages without arguments or answers have no
+// body.
+type (
+	IDRequest struct {
+		ID string
+	}
+
+	PathRequest struct {
+		Path string
+	}
+
+	QueryRequest struct {
+		Query string
+	}
+
+	AddrRequest struct {
+		Addr string
+	}
+
+	EntryRequest struct {
+		Entry string
+	}
+
+	NameRequest struct {
+		Name string
+	}
+
+	DataMessage struct {
+		Data []byte
+	}
+
+	ListResponse struct {
+		Items []string
+	}
+
+	ConnectedResponse struct {
+		Peers map[string]string
+	}
+
+	StatusResponse struct {
+		Peers []PeerStatus
+	}
+
+	FingerprintsResponse struct {
+		Peers []PeerFingerprint
+	}
+
+	ResultResponse struct {
+		Result string
+	}
+
+	ContactsResponse struct {
+		Contacts []Contact
+	}
+
+	FileContent struct {
+		Content []byte
+	}
+
+	// HelloMessage introduces a peer with its table, both in Hello
+	// requests and their answers. It has to be the one proved by the
+	// session it comes through. Signature and Have depend on the features
+	// agreed, see newHello.
+	HelloMessage struct {
+		Peer Peer
+		Table IDTable
+		Signature []byte
+		Have []string
+	}
+)
+
+// writeFrame sends body, which may be nil, in one frame with the header h.
+func writeFrame(w io.Writer, h Header, body interface{}) (err error) {
+	data, err := encodeBody(body)
+
+	if err != nil {
+		return err
+	}
+
+	return writeChunk(w, h, data)
+}
+
+// encodeBody returns the gob encoding of body, or nothing for a nil body.
+func encodeBody(body interface{}) (data []byte, err error) {
+	if body == nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	err = gob.NewEncoder(&buf).Encode(body)
+
+	return buf.Bytes(), err
+}
+
+// writeChunk sends data, already encoded, in one frame with the header h.
+// The frame goes in a single Write.
+func writeChunk(w io.Writer, h Header, data []byte) (err error) {
+	if len(data) > maxFrameSize {
+		return ErrBadFrame
+	}
+
+	frame := make([]byte, frameHeaderSize+len(data))
+
+	frame[0] = frameMagic
+	frame[1] = WireVersion
+	binary.BigEndian.PutUint16(frame[2:], uint16(h.Type))
+	frame[4] = h.Flags
+	binary.BigEndian.PutUint32(frame[8:], h.ID)
+	binary.BigEndian.PutUint32(frame[12:], uint32(len(data)))
+
+	copy(frame[frameHeaderSize:], data)
+
+	_, err = w.Write(frame)
+
+	return err
+}
+
+// readFrame reads the next frame of r, refusing bodies larger than limit
+// before they are allocated. The version is checked by the caller, so it
+// can answer frames of other versions.
+func readFrame(r io.Reader, limit int) (h Header, body []byte, err error) {
+	var header [frameHeaderSize]byte
+
+	_, err = io.ReadFull(r, header[:])
+
+	if err != nil {
+		return h, nil, err
+	}
+
+	if header[0] != frameMagic {
+		return h, nil, ErrBadFrame
+	}
+
+	h = Header{
+		Version: header[1],
+		Type: MsgType(binary.BigEndian.Uint16(header[2:])),
+		Flags: header[4],
+		ID: binary.BigEndian.Uint32(header[8:]),
+		Length: binary.BigEndian.Uint32(header[12:]),
+	}
+
+	if h.Length > uint32(limit) {
+		return h, nil, ErrBadFrame
+	}
+
+	body = make([]byte, h.Length)
+
+	_, err = io.ReadFull(r, body)
+
+	if err != nil {
+		return h, nil, err
+	}
+
+	return h, body, err
+}
+
+// decodeBody decodes the body of a frame into v. Empty bodies leave v
+// untouched.
+func decodeBody(body []byte, v interface{}) (err error) {
+	if len(body) == 0 || v == nil {
+		return err
+	}
+
+	return gob.NewDecoder(bytes.NewReader(body)).Decode(v)
+}
+
+var requestIDs atomic.Uint32
+
+// Call sends a request of type t with body req through rw and decodes the
+// answer into resp. Both bodies may be nil. Error answers are returned as
+// *WireError. Local clients use it to talk to the control endpoint.
+func Call(rw io.ReadWriter, t MsgType, req, resp interface{}) (err error) {
+	id := requestIDs.Add(1)
+
+	err = writeFrame(rw, Header{Type: t, ID: id}, req)
+
+	if err != nil {
+		return err
+	}
+
+	h, body, err := readFrame(rw, maxFrameSize)
+
+	if err != nil {
+		return err
+	}
+
+	if h.ID != id || h.Flags&flagResponse == 0 {
+		return ErrBadFrame
+	}
+
+	return decodeAnswer(t, h, body, resp)
+}
+
+// decodeAnswer decodes the answer h to a request of type t into resp. Error
+// answers are returned as *WireError.
+func decodeAnswer(t MsgType, h Header, body []byte, resp interface{}) (err error) {
+	if h.Type == MsgError {
+		var e WireError
+
+		err = decodeBody(body, &e)
+
+		if err != nil {
+			return err
+		}
+
+		return &e
+	}
+
+	if h.Type != t {
+		return ErrBadFrame
+	}
+
+	return decodeBody(body, resp)
+}
+
+// request is a request being served.
+type request struct {
+	Header
+	body []byte
+
+	// rw is the connection, which is only used directly by the handlers
+	// that take it over.
+	rw io.ReadWriter
+
+	// peer is the one proved by the session, nil for local clients.
+	peer *Peer
+	remIP string
+
+	// features are the ones agreed with peer.
+	features uint32
+}
+
+// decode decodes the body of r into v.
+func (r *request) decode(v interface{}) (err error) {
+	err = decodeBody(r.body, v)
+
+	if err != nil {
+		return &WireError{Code: CodeBadRequest, Message: fmt.Sprintf("malformed %s request: %s", r.Type, err)}
+	}
+
+	return err
+}
+
+// handlerFunc serves a request and returns the body of the answer, which
+// may be nil.
+type handlerFunc func(n *Node, r *request) (resp interface{}, err error)
+
+// errTakenOver is returned by the handlers that have answered the request
+// themselves and keep the connection for something else.
+var errTakenOver = errors.New("cosmofs: connection taken over by the handler")
+
+// The handlers of each kind of connection. Relays take over a session of
+// their own, and streams relayed to us are only used to open files.
+var localHandlers, peerHandlers, streamHandlers, relayedHandlers map[MsgType]handlerFunc
+
+func init() {
+	localHandlers = map[MsgType]handlerFunc{
+		MsgListDirs: (*Node).listDirectories,
+		MsgListDirsID: (*Node).listDirectoriesID,
+		MsgListDir: (*Node).listDirectory,
+		MsgListKnownIDs: (*Node).listKnownIDs,
+		MsgListConnected: (*Node).listConnectedIDs,
+		MsgPeerStatus: (*Node).listPeerStatus,
+		MsgSearch: (*Node).search,
+		MsgSearchDir: (*Node).searchDir,
+		MsgSearchFile: (*Node).searchFile,
+		MsgLocalOpenFile: (*Node).openFile,
+		MsgListFingerprints: (*Node).listFingerprints,
+		MsgAcceptKey: (*Node).acceptKey,
+		MsgExportPeers: (*Node).exportPeers,
+		MsgImportPeers: (*Node).importPeers,
+		MsgDenyPeer: (*Node).denyPeer,
+		MsgAllowPeer: (*Node).allowPeer,
+		MsgListDenied: (*Node).listDenied,
+		MsgRevokeKey: (*Node).revokeKey,
+		MsgConnectPeer: (*Node).connectPeer,
+		MsgFindPeer: (*Node).findPeer,
+		MsgFindFile: (*Node).findFile,
+	}
+
+	peerHandlers = map[MsgType]handlerFunc{
+		MsgHello: (*Node).answerHello,
+		MsgOpenFile: (*Node).answerOpenFile,
+		MsgHeartbeat: (*Node).answerHeartbeat,
+		MsgGoodbye: (*Node).answerGoodbye,
+		MsgRevocation: (*Node).answerRevocation,
+		MsgDHT: (*Node).answerDHT,
+		MsgPeerExchange: (*Node).answerPeerExchange,
+	}
+
+	streamHandlers = map[MsgType]handlerFunc{
+		MsgRelay: (*Node).answerRelay,
+		MsgRelayOpen: (*Node).answerRelayed,
+	}
+
+	relayedHandlers = map[MsgType]handlerFunc{
+		MsgOpenFile: (*Node).answerOpenFile,
+	}
+}
+
+// serveFrames answers the requests read from rw with handlers, until the
+// connection is closed or taken over by a handler. peer is the one proved by
+// the session of rw, if any.
+func (n *Node) serveFrames(rw io.ReadWriter, handlers map[MsgType]handlerFunc, peer *Peer, remIP string) {
+	for {
+		h, body, err := readFrame(rw, maxFrameSize)
+
+		if err != nil {
+			if !isClosed(err) && !n.closed() {
+				n.debug("Error reading request from %s: %s\n", remIP, err)
+			}
+
+			return
+		}
+
+		r := &request{
+			Header: h,
+			body: body,
+			rw: rw,
+			peer: peer,
+			remIP: remIP,
+		}
+
+		if !n.serveRequest(r, handlers) {
+			return
+		}
+	}
+}
+
+// serveRequest answers r through its connection. It returns false if the
+// connection cannot be used anymore.
+func (n *Node) serveRequest(r *request, handlers map[MsgType]handlerFunc) bool {
+	resp, err := n.dispatch(r, handlers)
+
+	if err == errTakenOver {
+		return false
+	}
+
+	answer := Header{Type: r.Type, Flags: flagResponse, ID: r.ID}
+
+	if err != nil {
+		log.Printf("Error serving %s from %s: %s\n", r.Type, r.remIP, err)
+
+		answer.Type = MsgError
+		resp = wireError(err)
+	}
+
+	err = writeFrame(r.rw, answer, resp)
+
+	if err != nil {
+		n.debug("Error answering %s to %s: %s\n", r.Type, r.remIP, err)
+		return false
+	}
+
+	return true
+}
+
+// dispatch runs the handler of r. Requests of other versions and types we
+// do not know are answered with an error.
+func (n *Node) dispatch(r *request, handlers map[MsgType]handlerFunc) (resp interface{}, err error) {
+	if r.Version != WireVersion {
+		return nil, errBadVersion(r.Version)
+	}
+
+	handle, ok := handlers[r.Type]
+
+	if !ok || r.Flags&flagResponse != 0 {
+		return nil, &WireError{Code: CodeUnknownType, Message: fmt.Sprintf("unknown request: %s", r.Type)}
+	}
+
+	n.debug("%s from %s\n", r.Type, r.remIP)
+
+	return handle(n, r)
+}
+
+func errBadVersion(version uint8) *WireError {
+	return &WireError{
+		Code: CodeBadVersion,
+		Message: fmt.Sprintf("unsupported protocol version %d, this node speaks version %d", version, WireVersion),
+	}
+}
+
+// wireError returns the body of the error answer for err.
+func wireError(err error) *WireError {
+	var e *WireError
+
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return &WireError{Code: errorCode(err), Message: err.Error()}
+}
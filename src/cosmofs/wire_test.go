@@ -0,0 +1,181 @@
+package cosmofs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+
+	err := writeFrame(&buf, Header{Type: MsgListDir, ID: 42}, PathRequest{Path: "alice@cosmofs.es/out1"})
+
+	if err != nil {
+		t.Fatal("Failure in writeFrame:", err)
+	}
+
+	err = writeFrame(&buf, Header{Type: MsgHeartbeat, Flags: flagResponse, ID: 43}, nil)
+
+	if err != nil {
+		t.Fatal("Failure in writeFrame:", err)
+	}
+
+	h, body, err := readFrame(&buf, maxFrameSize)
+
+	if err != nil {
+		t.Fatal("Failure in readFrame:", err)
+	}
+
+	var req PathRequest
+
+	err = decodeBody(body, &req)
+
+	if err != nil || h.Version != WireVersion || h.Type != MsgListDir || h.ID != 42 || req.Path != "alice@cosmofs.es/out1" {
+		t.Errorf("Failure in readFrame. Got %+v %+v: %v", h, req, err)
+	}
+
+	h, body, err = readFrame(&buf, maxFrameSize)
+
+	if err != nil || h.Type != MsgHeartbeat || h.Flags != flagResponse || h.ID != 43 || len(body) != 0 {
+		t.Errorf("Failure in readFrame. Got %+v with %d bytes: %v", h, len(body), err)
+	}
+
+	_, _, err = readFrame(bytes.NewReader([]byte("General TCP\nalice@cosmofs.es\n")), maxFrameSize)
+
+	if err != ErrBadFrame {
+		t.Error("Failure in readFrame. A line was taken as a frame:", err)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	n := newTestNode(t, "alice@cosmofs.es")
+
+	client, server := net.Pipe()
+
+	defer client.Close()
+
+	go func() {
+		n.serveFrames(server, localHandlers, nil, "pipe")
+		server.Close()
+	}()
+
+	var ids ListResponse
+
+	err := Call(client, MsgListKnownIDs, nil, &ids)
+
+	if err != nil || len(ids.Items) != 1 || ids.Items[0] != n.ID() {
+		t.Errorf("Failure in Call. Got %v: %v", ids.Items, err)
+	}
+
+	// Peer requests are unknown to the local endpoint
+	var e *WireError
+
+	err = Call(client, MsgHello, nil, nil)
+
+	if !errors.As(err, &e) || e.Code != CodeUnknownType {
+		t.Error("Failure in dispatch. Unknown request answered with:", err)
+	}
+
+	// Frames of other versions are refused, but the connection goes on
+	var buf bytes.Buffer
+
+	writeFrame(&buf, Header{Type: MsgListKnownIDs, ID: 7}, nil)
+
+	frame := buf.Bytes()
+	frame[1] = WireVersion + 1
+
+	go client.Write(frame)
+
+	h, body, err := readFrame(client, maxFrameSize)
+
+	if err != nil || h.Type != MsgError || h.ID != 7 {
+		t.Fatalf("Failure in dispatch. Got %+v: %v", h, err)
+	}
+
+	e = new(WireError)
+
+	err = decodeBody(body, e)
+
+	if err != nil || e.Code != CodeBadVersion {
+		t.Errorf("Failure in dispatch. Got %+v: %v", e, err)
+	}
+
+	err = Call(client, MsgListKnownIDs, nil, &ids)
+
+	if err != nil {
+		t.Error("Failure in Call after an error:", err)
+	}
+
+	// Errors of the DHT reach the client
+	var contacts ContactsResponse
+
+	err = Call(client, MsgFindPeer, IDRequest{ID: "bob@cosmofs.es"}, &contacts)
+
+	if !errors.As(err, &e) || e.Message != ErrDHTDisabled.Error() {
+		t.Error("Failure in findPeer. DHT not enabled answered with:", err)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	tests := []struct {
+		err error
+		code ErrorCode
+		kind error
+	}{
+		{notFound("alice@cosmofs.es/out1"), CodeNotFound, ErrNotFound},
+		{ErrPeerDenied, CodePermissionDenied, ErrPermissionDenied},
+		{ErrConnClosed, CodePeerOffline, ErrPeerOffline},
+		{ErrTimeout, CodeTimeout, ErrTimeout},
+		{ErrBadRecord, CodeIntegrity, ErrIntegrity},
+		{fs.ErrNotExist, CodeNotFound, ErrNotFound},
+		{errors.New("cosmofs: anything else"), CodeFailed, nil},
+	}
+
+	for _, test := range tests {
+		e := wireError(test.err)
+
+		if e.Code != test.code || e.Message != test.err.Error() || !errors.Is(e, test.kind) && test.kind != nil {
+			t.Errorf("Failure in wireError of %v. Got %+v", test.err, e)
+		}
+	}
+
+	if peerOffline("alice@cosmofs.es", ErrPeerDenied) != ErrPeerDenied {
+		t.Error("Failure in peerOffline. The kind of the error was lost.")
+	}
+
+	// The kind goes over the wire.
+	n := newTestNode(t, "alice@cosmofs.es")
+
+	client, server := net.Pipe()
+
+	defer client.Close()
+
+	go func() {
+		n.serveFrames(server, localHandlers, nil, "pipe")
+		server.Close()
+	}()
+
+	var dirs ListResponse
+
+	err := Call(client, MsgListDirsID, IDRequest{ID: "bob@cosmofs.es"}, &dirs)
+
+	if !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "bob@cosmofs.es") {
+		t.Error("Failure in Call. Unknown ID answered with:", err)
+	}
+
+	err = Call(client, MsgListDir, PathRequest{Path: "bob"}, &dirs)
+
+	if !errors.Is(err, ErrInvalidPath) {
+		t.Error("Failure in Call. Invalid path answered with:", err)
+	}
+
+	err = Call(client, MsgSearch, QueryRequest{Query: "nothing"}, &dirs)
+
+	if err != nil || len(dirs.Items) != 0 {
+		t.Errorf("Failure in Call. Empty search answered with %v: %v", dirs.Items, err)
+	}
+}